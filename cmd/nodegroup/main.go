@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/config"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+)
+
+func main() {
+	create := flag.String("create", "", "Path to a JSON file describing a new node to create in the given groups")
+	nodeID := flag.Int64("node", 0, "ID of the node whose groups should be replaced")
+	planID := flag.Int64("plan", 0, "ID of the plan whose node groups should be replaced")
+	groups := flag.String("groups", "", "Comma separated node group IDs, empty to clear")
+	flag.Parse()
+
+	targets := 0
+	for _, set := range []bool{*create != "", *nodeID > 0, *planID > 0} {
+		if set {
+			targets++
+		}
+	}
+	groupIDs, err := parseIDs(*groups)
+	if targets != 1 || err != nil {
+		fmt.Println("Usage: go run cmd/nodegroup/main.go (-create <node.json> | -node <node_id> | -plan <plan_id>) -groups <id,id,...>")
+		os.Exit(1)
+	}
+
+	// Load Config
+	if err := config.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Init DB
+	dbConfig := config.Database()
+
+	if err := db.InitDB(dbConfig); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	// Init Redis so that cached node user lists are invalidated
+	if err := cache.InitRedis(config.Redis()); err != nil {
+		log.Printf("Warning: Failed to initialize Redis: %v", err)
+	}
+
+	switch {
+	case *create != "":
+		data, err := os.ReadFile(*create)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *create, err)
+		}
+		var node model.Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			log.Fatalf("Failed to parse %s: %v", *create, err)
+		}
+		node.ID = 0
+		if err := service.NewNodeService().CreateNode(&node, groupIDs); err != nil {
+			log.Fatalf("Failed to create node: %v", err)
+		}
+		fmt.Printf("Node:   %d (%s)\n", node.ID, node.Name)
+	case *nodeID > 0:
+		if err := service.NewNodeService().SetNodeGroups(*nodeID, groupIDs); err != nil {
+			log.Fatalf("Failed to set groups for node %d: %v", *nodeID, err)
+		}
+		fmt.Printf("Node:   %d\n", *nodeID)
+	default:
+		if err := service.NewSubscriptionService().SetPlanNodeGroups(*planID, groupIDs); err != nil {
+			log.Fatalf("Failed to set node groups for plan %d: %v", *planID, err)
+		}
+		fmt.Printf("Plan:   %d\n", *planID)
+	}
+
+	fmt.Printf("Groups: %v\n", groupIDs)
+}
+
+// parseIDs parses a comma separated list of IDs.
+func parseIDs(s string) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/pkg/config"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+)
+
+func main() {
+	nodeID := flag.Int64("node", 0, "ID of the node whose key should be generated or rotated")
+	flag.Parse()
+
+	if *nodeID <= 0 {
+		fmt.Println("Usage: go run cmd/nodekey/main.go -node <node_id>")
+		os.Exit(1)
+	}
+
+	// Load Config
+	if err := config.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Init DB
+	dbConfig := config.Database()
+
+	if err := db.InitDB(dbConfig); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	credential, err := service.NewNodeService().RotateNodeKey(*nodeID)
+	if err != nil {
+		log.Fatalf("Failed to rotate key for node %d: %v", *nodeID, err)
+	}
+
+	// The secret is only shown once; configure it on the node agent.
+	fmt.Printf("Node:   %d\n", credential.NodeID)
+	fmt.Printf("Key ID: %s\n", credential.KeyID)
+	fmt.Printf("Secret: %s\n", credential.Secret)
+}
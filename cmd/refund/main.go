@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/pkg/config"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/mariclezhang/vps_backend/pkg/payment"
+	"github.com/spf13/viper"
+)
+
+func main() {
+	orderNo := flag.String("order", "", "Order number of the paid recharge to refund")
+	flag.Parse()
+
+	if *orderNo == "" {
+		fmt.Println("Usage: go run cmd/refund/main.go -order <order_no>")
+		os.Exit(1)
+	}
+
+	// Load Config
+	if err := config.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Init DB
+	dbConfig := config.Database()
+
+	if err := db.InitDB(dbConfig); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	// Init payment providers (the fake provider keeps payments in memory and
+	// cannot refund orders paid through another process)
+	if viper.GetBool("payment.fake.enabled") {
+		payment.Register(payment.NewFakeProvider(viper.GetString("payment.fake.secret")))
+	}
+
+	if err := service.NewPaymentService().RefundRecharge(*orderNo); err != nil {
+		log.Fatalf("Failed to refund order %s: %v", *orderNo, err)
+	}
+
+	fmt.Printf("Order:  %s\n", *orderNo)
+	fmt.Println("Status: refunded")
+}
@@ -44,14 +44,25 @@ func main() {
 		log.Fatalf("Failed to seed users: %v", err)
 	}
 
+	// 创建节点
+	if err := seedNodes(); err != nil {
+		log.Fatalf("Failed to seed nodes: %v", err)
+	}
+
+	// 创建节点分组
+	groups, err := seedNodeGroups()
+	if err != nil {
+		log.Fatalf("Failed to seed node groups: %v", err)
+	}
+
 	// 创建订阅套餐
-	if err := seedSubscriptionPlans(); err != nil {
+	if err := seedSubscriptionPlans(groups); err != nil {
 		log.Fatalf("Failed to seed subscription plans: %v", err)
 	}
 
-	// 创建节点
-	if err := seedNodes(); err != nil {
-		log.Fatalf("Failed to seed nodes: %v", err)
+	// 创建流量包
+	if err := seedTrafficPacks(); err != nil {
+		log.Fatalf("Failed to seed traffic packs: %v", err)
 	}
 
 	// 创建公告
@@ -80,8 +91,21 @@ func cleanDatabase() error {
 	// 注意：这会删除所有数据！仅用于开发环境
 	tables := []string{
 		"user_node_access",
+		"plan_node_groups",
+		"node_group_nodes",
+		"node_groups",
+		"node_credentials",
+		"node_latency_logs",
 		"traffic_logs",
+		"traffic_reports",
+		"traffic_flushes",
+		"traffic_hourly",
+		"traffic_daily",
+		"traffic_rollup_states",
+		"traffic_pack_purchases",
+		"traffic_packs",
 		"orders",
+		"traffic_usage_periods",
 		"subscriptions",
 		"subscription_plans",
 		"nodes",
@@ -151,29 +175,40 @@ func seedUsers() error {
 	return nil
 }
 
-func seedSubscriptionPlans() error {
+func seedSubscriptionPlans(groups map[string]model.NodeGroup) error {
 	log.Println("Seeding subscription plans...")
 
+	standard := groups["标准节点"]
+	premium := groups["高级节点"]
+
 	plans := []model.SubscriptionPlan{
 		{
-			Name:         "基础套餐",
-			Description:  "适合轻度使用者",
-			Price:        29.90,
-			TrafficLimit: 100 * 1024 * 1024 * 1024, // 100GB
-			DurationDays: 30,
-			Features:     model.StringArray{"100GB流量", "5个设备同时在线", "标准速度"},
-			IsActive:     true,
-			SortOrder:    1,
+			Name:               "基础套餐",
+			Description:        "适合轻度使用者",
+			Price:              29.90,
+			TrafficLimit:       100 * 1024 * 1024 * 1024, // 100GB
+			DurationDays:       30,
+			Features:           model.StringArray{"100GB流量", "5个设备同时在线", "标准速度"},
+			NodeGroups:         []model.NodeGroup{standard},
+			DeviceLimit:        5,
+			UploadSpeedLimit:   20,
+			DownloadSpeedLimit: 100,
+			IsActive:           true,
+			SortOrder:          1,
 		},
 		{
-			Name:         "标准套餐",
-			Description:  "最受欢迎的选择",
-			Price:        49.90,
-			TrafficLimit: 200 * 1024 * 1024 * 1024, // 200GB
-			DurationDays: 30,
-			Features:     model.StringArray{"200GB流量", "10个设备同时在线", "高速连接", "优先支持"},
-			IsActive:     true,
-			SortOrder:    2,
+			Name:               "标准套餐",
+			Description:        "最受欢迎的选择",
+			Price:              49.90,
+			TrafficLimit:       200 * 1024 * 1024 * 1024, // 200GB
+			DurationDays:       30,
+			Features:           model.StringArray{"200GB流量", "10个设备同时在线", "高速连接", "优先支持"},
+			NodeGroups:         []model.NodeGroup{standard},
+			DeviceLimit:        10,
+			UploadSpeedLimit:   50,
+			DownloadSpeedLimit: 300,
+			IsActive:           true,
+			SortOrder:          2,
 		},
 		{
 			Name:         "高级套餐",
@@ -182,6 +217,7 @@ func seedSubscriptionPlans() error {
 			TrafficLimit: 500 * 1024 * 1024 * 1024, // 500GB
 			DurationDays: 30,
 			Features:     model.StringArray{"500GB流量", "无限设备", "极速连接", "专属客服", "高级节点"},
+			NodeGroups:   []model.NodeGroup{standard, premium},
 			IsActive:     true,
 			SortOrder:    3,
 		},
@@ -191,7 +227,7 @@ func seedSubscriptionPlans() error {
 			Price:        199.90,
 			TrafficLimit: 1024 * 1024 * 1024 * 1024, // 1TB
 			DurationDays: 30,
-			Features:     model.StringArray{"1TB流量", "无限设备", "极速连接", "专属客服", "所有节点", "优先网络"},
+			Features:     model.StringArray{"1TB流量", "无限设备", "极速连接", "专属客服", "所有节点", "优先网络"}, // 未配置分组，可访问所有节点
 			IsActive:     true,
 			SortOrder:    4,
 		},
@@ -207,6 +243,46 @@ func seedSubscriptionPlans() error {
 	return nil
 }
 
+func seedTrafficPacks() error {
+	log.Println("Seeding traffic packs...")
+
+	packs := []model.TrafficPack{
+		{
+			Name:        "10GB流量包",
+			Description: "有效期至订阅到期",
+			Traffic:     10 * 1024 * 1024 * 1024, // 10GB
+			Price:       5.00,
+			IsActive:    true,
+			SortOrder:   1,
+		},
+		{
+			Name:        "50GB流量包",
+			Description: "有效期至订阅到期",
+			Traffic:     50 * 1024 * 1024 * 1024, // 50GB
+			Price:       19.90,
+			IsActive:    true,
+			SortOrder:   2,
+		},
+		{
+			Name:        "100GB流量包",
+			Description: "有效期至订阅到期",
+			Traffic:     100 * 1024 * 1024 * 1024, // 100GB
+			Price:       34.90,
+			IsActive:    true,
+			SortOrder:   3,
+		},
+	}
+
+	for _, pack := range packs {
+		if err := db.DB.Create(&pack).Error; err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Created %d traffic packs", len(packs))
+	return nil
+}
+
 func seedNodes() error {
 	log.Println("Seeding nodes...")
 
@@ -293,6 +369,7 @@ func seedNodes() error {
 			Bandwidth:          "1Gbps",
 			MaxConnections:     1000,
 			CurrentConnections: 600,
+			TrafficRate:        1.5,
 			IsActive:           true,
 		},
 		{
@@ -307,6 +384,7 @@ func seedNodes() error {
 			Bandwidth:          "1Gbps",
 			MaxConnections:     1000,
 			CurrentConnections: 300,
+			TrafficRate:        0.5,
 			IsActive:           true,
 		},
 		{
@@ -321,6 +399,7 @@ func seedNodes() error {
 			Bandwidth:          "1Gbps",
 			MaxConnections:     1000,
 			CurrentConnections: 250,
+			TrafficRate:        0.5,
 			IsActive:           true,
 		},
 	}
@@ -335,6 +414,42 @@ func seedNodes() error {
 	return nil
 }
 
+func seedNodeGroups() (map[string]model.NodeGroup, error) {
+	log.Println("Seeding node groups...")
+
+	// 亚洲低延迟节点作为高级节点，其余为标准节点
+	groupLocations := []struct {
+		Name        string
+		Description string
+		Locations   []string
+	}{
+		{Name: "标准节点", Description: "基础与标准套餐可用", Locations: []string{"US", "SG", "DE", "UK"}},
+		{Name: "高级节点", Description: "低延迟亚洲节点", Locations: []string{"JP", "HK"}},
+	}
+
+	groups := make(map[string]model.NodeGroup, len(groupLocations))
+	for _, g := range groupLocations {
+		var nodes []model.Node
+		if err := db.DB.Where("location IN ?", g.Locations).Find(&nodes).Error; err != nil {
+			return nil, err
+		}
+
+		group := model.NodeGroup{
+			Name:        g.Name,
+			Description: g.Description,
+			Nodes:       nodes,
+		}
+		if err := db.DB.Create(&group).Error; err != nil {
+			return nil, err
+		}
+		group.Nodes = nil
+		groups[group.Name] = group
+	}
+
+	log.Printf("Created %d node groups", len(groups))
+	return groups, nil
+}
+
 func seedAnnouncements() error {
 	log.Println("Seeding announcements...")
 
@@ -1,37 +1,30 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"strings"
+	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/mariclezhang/vps_backend/internal/api/router"
+	"github.com/mariclezhang/vps_backend/internal/service"
 	"github.com/mariclezhang/vps_backend/internal/util"
 	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/config"
 	"github.com/mariclezhang/vps_backend/pkg/db"
 	"github.com/mariclezhang/vps_backend/pkg/email"
+	"github.com/mariclezhang/vps_backend/pkg/payment"
 	"github.com/spf13/viper"
 )
 
 func main() {
 	// 加载配置
-	if err := loadConfig(); err != nil {
+	if err := config.Load(); err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
 	// 初始化数据库
-	dbConfig := db.Config{
-		Host:         viper.GetString("database.host"),
-		Port:         viper.GetInt("database.port"),
-		User:         viper.GetString("database.user"),
-		Password:     viper.GetString("database.password"),
-		DBName:       viper.GetString("database.dbname"),
-		SSLMode:      viper.GetString("database.sslmode"),
-		MaxOpenConns: viper.GetInt("database.max_open_conns"),
-		MaxIdleConns: viper.GetInt("database.max_idle_conns"),
-	}
+	dbConfig := config.Database()
 
 	if err := db.InitDB(dbConfig); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
@@ -44,16 +37,23 @@ func main() {
 
 	log.Println("Database migration completed")
 
-	// 初始化Redis
-	redisConfig := cache.Config{
-		Host:     viper.GetString("redis.host"),
-		Port:     viper.GetInt("redis.port"),
-		Password: viper.GetString("redis.password"),
-		DB:       viper.GetInt("redis.db"),
+	// 初始化订阅链接
+	service.InitSubscribeBaseURL(viper.GetString("subscribe.base_url"))
+	if err := service.NewSubscriptionService().BackfillSubscribeTokens(); err != nil {
+		log.Fatalf("Failed to backfill subscribe tokens: %v", err)
+	}
+	if err := service.NewUserService().BackfillUserUUIDs(); err != nil {
+		log.Fatalf("Failed to backfill user uuids: %v", err)
 	}
+	if err := service.NewSubscriptionService().BackfillSubscriptionTrafficTotals(); err != nil {
+		log.Fatalf("Failed to backfill subscription traffic totals: %v", err)
+	}
+
+	// 初始化Redis
+	redisConfig := config.Redis()
 
 	if err := cache.InitRedis(redisConfig); err != nil {
-		log.Printf("Warning: Failed to initialize Redis: %v", err)
+		log.Printf("Warning: Failed to initialize Redis, falling back to database: %v", err)
 	} else {
 		log.Println("Redis connected successfully")
 	}
@@ -71,6 +71,47 @@ func main() {
 	}
 	email.InitEmailService(emailConfig)
 
+	// 初始化支付渠道
+	service.InitPayment(viper.GetString("payment.notify_base_url"))
+	if viper.GetBool("payment.fake.enabled") {
+		log.Println("已启用模拟支付渠道，生产环境请关闭 payment.fake.enabled")
+		payment.Register(payment.NewFakeProvider(viper.GetString("payment.fake.secret")))
+	}
+
+	// 初始化节点通讯
+	service.InitNodeAgent(time.Duration(viper.GetInt("node_agent.user_cache_seconds")) * time.Second)
+	service.InitDeviceLimit(time.Duration(viper.GetInt("node_agent.online_ttl_seconds")) * time.Second)
+
+	// 初始化节点延迟探测
+	service.InitLatencyProbe(viper.GetInt("probe.samples"),
+		time.Duration(viper.GetInt("probe.timeout_ms"))*time.Millisecond)
+
+	// 启动节点心跳检查与健康检查
+	service.InitNodeHealth(time.Duration(viper.GetInt("node_agent.heartbeat_timeout_seconds"))*time.Second,
+		viper.GetInt("health_check.failure_threshold"))
+	go service.NewNodeAgentService().RunHeartbeatChecker(context.Background(),
+		time.Duration(viper.GetInt("node_agent.heartbeat_check_seconds"))*time.Second)
+	go service.NewNodeService().RunHealthChecker(context.Background(),
+		time.Duration(viper.GetInt("health_check.interval_seconds"))*time.Second,
+		viper.GetInt("health_check.workers"))
+
+	// 启动流量同步 (Redis -> DB)
+	go service.NewSubscriptionService().RunTrafficFlusher(context.Background(),
+		time.Duration(viper.GetInt("traffic.sync_interval_seconds"))*time.Second)
+
+	// 启动每月流量重置
+	service.InitTrafficReset(viper.GetInt("traffic.reset_day"))
+	go service.NewSubscriptionService().RunTrafficReset(context.Background(), time.Hour)
+
+	// 启动流量汇总与过期日志清理
+	service.InitTrafficRetention(viper.GetInt("traffic.raw_retention_days"), viper.GetInt("traffic.hourly_retention_days"))
+	go service.NewSubscriptionService().RunTrafficRollup(context.Background(),
+		time.Duration(viper.GetInt("traffic.rollup_interval_seconds"))*time.Second)
+
+	// 启动订阅配额检查，到期或流量用完的订阅收回节点权限
+	go service.NewSubscriptionService().RunQuotaEnforcer(context.Background(),
+		time.Duration(viper.GetInt("traffic.enforce_interval_seconds"))*time.Second)
+
 	// 设置路由
 	frontendURL := viper.GetString("server.frontend_url")
 	r := router.SetupRouter(frontendURL)
@@ -84,49 +125,3 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
-
-// loadConfig 加载配置文件
-func loadConfig() error {
-	// 加载 .env 文件（如果存在）
-	if _, err := os.Stat(".env"); err == nil {
-		if err := godotenv.Load(); err != nil {
-			log.Printf("Warning: Error loading .env file: %v", err)
-		} else {
-			log.Println(".env file loaded successfully")
-		}
-	}
-
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath(".")
-
-	// 读取环境变量
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	// 设置默认值
-	viper.SetDefault("server.port", 8080)
-	viper.SetDefault("server.mode", "debug")
-	viper.SetDefault("server.frontend_url", "http://localhost:8000")
-	viper.SetDefault("database.host", "localhost")
-	viper.SetDefault("database.port", 5432)
-	viper.SetDefault("database.sslmode", "disable")
-	viper.SetDefault("database.max_open_conns", 100)
-	viper.SetDefault("database.max_idle_conns", 10)
-	viper.SetDefault("redis.host", "localhost")
-	viper.SetDefault("redis.port", 6379)
-	viper.SetDefault("redis.db", 0)
-	viper.SetDefault("jwt.expire_hours", 24)
-
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Println("Config file not found, using defaults")
-			return nil
-		}
-		return err
-	}
-
-	log.Println("Config file loaded successfully")
-	return nil
-}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/config"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+)
+
+func main() {
+	userID := flag.Int64("user", 0, "ID of the user whose speed limit should be overridden")
+	upload := flag.Int64("upload", -1, "Upload limit in Mbps, 0 for unlimited, -1 to use the plan limit")
+	download := flag.Int64("download", -1, "Download limit in Mbps, 0 for unlimited, -1 to use the plan limit")
+	flag.Parse()
+
+	if *userID <= 0 {
+		fmt.Println("Usage: go run cmd/speedlimit/main.go -user <user_id> [-upload <mbps>] [-download <mbps>]")
+		os.Exit(1)
+	}
+
+	// Load Config
+	if err := config.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Init DB
+	dbConfig := config.Database()
+
+	if err := db.InitDB(dbConfig); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	// Init Redis so that cached node user lists are invalidated
+	if err := cache.InitRedis(config.Redis()); err != nil {
+		log.Printf("Warning: Failed to initialize Redis: %v", err)
+	}
+
+	if err := service.NewUserService().SetSpeedLimitOverride(*userID, override(*upload), override(*download)); err != nil {
+		log.Fatalf("Failed to set speed limit for user %d: %v", *userID, err)
+	}
+
+	fmt.Printf("User:     %d\n", *userID)
+	fmt.Printf("Upload:   %s\n", describe(*upload))
+	fmt.Printf("Download: %s\n", describe(*download))
+}
+
+// override converts a flag value to a nullable limit; negative values fall back to the plan.
+func override(v int64) *int64 {
+	if v < 0 {
+		return nil
+	}
+	return &v
+}
+
+func describe(v int64) string {
+	switch {
+	case v < 0:
+		return "plan limit"
+	case v == 0:
+		return "unlimited"
+	default:
+		return fmt.Sprintf("%d Mbps", v)
+	}
+}
@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mariclezhang/vps_backend/internal/middleware"
 	"github.com/mariclezhang/vps_backend/internal/service"
 	"github.com/mariclezhang/vps_backend/internal/util"
 )
@@ -22,10 +24,11 @@ func NewNodeHandler() *NodeHandler {
 
 // GetList 获取节点列表
 func (h *NodeHandler) GetList(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
 	location := c.Query("location")
 	protocol := c.Query("protocol")
 
-	nodes, err := h.nodeService.GetNodes(location, protocol)
+	nodes, err := h.nodeService.GetNodes(userID, location, protocol)
 	if err != nil {
 		util.Error(c, 400, err.Error())
 		return
@@ -36,6 +39,7 @@ func (h *NodeHandler) GetList(c *gin.Context) {
 
 // GetDetail 获取节点详情
 func (h *NodeHandler) GetDetail(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
 	idStr := c.Param("id")
 	nodeID, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
@@ -43,7 +47,7 @@ func (h *NodeHandler) GetDetail(c *gin.Context) {
 		return
 	}
 
-	node, err := h.nodeService.GetNodeDetail(nodeID)
+	node, err := h.nodeService.GetNodeDetailForUser(userID, nodeID)
 	if err != nil {
 		util.Error(c, 400, err.Error())
 		return
@@ -54,6 +58,7 @@ func (h *NodeHandler) GetDetail(c *gin.Context) {
 
 // TestLatency 测试节点延迟
 func (h *NodeHandler) TestLatency(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
 	idStr := c.Param("id")
 	nodeID, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
@@ -61,13 +66,15 @@ func (h *NodeHandler) TestLatency(c *gin.Context) {
 		return
 	}
 
-	latency, err := h.nodeService.TestLatency(nodeID)
+	result, err := h.nodeService.TestLatency(c.Request.Context(), userID, nodeID)
 	if err != nil {
+		if errors.Is(err, service.ErrNodeAccessDenied) {
+			util.Forbidden(c, err.Error())
+			return
+		}
 		util.Error(c, 400, err.Error())
 		return
 	}
 
-	util.Success(c, gin.H{
-		"latency": latency,
-	})
+	util.Success(c, result)
 }
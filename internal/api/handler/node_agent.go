@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mariclezhang/vps_backend/internal/middleware"
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/internal/util"
+)
+
+// NodeAgentHandler 节点通讯处理器
+type NodeAgentHandler struct {
+	nodeAgentService    *service.NodeAgentService
+	subscriptionService *service.SubscriptionService
+}
+
+// NewNodeAgentHandler 创建节点通讯处理器实例
+func NewNodeAgentHandler() *NodeAgentHandler {
+	return &NodeAgentHandler{
+		nodeAgentService:    service.NewNodeAgentService(),
+		subscriptionService: service.NewSubscriptionService(),
+	}
+}
+
+// GetUsers 获取节点可接入的用户列表，支持 ETag/If-None-Match
+func (h *NodeAgentHandler) GetUsers(c *gin.Context) {
+	nodeID, _ := middleware.GetNodeID(c)
+
+	list, err := h.nodeAgentService.GetNodeUsers(nodeID)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	c.Header("ETag", list.ETag)
+	if c.GetHeader("If-None-Match") == list.ETag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	util.Success(c, gin.H{
+		"users": list.Users,
+	})
+}
+
+// PushTrafficRequest 节点流量上报请求
+type PushTrafficRequest struct {
+	Items []service.TrafficDelta `json:"items" binding:"required,dive"`
+}
+
+// PushTraffic 节点批量上报用户流量，通过 Idempotency-Key 请求头去重
+func (h *NodeAgentHandler) PushTraffic(c *gin.Context) {
+	nodeID, _ := middleware.GetNodeID(c)
+
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if idempotencyKey == "" || len(idempotencyKey) > 64 {
+		util.BadRequest(c, "缺少或无效的 Idempotency-Key")
+		return
+	}
+
+	var req PushTrafficRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		util.BadRequest(c, "请求参数错误")
+		return
+	}
+
+	result, err := h.subscriptionService.RecordTrafficBatch(nodeID, idempotencyKey, req.Items)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.Success(c, result)
+}
+
+// ReportOnlineRequest 节点在线 IP 上报请求
+type ReportOnlineRequest struct {
+	Users []service.OnlineUserIPs `json:"users" binding:"dive"`
+}
+
+// ReportOnline 节点上报当前在线用户的 IP，返回超出设备数限制的用户
+func (h *NodeAgentHandler) ReportOnline(c *gin.Context) {
+	var req ReportOnlineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		util.BadRequest(c, "请求参数错误")
+		return
+	}
+
+	result, err := h.nodeAgentService.ReportOnlineIPs(req.Users)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.Success(c, result)
+}
+
+// Heartbeat 节点上报心跳与运行状态
+func (h *NodeAgentHandler) Heartbeat(c *gin.Context) {
+	nodeID, _ := middleware.GetNodeID(c)
+
+	var req service.NodeHeartbeat
+	if err := c.ShouldBindJSON(&req); err != nil {
+		util.BadRequest(c, "请求参数错误")
+		return
+	}
+
+	if err := h.nodeAgentService.RecordHeartbeat(nodeID, req); err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.SuccessWithMessage(c, "心跳已记录", nil)
+}
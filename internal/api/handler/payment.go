@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mariclezhang/vps_backend/internal/service"
+)
+
+// PaymentHandler 支付渠道回调处理器（无需登录，由支付渠道签名认证）
+type PaymentHandler struct {
+	paymentService *service.PaymentService
+}
+
+// NewPaymentHandler 创建支付回调处理器实例
+func NewPaymentHandler() *PaymentHandler {
+	return &PaymentHandler{
+		paymentService: service.NewPaymentService(),
+	}
+}
+
+// Notify 接收支付渠道的异步通知，处理成功返回 success，否则支付渠道会重试
+func (h *PaymentHandler) Notify(c *gin.Context) {
+	method := c.Param("method")
+	if err := h.paymentService.HandleCallback(method, c.Request); err != nil {
+		log.Printf("处理 %s 支付通知失败: %v", method, err)
+		c.String(http.StatusBadRequest, "fail")
+		return
+	}
+	c.String(http.StatusOK, "success")
+}
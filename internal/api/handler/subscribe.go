@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mariclezhang/vps_backend/internal/service"
+	"github.com/mariclezhang/vps_backend/internal/subscribe"
+	"github.com/mariclezhang/vps_backend/internal/util"
+)
+
+// SubscribeHandler 订阅链接处理器（客户端拉取节点，无需登录）
+type SubscribeHandler struct {
+	subscriptionService *service.SubscriptionService
+	nodeService         *service.NodeService
+	userService         *service.UserService
+}
+
+// NewSubscribeHandler 创建订阅链接处理器实例
+func NewSubscribeHandler() *SubscribeHandler {
+	return &SubscribeHandler{
+		subscriptionService: service.NewSubscriptionService(),
+		nodeService:         service.NewNodeService(),
+		userService:         service.NewUserService(),
+	}
+}
+
+// Subscribe 根据订阅token返回用户可用节点的订阅内容
+func (h *SubscribeHandler) Subscribe(c *gin.Context) {
+	token := c.Param("token")
+
+	subscription, err := h.subscriptionService.GetSubscriptionByToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrSubscriptionNotFound):
+			util.NotFound(c, err.Error())
+		case errors.Is(err, service.ErrSubscriptionInactive), errors.Is(err, service.ErrTrafficExhausted):
+			util.Forbidden(c, err.Error())
+		default:
+			util.InternalServerError(c, "获取订阅失败")
+		}
+		return
+	}
+
+	// 未指定格式时根据客户端 User-Agent 自动识别
+	target := c.Query("target")
+	if target == "" {
+		target = subscribe.DetectTarget(c.GetHeader("User-Agent"))
+	}
+	renderer, ok := subscribe.Lookup(target)
+	if !ok {
+		util.BadRequest(c, "不支持的订阅格式")
+		return
+	}
+
+	nodes, err := h.nodeService.GetUserAccessibleNodes(subscription.UserID)
+	if err != nil {
+		util.InternalServerError(c, "获取节点失败")
+		return
+	}
+
+	user, err := h.userService.GetUserInfo(subscription.UserID)
+	if err != nil {
+		util.InternalServerError(c, "获取用户失败")
+		return
+	}
+
+	// 节点认证信息使用用户自己的凭证，与节点端拉取的用户列表一致
+	content, err := renderer.Render(subscribe.ParseNodes(nodes, user.UUID))
+	if err != nil {
+		util.InternalServerError(c, "生成订阅失败")
+		return
+	}
+
+	upload, download, err := h.subscriptionService.GetSubscriptionUsage(subscription)
+	if err != nil {
+		util.InternalServerError(c, "获取流量信息失败")
+		return
+	}
+
+	// 客户端通过该响应头展示剩余流量与到期时间
+	c.Header("subscription-userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d",
+		upload, download, subscription.TotalTrafficLimit(), subscription.ExpiredAt.Unix()))
+	c.Header("profile-update-interval", "24")
+	c.Header("content-disposition", "attachment; filename*=UTF-8''"+url.PathEscape(subscription.Name))
+
+	c.Data(http.StatusOK, renderer.ContentType(), content)
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -12,12 +13,14 @@ import (
 // SubscriptionHandler 订阅处理器
 type SubscriptionHandler struct {
 	subscriptionService *service.SubscriptionService
+	paymentService      *service.PaymentService
 }
 
 // NewSubscriptionHandler 创建订阅处理器实例
 func NewSubscriptionHandler() *SubscriptionHandler {
 	return &SubscriptionHandler{
 		subscriptionService: service.NewSubscriptionService(),
+		paymentService:      service.NewPaymentService(),
 	}
 }
 
@@ -33,6 +36,16 @@ type RenewRequest struct {
 	Duration       int   `json:"duration" binding:"required,min=1"` // 月数
 }
 
+// PurchaseTrafficPackRequest 购买流量包请求
+type PurchaseTrafficPackRequest struct {
+	PackID int64 `json:"packId" binding:"required"`
+}
+
+// ChangePlanRequest 更换套餐请求
+type ChangePlanRequest struct {
+	PlanID int64 `json:"planId" binding:"required"`
+}
+
 // GetList 获取用户订阅列表
 func (h *SubscriptionHandler) GetList(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
@@ -57,6 +70,17 @@ func (h *SubscriptionHandler) GetPlans(c *gin.Context) {
 	util.Success(c, plans)
 }
 
+// GetTrafficPacks 获取可购买的流量包
+func (h *SubscriptionHandler) GetTrafficPacks(c *gin.Context) {
+	packs, err := h.subscriptionService.GetTrafficPacks()
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.Success(c, packs)
+}
+
 // Purchase 购买订阅
 func (h *SubscriptionHandler) Purchase(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
@@ -117,7 +141,81 @@ func (h *SubscriptionHandler) Cancel(c *gin.Context) {
 	})
 }
 
-// Recharge 充值
+// PurchaseTrafficPack 为订阅购买流量包
+func (h *SubscriptionHandler) PurchaseTrafficPack(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+
+	idStr := c.Param("id")
+	subscriptionID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		util.BadRequest(c, "无效的订阅ID")
+		return
+	}
+
+	var req PurchaseTrafficPackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		util.BadRequest(c, "请求参数错误")
+		return
+	}
+
+	purchase, err := h.subscriptionService.PurchaseTrafficPack(userID, subscriptionID, req.PackID)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.SuccessWithMessage(c, "购买成功", purchase)
+}
+
+// ChangePlan 更换订阅套餐，按原订阅未使用部分折算差价
+func (h *SubscriptionHandler) ChangePlan(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+
+	idStr := c.Param("id")
+	subscriptionID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		util.BadRequest(c, "无效的订阅ID")
+		return
+	}
+
+	var req ChangePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		util.BadRequest(c, "请求参数错误")
+		return
+	}
+
+	result, err := h.subscriptionService.ChangePlan(userID, subscriptionID, req.PlanID)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.SuccessWithMessage(c, "套餐已更换", result)
+}
+
+// ResetToken 重置订阅链接，旧链接立即失效
+func (h *SubscriptionHandler) ResetToken(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+
+	idStr := c.Param("id")
+	subscriptionID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		util.BadRequest(c, "无效的订阅ID")
+		return
+	}
+
+	subscription, err := h.subscriptionService.ResetSubscribeToken(userID, subscriptionID)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.SuccessWithMessage(c, "订阅链接已重置", gin.H{
+		"subscribeUrl": subscription.SubscribeURL,
+	})
+}
+
+// Recharge 发起充值，返回支付地址，余额在支付成功后到账
 func (h *SubscriptionHandler) Recharge(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
 
@@ -131,16 +229,28 @@ func (h *SubscriptionHandler) Recharge(c *gin.Context) {
 		return
 	}
 
-	// TODO: 实际支付流程
-	// 这里仅模拟充值成功
-	userService := service.NewUserService()
-	if err := userService.AddBalance(userID, req.Amount); err != nil {
+	result, err := h.paymentService.CreateRecharge(userID, req.Amount, req.Method)
+	if err != nil {
 		util.Error(c, 400, err.Error())
 		return
 	}
 
-	util.SuccessWithMessage(c, "充值成功", gin.H{
-		"success": true,
-		"amount":  req.Amount,
-	})
+	util.SuccessWithMessage(c, "请完成支付", result)
+}
+
+// GetRecharge 查询充值订单状态
+func (h *SubscriptionHandler) GetRecharge(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+
+	order, err := h.paymentService.GetRecharge(userID, c.Param("orderNo"))
+	if err != nil {
+		if errors.Is(err, service.ErrOrderNotFound) {
+			util.NotFound(c, err.Error())
+			return
+		}
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.Success(c, order)
 }
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/mariclezhang/vps_backend/internal/middleware"
 	"github.com/mariclezhang/vps_backend/internal/service"
@@ -121,6 +123,49 @@ func (h *UserHandler) GetTraffic(c *gin.Context) {
 	util.Success(c, traffic)
 }
 
+// GetTrafficHistory 获取流量使用历史
+func (h *UserHandler) GetTrafficHistory(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+
+	now := time.Now()
+	query := service.TrafficHistoryQuery{
+		From:        now.AddDate(0, 0, -30),
+		To:          now,
+		Granularity: c.DefaultQuery("granularity", service.GranularityDay),
+		GroupBy:     c.Query("groupBy"),
+	}
+
+	var err error
+	if v := c.Query("from"); v != "" {
+		if query.From, err = parseTimeParam(v); err != nil {
+			util.BadRequest(c, "无效的开始时间")
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if query.To, err = parseTimeParam(v); err != nil {
+			util.BadRequest(c, "无效的结束时间")
+			return
+		}
+	}
+
+	history, err := h.subscriptionService.GetTrafficHistory(userID, query)
+	if err != nil {
+		util.Error(c, 400, err.Error())
+		return
+	}
+
+	util.Success(c, history)
+}
+
+// parseTimeParam 解析 RFC3339 或 YYYY-MM-DD (本地时区) 格式的时间参数
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.Local(), nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
 // GetStats 获取账户统计
 func (h *UserHandler) GetStats(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/mariclezhang/vps_backend/internal/api/handler"
 	"github.com/mariclezhang/vps_backend/internal/middleware"
+	"github.com/mariclezhang/vps_backend/internal/service"
 )
 
 // SetupRouter 设置路由
@@ -19,6 +20,12 @@ func SetupRouter(frontendURL string) *gin.Engine {
 	userHandler := handler.NewUserHandler()
 	subscriptionHandler := handler.NewSubscriptionHandler()
 	nodeHandler := handler.NewNodeHandler()
+	subscribeHandler := handler.NewSubscribeHandler()
+	nodeAgentHandler := handler.NewNodeAgentHandler()
+	paymentHandler := handler.NewPaymentHandler()
+
+	// 订阅链接 (无需token，客户端直接拉取)
+	r.GET("/sub/:token", subscribeHandler.Subscribe)
 
 	// API路由组
 	api := r.Group("/api")
@@ -33,6 +40,19 @@ func SetupRouter(frontendURL string) *gin.Engine {
 			auth.POST("/reset-password", authHandler.ResetPassword)
 		}
 
+		// 支付渠道异步通知 (支付渠道签名认证)
+		api.Any("/payments/:method/notify", paymentHandler.Notify)
+
+		// 节点通讯接口 (节点密钥签名认证，不接受用户token)
+		nodeAgent := api.Group("/node-agent")
+		nodeAgent.Use(middleware.NodeAuthMiddleware(service.NewNodeService().GetNodeCredential))
+		{
+			nodeAgent.GET("/users", nodeAgentHandler.GetUsers)
+			nodeAgent.POST("/traffic", nodeAgentHandler.PushTraffic)
+			nodeAgent.POST("/heartbeat", nodeAgentHandler.Heartbeat)
+			nodeAgent.POST("/online", nodeAgentHandler.ReportOnline)
+		}
+
 		// 需要认证的接口
 		authorized := api.Group("")
 		authorized.Use(middleware.AuthMiddleware())
@@ -50,8 +70,10 @@ func SetupRouter(frontendURL string) *gin.Engine {
 			{
 				account.GET("/balance", userHandler.GetBalance)
 				account.GET("/traffic", userHandler.GetTraffic)
+				account.GET("/traffic/history", userHandler.GetTrafficHistory)
 				account.GET("/stats", userHandler.GetStats)
 				account.POST("/recharge", subscriptionHandler.Recharge)
+				account.GET("/recharge/:orderNo", subscriptionHandler.GetRecharge)
 			}
 
 			// 订阅接口
@@ -59,9 +81,13 @@ func SetupRouter(frontendURL string) *gin.Engine {
 			{
 				subscriptions.GET("", subscriptionHandler.GetList)
 				subscriptions.GET("/plans", subscriptionHandler.GetPlans)
+				subscriptions.GET("/traffic-packs", subscriptionHandler.GetTrafficPacks)
 				subscriptions.POST("/purchase", subscriptionHandler.Purchase)
 				subscriptions.POST("/renew", subscriptionHandler.Renew)
 				subscriptions.DELETE("/:id", subscriptionHandler.Cancel)
+				subscriptions.POST("/:id/reset-token", subscriptionHandler.ResetToken)
+				subscriptions.POST("/:id/traffic-packs", subscriptionHandler.PurchaseTrafficPack)
+				subscriptions.POST("/:id/change-plan", subscriptionHandler.ChangePlan)
 			}
 
 			// 节点接口
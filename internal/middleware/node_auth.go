@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mariclezhang/vps_backend/internal/util"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+)
+
+// nodeSignatureWindow 节点请求时间戳允许的最大偏差，超出视为重放
+const nodeSignatureWindow = 5 * time.Minute
+
+// nodeMaxBodySize 节点请求体大小上限
+const nodeMaxBodySize = 10 << 20
+
+// signatureCache 未启用 Redis 时在进程内记录已使用的签名。
+// 仅对当前进程有效，多实例部署时应启用 Redis。
+type signatureCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	warn sync.Once
+}
+
+var usedSignatures = &signatureCache{seen: make(map[string]time.Time)}
+
+// add 记录签名，签名在有效期内已使用过时返回 false
+func (sc *signatureCache) add(signature string, ttl time.Duration) bool {
+	sc.warn.Do(func() {
+		log.Println("警告: 未启用 Redis，节点请求防重放仅在当前进程内生效，多实例部署时无法拦截跨实例的重放请求")
+	})
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	if expiry, ok := sc.seen[signature]; ok && expiry.After(now) {
+		return false
+	}
+	for sig, expiry := range sc.seen {
+		if !expiry.After(now) {
+			delete(sc.seen, sig)
+		}
+	}
+	sc.seen[signature] = now.Add(ttl)
+	return true
+}
+
+// markSignatureUsed 记录已使用的签名，签名已使用过时返回 false
+func markSignatureUsed(signature string) (bool, error) {
+	ttl := 2 * nodeSignatureWindow
+	if cache.RedisClient == nil {
+		return usedSignatures.add(signature, ttl), nil
+	}
+	return cache.RedisClient.SetNX(context.Background(), "node:sig:"+signature, 1, ttl).Result()
+}
+
+// NodeCredentialLookup 根据密钥ID查询节点ID与签名密钥
+type NodeCredentialLookup func(keyID string) (nodeID int64, secret string, err error)
+
+// NodeAuthMiddleware 节点通讯认证中间件
+// 节点使用各自的密钥对请求做 HMAC 签名，不接受用户JWT:
+//   - X-Node-Key: 密钥ID
+//   - X-Node-Timestamp: Unix 时间戳(秒)
+//   - X-Node-Signature: util.NodeSignature 计算的签名
+func NodeAuthMiddleware(lookup NodeCredentialLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID := c.GetHeader("X-Node-Key")
+		timestamp := c.GetHeader("X-Node-Timestamp")
+		signature := c.GetHeader("X-Node-Signature")
+		if keyID == "" || timestamp == "" || signature == "" {
+			util.Unauthorized(c, "缺少节点签名")
+			c.Abort()
+			return
+		}
+
+		// 检查时间窗口，拒绝过期或伪造的时间戳
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			util.Unauthorized(c, "无效的时间戳")
+			c.Abort()
+			return
+		}
+		if diff := time.Since(time.Unix(ts, 0)); diff > nodeSignatureWindow || diff < -nodeSignatureWindow {
+			util.Unauthorized(c, "请求已过期")
+			c.Abort()
+			return
+		}
+
+		nodeID, secret, err := lookup(keyID)
+		if err != nil {
+			util.Unauthorized(c, "无效的节点密钥")
+			c.Abort()
+			return
+		}
+
+		// 读取请求体用于签名校验，之后放回供处理器使用
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, nodeMaxBodySize))
+		if err != nil {
+			util.BadRequest(c, "请求体过大")
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !util.VerifyNodeSignature(secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, body, signature) {
+			util.Unauthorized(c, "签名错误")
+			c.Abort()
+			return
+		}
+
+		// 时间窗口内同一签名只允许使用一次，无法确认时拒绝请求
+		fresh, err := markSignatureUsed(signature)
+		if err != nil {
+			log.Printf("节点 %d 请求防重放检查失败: %v", nodeID, err)
+			util.ErrorWithStatus(c, http.StatusServiceUnavailable, 503, "服务暂不可用")
+			c.Abort()
+			return
+		}
+		if !fresh {
+			util.Unauthorized(c, "重复的请求")
+			c.Abort()
+			return
+		}
+
+		// 将节点信息存储到上下文
+		c.Set("nodeID", nodeID)
+
+		c.Next()
+	}
+}
+
+// GetNodeID 从上下文中获取节点ID
+func GetNodeID(c *gin.Context) (int64, bool) {
+	nodeID, exists := c.Get("nodeID")
+	if !exists {
+		return 0, false
+	}
+	return nodeID.(int64), true
+}
@@ -23,24 +23,65 @@ func (c NodeConfig) Value() (driver.Value, error) {
 	return json.Marshal(c)
 }
 
+// 节点协议
+const (
+	NodeProtocolVMess       = "vmess"
+	NodeProtocolVLESS       = "vless"
+	NodeProtocolTrojan      = "trojan"
+	NodeProtocolShadowsocks = "shadowsocks"
+)
+
+// NodeConfig 中约定的配置键
+const (
+	NodeConfigUUID          = "uuid"          // vmess/vless 用户ID
+	NodeConfigAlterID       = "alterId"       // vmess alterId，默认 0
+	NodeConfigSecurity      = "security"      // vmess 加密方式，默认 auto
+	NodeConfigFlow          = "flow"          // vless 流控，如 xtls-rprx-vision
+	NodeConfigPassword      = "password"      // trojan/shadowsocks 密码
+	NodeConfigMethod        = "method"        // shadowsocks 加密方式
+	NodeConfigNetwork       = "network"       // 传输方式 tcp/ws/grpc/h2，默认 tcp
+	NodeConfigPath          = "path"          // ws/h2 路径
+	NodeConfigHost          = "host"          // ws/h2 Host
+	NodeConfigServiceName   = "serviceName"   // grpc 服务名
+	NodeConfigTLS           = "tls"           // 是否启用 TLS
+	NodeConfigSNI           = "sni"           // TLS SNI
+	NodeConfigAllowInsecure = "allowInsecure" // 是否跳过证书校验
+)
+
+// 节点状态
+const (
+	NodeStatusOnline      = "online"
+	NodeStatusOffline     = "offline"
+	NodeStatusMaintenance = "maintenance"
+)
+
 // Node 节点模型
 type Node struct {
-	ID                 int64      `json:"id" gorm:"primaryKey"`
-	Name               string     `json:"name" gorm:"not null"`
-	Location           string     `json:"location"` // 地理位置
-	Protocol           string     `json:"protocol"` // vmess/vless/trojan/shadowsocks
-	ServerAddress      string     `json:"serverAddress" gorm:"column:server_address"`
-	ServerPort         int        `json:"serverPort" gorm:"column:server_port"`
-	Status             string     `json:"status" gorm:"default:'online'"` // online/offline/maintenance
-	Latency            int        `json:"latency"`                        // 延迟 ms
-	LoadPercentage     int        `json:"load" gorm:"column:load_percentage;default:0"`
-	Bandwidth          string     `json:"bandwidth"`
-	MaxConnections     int        `json:"maxConnections" gorm:"column:max_connections"`
-	CurrentConnections int        `json:"currentConnections" gorm:"column:current_connections;default:0"`
-	Config             NodeConfig `json:"config" gorm:"type:jsonb"`
-	IsActive           bool       `json:"isActive" gorm:"default:true"`
-	CreatedAt          time.Time  `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt          time.Time  `json:"updatedAt" gorm:"autoUpdateTime"`
+	ID                  int64      `json:"id" gorm:"primaryKey"`
+	Name                string     `json:"name" gorm:"not null"`
+	Location            string     `json:"location"` // 地理位置
+	Protocol            string     `json:"protocol"` // vmess/vless/trojan/shadowsocks
+	ServerAddress       string     `json:"serverAddress" gorm:"column:server_address"`
+	ServerPort          int        `json:"serverPort" gorm:"column:server_port"`
+	Status              string     `json:"status" gorm:"default:'online'"` // online/offline/maintenance
+	Latency             int        `json:"latency"`                        // 最近一次探测的延迟 ms，历史见 NodeLatencyLog
+	LoadPercentage      int        `json:"load" gorm:"column:load_percentage;default:0"`
+	Bandwidth           string     `json:"bandwidth"`
+	MaxConnections      int        `json:"maxConnections" gorm:"column:max_connections"`
+	CurrentConnections  int        `json:"currentConnections" gorm:"column:current_connections;default:0"`
+	CPUUsage            float64    `json:"cpuUsage" gorm:"column:cpu_usage;default:0"`       // CPU 使用率 %
+	MemoryUsage         float64    `json:"memoryUsage" gorm:"column:memory_usage;default:0"` // 内存使用率 %
+	Uptime              int64      `json:"uptime" gorm:"default:0"`                          // 节点运行时长 秒
+	LastHeartbeatAt     *time.Time `json:"lastHeartbeatAt" gorm:"column:last_heartbeat_at;index"`
+	ConsecutiveFailures int        `json:"consecutiveFailures" gorm:"column:consecutive_failures;default:0"` // 连续探测失败次数
+	TrafficRate         float64    `json:"trafficRate" gorm:"column:traffic_rate;default:1"`                 // 流量倍率，计入订阅的流量 = 实际流量 × 倍率
+	Config              NodeConfig `json:"config" gorm:"type:jsonb"`
+	IsActive            bool       `json:"isActive" gorm:"default:true"`
+	CreatedAt           time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt           time.Time  `json:"updatedAt" gorm:"autoUpdateTime"`
+
+	// Relations
+	Groups []NodeGroup `json:"groups,omitempty" gorm:"many2many:node_group_nodes;"`
 }
 
 // TableName 指定表名
@@ -48,13 +89,30 @@ func (Node) TableName() string {
 	return "nodes"
 }
 
+// NodeGroup 节点分组，套餐通过分组决定可访问的节点
+type NodeGroup struct {
+	ID          int64     `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"uniqueIndex;size:64;not null"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+
+	// Relations
+	Nodes []Node `json:"nodes,omitempty" gorm:"many2many:node_group_nodes;"`
+}
+
+// TableName 指定表名
+func (NodeGroup) TableName() string {
+	return "node_groups"
+}
+
 // UserNodeAccess 用户节点访问权限模型
 type UserNodeAccess struct {
-	ID             int64     `json:"id" gorm:"primaryKey"`
-	UserID         int64     `json:"userId" gorm:"uniqueIndex:idx_user_node"`
-	NodeID         int64     `json:"nodeId" gorm:"uniqueIndex:idx_user_node"`
-	SubscriptionID int64     `json:"subscriptionId"`
-	GrantedAt      time.Time `json:"grantedAt" gorm:"autoCreateTime"`
+	ID             int64      `json:"id" gorm:"primaryKey"`
+	UserID         int64      `json:"userId" gorm:"uniqueIndex:idx_user_node"`
+	NodeID         int64      `json:"nodeId" gorm:"uniqueIndex:idx_user_node"`
+	SubscriptionID int64      `json:"subscriptionId"`
+	GrantedAt      time.Time  `json:"grantedAt" gorm:"autoCreateTime"`
 	ExpiredAt      *time.Time `json:"expiredAt"`
 
 	// Relations
@@ -67,3 +125,41 @@ type UserNodeAccess struct {
 func (UserNodeAccess) TableName() string {
 	return "user_node_access"
 }
+
+// NodeCredential 节点通讯密钥，节点端使用 KeyID + Secret 对请求进行 HMAC 签名
+type NodeCredential struct {
+	ID        int64     `json:"id" gorm:"primaryKey"`
+	NodeID    int64     `json:"nodeId" gorm:"uniqueIndex;not null"`
+	KeyID     string    `json:"keyId" gorm:"uniqueIndex;size:32;not null"`
+	Secret    string    `json:"-" gorm:"size:128;not null"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime"` // 最近一次轮换时间
+
+	// Relations
+	Node *Node `json:"node,omitempty" gorm:"foreignKey:NodeID"`
+}
+
+// TableName 指定表名
+func (NodeCredential) TableName() string {
+	return "node_credentials"
+}
+
+// NodeLatencyLog 节点延迟探测记录 (时间序列)
+type NodeLatencyLog struct {
+	ID        int64     `json:"id" gorm:"primaryKey"`
+	NodeID    int64     `json:"nodeId" gorm:"index:idx_node_latency_time"`
+	Latency   int       `json:"latency"` // 中位数延迟 ms
+	Min       int       `json:"min"`
+	Max       int       `json:"max"`
+	Jitter    int       `json:"jitter"`
+	Loss      float64   `json:"loss"` // 丢包率 %
+	Samples   int       `json:"samples"`
+	Received  int       `json:"received"`
+	TLS       bool      `json:"tls" gorm:"column:tls"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime;index:idx_node_latency_time"`
+}
+
+// TableName 指定表名
+func (NodeLatencyLog) TableName() string {
+	return "node_latency_logs"
+}
@@ -6,17 +6,19 @@ import (
 
 // Order 订单模型
 type Order struct {
-	ID            int64     `json:"id" gorm:"primaryKey"`
-	UserID        int64     `json:"userId" gorm:"index"`
-	OrderNo       string    `json:"orderNo" gorm:"uniqueIndex;not null"`
-	Type          string    `json:"type"` // purchase/renew/recharge
-	PlanID        *int64    `json:"planId"`
-	Amount        float64   `json:"amount" gorm:"type:decimal(10,2);not null"`
-	PaymentMethod string    `json:"paymentMethod"`
-	Status        string    `json:"status" gorm:"default:'pending'"` // pending/paid/cancelled/refunded
-	PaidAt        *time.Time `json:"paidAt"`
-	CreatedAt     time.Time `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt     time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+	ID             int64      `json:"id" gorm:"primaryKey"`
+	UserID         int64      `json:"userId" gorm:"index"`
+	OrderNo        string     `json:"orderNo" gorm:"uniqueIndex;not null"`
+	Type           string     `json:"type"` // purchase/renew/recharge/traffic_pack/change_plan
+	PlanID         *int64     `json:"planId"`
+	SubscriptionID *int64     `json:"subscriptionId"` // 续费、流量包等针对已有订阅的订单
+	Amount         float64    `json:"amount" gorm:"type:decimal(10,2);not null"`
+	PaymentMethod  string     `json:"paymentMethod"`
+	TradeNo        string     `json:"tradeNo" gorm:"size:64"`          // 支付渠道的交易号
+	Status         string     `json:"status" gorm:"default:'pending'"` // pending/paid/cancelled/refunding/refunded
+	PaidAt         *time.Time `json:"paidAt"`
+	CreatedAt      time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt      time.Time  `json:"updatedAt" gorm:"autoUpdateTime"`
 
 	// Relations
 	User *User             `json:"user,omitempty" gorm:"foreignKey:UserID"`
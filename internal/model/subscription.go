@@ -34,8 +34,20 @@ type SubscriptionPlan struct {
 	Features     StringArray `json:"features" gorm:"type:jsonb"`
 	IsActive     bool        `json:"isActive" gorm:"default:true"`
 	SortOrder    int         `json:"sortOrder" gorm:"default:0"`
-	CreatedAt    time.Time   `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt    time.Time   `json:"updatedAt" gorm:"autoUpdateTime"`
+	// TrafficResetMode 流量重置方式: anniversary 按订阅开始日每月重置, monthly 每月 traffic.reset_day 重置, none 不重置。
+	// 总时长 (含续费) 不超过一个月的订阅不重置
+	TrafficResetMode string `json:"trafficResetMode" gorm:"size:16;default:'anniversary'"`
+	// DeviceLimit 所有节点合计的同时在线设备 (IP) 数，0 表示不限制
+	DeviceLimit int `json:"deviceLimit" gorm:"default:0"`
+	// UploadSpeedLimit/DownloadSpeedLimit 上传/下载限速 Mbps，0 表示不限速
+	UploadSpeedLimit   int64     `json:"uploadSpeedLimit" gorm:"default:0"`
+	DownloadSpeedLimit int64     `json:"downloadSpeedLimit" gorm:"default:0"`
+	CreatedAt          time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt          time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+
+	// Relations
+	// NodeGroups 套餐可访问的节点分组，为空时可访问所有节点
+	NodeGroups []NodeGroup `json:"nodeGroups,omitempty" gorm:"many2many:plan_node_groups;"`
 }
 
 // TableName 指定表名
@@ -45,24 +57,32 @@ func (SubscriptionPlan) TableName() string {
 
 // Subscription 用户订阅模型
 type Subscription struct {
-	ID           int64     `json:"id" gorm:"primaryKey"`
-	UserID       int64     `json:"userId" gorm:"index;not null"`
-	PlanID       int64     `json:"planId"`
-	Name         string    `json:"name"`
-	Type         string    `json:"type"`
-	Status       string    `json:"status" gorm:"default:'active'"` // active/expired/cancelled
-	TrafficLimit int64     `json:"traffic" gorm:"column:traffic_limit"`
-	TrafficUsed  int64     `json:"trafficUsed" gorm:"default:0"`
-	Price        float64   `json:"price" gorm:"type:decimal(10,2)"`
-	DurationDays int       `json:"duration" gorm:"column:duration_days"`
-	SubscribeURL string    `json:"subscribeUrl" gorm:"column:subscribe_url"`
-	StartedAt    time.Time `json:"startedAt" gorm:"autoCreateTime"`
-	ExpiredAt    time.Time `json:"expireDate"`
-	CreatedAt    time.Time `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt    time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+	ID           int64      `json:"id" gorm:"primaryKey"`
+	UserID       int64      `json:"userId" gorm:"index;not null"`
+	PlanID       int64      `json:"planId"`
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	Status       string     `json:"status" gorm:"default:'active'"` // active/expired/exhausted/cancelled
+	TrafficLimit int64      `json:"traffic" gorm:"column:traffic_limit"`
+	TrafficUsed  int64      `json:"trafficUsed" gorm:"default:0"`
+	Price        float64    `json:"price" gorm:"type:decimal(10,2)"`
+	DurationDays int        `json:"duration" gorm:"column:duration_days"`
+	Token        string     `json:"-" gorm:"size:64;uniqueIndex"` // 订阅链接token，可重置
+	SubscribeURL string     `json:"subscribeUrl" gorm:"-"`        // 由公开地址和token拼接，不落库
+	StartedAt    time.Time  `json:"startedAt" gorm:"autoCreateTime"`
+	LastResetAt  *time.Time `json:"lastResetAt"` // 最近一次流量重置时间
+	ExpiredAt    time.Time  `json:"expireDate"`
+	CreatedAt    time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time  `json:"updatedAt" gorm:"autoUpdateTime"`
+	// ExtraTraffic 流量包提供的剩余额外流量 (字节)，超出套餐流量的用量先从中扣除
+	ExtraTraffic int64 `json:"extraTraffic" gorm:"default:0"`
+	// UploadTotal/DownloadTotal 订阅累计的实际上传/下载流量 (字节，不含倍率，不随周期重置)，
+	// 用于拆分已用流量的上下行，原始流量日志清理后仍然可用
+	UploadTotal   int64 `json:"-" gorm:"default:0"`
+	DownloadTotal int64 `json:"-" gorm:"default:0"`
 
 	// Relations
-	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	User *User             `json:"user,omitempty" gorm:"foreignKey:UserID"`
 	Plan *SubscriptionPlan `json:"plan,omitempty" gorm:"foreignKey:PlanID"`
 }
 
@@ -70,3 +90,70 @@ type Subscription struct {
 func (Subscription) TableName() string {
 	return "subscriptions"
 }
+
+// TotalTrafficLimit 订阅当前可用的总流量，即套餐流量加流量包流量
+func (s *Subscription) TotalTrafficLimit() int64 {
+	return s.TrafficLimit + s.ExtraTraffic
+}
+
+// TrafficPack 流量包，可在有效订阅上单独购买的额外流量
+type TrafficPack struct {
+	ID          int64     `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"not null"`
+	Description string    `json:"description" gorm:"type:text"`
+	Traffic     int64     `json:"traffic" gorm:"not null"` // 字节
+	Price       float64   `json:"price" gorm:"type:decimal(10,2);not null"`
+	IsActive    bool      `json:"isActive" gorm:"default:true"`
+	SortOrder   int       `json:"sortOrder" gorm:"default:0"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+}
+
+// TableName 指定表名
+func (TrafficPack) TableName() string {
+	return "traffic_packs"
+}
+
+// TrafficPackPurchase 流量包购买记录，流量包在购买时订阅的到期时间失效。
+// 订阅的 ExtraTraffic 等于各记录 Remaining 之和。
+type TrafficPackPurchase struct {
+	ID             int64     `json:"id" gorm:"primaryKey"`
+	UserID         int64     `json:"userId" gorm:"index;not null"`
+	SubscriptionID int64     `json:"subscriptionId" gorm:"index;not null"`
+	PackID         int64     `json:"packId"`
+	OrderID        int64     `json:"orderId"`
+	Traffic        int64     `json:"traffic"`
+	Remaining      int64     `json:"remaining"` // 截至上次流量重置尚未用完的流量，本周期超出套餐的用量按到期先后分摊
+	ExpiredAt      time.Time `json:"expiredAt" gorm:"index"`
+	Expired        bool      `json:"expired" gorm:"default:false"` // 已到期，未用完的流量已从订阅中扣除
+	CreatedAt      time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+// TableName 指定表名
+func (TrafficPackPurchase) TableName() string {
+	return "traffic_pack_purchases"
+}
+
+// 套餐流量重置方式
+const (
+	TrafficResetMonthly     = "monthly"
+	TrafficResetAnniversary = "anniversary"
+	TrafficResetNone        = "none"
+)
+
+// TrafficUsagePeriod 订阅每个流量周期的用量归档，在流量重置时写入
+type TrafficUsagePeriod struct {
+	ID             int64     `json:"id" gorm:"primaryKey"`
+	SubscriptionID int64     `json:"subscriptionId" gorm:"uniqueIndex:idx_usage_period;not null"`
+	UserID         int64     `json:"userId" gorm:"index;not null"`
+	PeriodStart    time.Time `json:"periodStart"`
+	PeriodEnd      time.Time `json:"periodEnd" gorm:"uniqueIndex:idx_usage_period"`
+	TrafficUsed    int64     `json:"trafficUsed"`
+	TrafficLimit   int64     `json:"trafficLimit"`
+	CreatedAt      time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+// TableName 指定表名
+func (TrafficUsagePeriod) TableName() string {
+	return "traffic_usage_periods"
+}
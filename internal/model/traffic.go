@@ -12,7 +12,9 @@ type TrafficLog struct {
 	NodeID         int64     `json:"nodeId"`
 	UploadBytes    int64     `json:"uploadBytes" gorm:"default:0"`
 	DownloadBytes  int64     `json:"downloadBytes" gorm:"default:0"`
-	TotalBytes     int64     `json:"totalBytes" gorm:"default:0"`
+	TotalBytes     int64     `json:"totalBytes" gorm:"default:0"`   // 实际流量
+	Rate           float64   `json:"rate" gorm:"default:1"`         // 计费时的节点流量倍率
+	ChargedBytes   int64     `json:"chargedBytes" gorm:"default:0"` // 计入订阅的流量
 	RecordedAt     time.Time `json:"recordedAt" gorm:"index:idx_traffic_user_recorded;autoCreateTime"`
 
 	// Relations
@@ -25,3 +27,74 @@ type TrafficLog struct {
 func (TrafficLog) TableName() string {
 	return "traffic_logs"
 }
+
+// TrafficReport 节点流量上报记录，用于上报重试时的幂等去重
+type TrafficReport struct {
+	ID             int64     `json:"id" gorm:"primaryKey"`
+	NodeID         int64     `json:"nodeId" gorm:"uniqueIndex:idx_traffic_report_key;not null"`
+	IdempotencyKey string    `json:"idempotencyKey" gorm:"uniqueIndex:idx_traffic_report_key;size:64;not null"`
+	ItemCount      int       `json:"itemCount"`
+	CreatedAt      time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+// TableName 指定表名
+func (TrafficReport) TableName() string {
+	return "traffic_reports"
+}
+
+// TrafficFlush Redis 流量批次的入库记录，保证同一批次只入库一次
+type TrafficFlush struct {
+	ID        int64     `json:"id" gorm:"primaryKey"`
+	BatchID   string    `json:"batchId" gorm:"uniqueIndex;size:32;not null"`
+	ItemCount int       `json:"itemCount"`
+	CreatedAt time.Time `json:"createdAt" gorm:"autoCreateTime"`
+}
+
+// TableName 指定表名
+func (TrafficFlush) TableName() string {
+	return "traffic_flushes"
+}
+
+// TrafficHourly 按小时汇总的流量，由汇总任务根据 traffic_logs 生成
+type TrafficHourly struct {
+	ID            int64     `json:"id" gorm:"primaryKey"`
+	UserID        int64     `json:"userId" gorm:"uniqueIndex:idx_traffic_hourly_bucket,priority:1;not null"`
+	BucketStart   time.Time `json:"bucketStart" gorm:"uniqueIndex:idx_traffic_hourly_bucket,priority:2;index"`
+	NodeID        int64     `json:"nodeId" gorm:"uniqueIndex:idx_traffic_hourly_bucket,priority:3;not null"`
+	UploadBytes   int64     `json:"uploadBytes"`
+	DownloadBytes int64     `json:"downloadBytes"`
+	ChargedBytes  int64     `json:"chargedBytes"`
+}
+
+// TableName 指定表名
+func (TrafficHourly) TableName() string {
+	return "traffic_hourly"
+}
+
+// TrafficDaily 按天汇总的流量，由汇总任务根据 traffic_hourly 生成
+type TrafficDaily struct {
+	ID            int64     `json:"id" gorm:"primaryKey"`
+	UserID        int64     `json:"userId" gorm:"uniqueIndex:idx_traffic_daily_bucket,priority:1;not null"`
+	BucketStart   time.Time `json:"bucketStart" gorm:"uniqueIndex:idx_traffic_daily_bucket,priority:2"`
+	NodeID        int64     `json:"nodeId" gorm:"uniqueIndex:idx_traffic_daily_bucket,priority:3;not null"`
+	UploadBytes   int64     `json:"uploadBytes"`
+	DownloadBytes int64     `json:"downloadBytes"`
+	ChargedBytes  int64     `json:"chargedBytes"`
+}
+
+// TableName 指定表名
+func (TrafficDaily) TableName() string {
+	return "traffic_daily"
+}
+
+// TrafficRollupState 流量汇总进度，Watermark 之前的数据已汇总完成
+type TrafficRollupState struct {
+	Name      string    `json:"name" gorm:"primaryKey;size:32"`
+	Watermark time.Time `json:"watermark"`
+	UpdatedAt time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+}
+
+// TableName 指定表名
+func (TrafficRollupState) TableName() string {
+	return "traffic_rollup_states"
+}
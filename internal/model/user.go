@@ -1,24 +1,55 @@
 package model
 
 import (
+	"crypto/rand"
+	"fmt"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 // User 用户模型
 type User struct {
-	ID           int64     `json:"id" gorm:"primaryKey"`
-	Email        string    `json:"email" gorm:"uniqueIndex;not null"`
-	Username     string    `json:"username" gorm:"not null"`
-	PasswordHash string    `json:"-" gorm:"column:password_hash;not null"`
-	Avatar       string    `json:"avatar"`
-	Balance      float64   `json:"balance" gorm:"type:decimal(10,2);default:0.00"`
-	Status       string    `json:"status" gorm:"default:'active'"` // active/suspended/deleted
-	CreatedAt    time.Time `json:"createdAt" gorm:"autoCreateTime"`
-	UpdatedAt    time.Time `json:"updatedAt" gorm:"autoUpdateTime"`
+	ID           int64      `json:"id" gorm:"primaryKey"`
+	Email        string     `json:"email" gorm:"uniqueIndex;not null"`
+	Username     string     `json:"username" gorm:"not null"`
+	PasswordHash string     `json:"-" gorm:"column:password_hash;not null"`
+	UUID         string     `json:"-" gorm:"column:uuid;size:36;uniqueIndex"` // 节点连接凭证 (vmess/vless uuid、trojan 密码)
+	Avatar       string     `json:"avatar"`
+	Balance      float64    `json:"balance" gorm:"type:decimal(10,2);default:0.00"`
+	Status       string     `json:"status" gorm:"default:'active'"` // active/suspended/deleted
+	CreatedAt    time.Time  `json:"createdAt" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time  `json:"updatedAt" gorm:"autoUpdateTime"`
 	LastLoginAt  *time.Time `json:"lastLoginAt"`
+	// UploadSpeedLimit/DownloadSpeedLimit 用户单独设置的限速 Mbps，为空时使用套餐限速，0 表示不限速
+	UploadSpeedLimit   *int64 `json:"uploadSpeedLimit"`
+	DownloadSpeedLimit *int64 `json:"downloadSpeedLimit"`
 }
 
 // TableName 指定表名
 func (User) TableName() string {
 	return "users"
 }
+
+// BeforeCreate 创建用户时生成节点连接凭证
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.UUID == "" {
+		id, err := NewUserUUID()
+		if err != nil {
+			return err
+		}
+		u.UUID = id
+	}
+	return nil
+}
+
+// NewUserUUID 生成随机的节点连接凭证 (UUID v4)
+func NewUserUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("生成连接凭证失败: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
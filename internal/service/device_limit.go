@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// 在线设备统计使用的 Redis 键:
+// online:seen:<用户ID> 记录每个 IP 最后上报的时间，超过 onlineIPTTL 未上报的 IP 视为离线；
+// online:first:<用户ID> 记录 IP 首次上线的时间，超出限制时先上线的设备优先保留；
+// online:over_limit 为超出设备数限制的用户集合。
+const (
+	onlineSeenPrefix  = "online:seen:"
+	onlineFirstPrefix = "online:first:"
+	onlineOverLimit   = "online:over_limit"
+)
+
+// onlineIPTTL 在线 IP 的有效期，节点应在此时间内重复上报
+var onlineIPTTL = 3 * time.Minute
+
+// InitDeviceLimit 设置在线 IP 的有效期
+func InitDeviceLimit(ttl time.Duration) {
+	if ttl > 0 {
+		onlineIPTTL = ttl
+	}
+}
+
+// trackOnlineScript 记录用户的在线 IP 并清理过期 IP，返回按首次上线时间排序的在线 IP
+// KEYS[1] seen KEYS[2] first; ARGV[1] 当前时间, ARGV[2] 过期时间点, ARGV[3] 键过期秒数, ARGV[4..] IP
+var trackOnlineScript = redis.NewScript(`
+for i = 4, #ARGV do
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[i])
+	redis.call('ZADD', KEYS[2], 'NX', ARGV[1], ARGV[i])
+end
+local stale = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[2])
+if #stale > 0 then
+	redis.call('ZREM', KEYS[1], unpack(stale))
+	redis.call('ZREM', KEYS[2], unpack(stale))
+end
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[2], ARGV[3])
+end
+return redis.call('ZRANGE', KEYS[2], 0, -1)
+`)
+
+// OnlineUserIPs 节点上报的用户在线 IP
+type OnlineUserIPs struct {
+	UserID int64    `json:"userId" binding:"required"`
+	IPs    []string `json:"ips"`
+}
+
+// DeviceLimitViolation 超出设备数限制的用户
+type DeviceLimitViolation struct {
+	UserID     int64    `json:"userId"`
+	Limit      int      `json:"limit"`
+	Online     int      `json:"online"`     // 所有节点合计的在线 IP 数
+	AllowedIPs []string `json:"allowedIps"` // 允许接入的 IP，其余连接应断开
+}
+
+// OnlineReportResult 在线 IP 上报结果
+type OnlineReportResult struct {
+	Violations []DeviceLimitViolation `json:"violations"`
+}
+
+// trackOnlineIPs 记录用户的在线 IP，返回所有节点合计的在线 IP (按首次上线时间排序)
+func trackOnlineIPs(ctx context.Context, userID int64, ips []string, now time.Time) ([]string, error) {
+	ttl := int64(onlineIPTTL / time.Second)
+	if ttl <= 0 {
+		ttl = 1
+	}
+
+	args := make([]interface{}, 0, len(ips)+3)
+	args = append(args, now.Unix(), now.Add(-onlineIPTTL).Unix(), ttl)
+	for _, ip := range ips {
+		args = append(args, ip)
+	}
+
+	keys := []string{
+		fmt.Sprintf("%s%d", onlineSeenPrefix, userID),
+		fmt.Sprintf("%s%d", onlineFirstPrefix, userID),
+	}
+	return trackOnlineScript.Run(ctx, cache.RedisClient, keys, args...).StringSlice()
+}
+
+// planLimits 用户有效订阅的套餐限制，0 表示不限制
+type planLimits struct {
+	DeviceLimit        int
+	UploadSpeedLimit   int64
+	DownloadSpeedLimit int64
+}
+
+// userPlanLimits 获取用户当前有效订阅的套餐限制 (设备数、上传/下载限速)，
+// 多个订阅时每项分别取最宽松的限制，0 表示不限制
+func userPlanLimits(userIDs []int64) (map[int64]planLimits, error) {
+	type row struct {
+		UserID             int64
+		DeviceLimit        int
+		UploadSpeedLimit   int64
+		DownloadSpeedLimit int64
+	}
+
+	var rows []row
+	if err := db.DB.Table("subscriptions").
+		Select("subscriptions.user_id AS user_id, "+
+			"COALESCE(subscription_plans.device_limit, 0) AS device_limit, "+
+			"COALESCE(subscription_plans.upload_speed_limit, 0) AS upload_speed_limit, "+
+			"COALESCE(subscription_plans.download_speed_limit, 0) AS download_speed_limit").
+		Joins("LEFT JOIN subscription_plans ON subscription_plans.id = subscriptions.plan_id").
+		Where("subscriptions.user_id IN ?", userIDs).
+		Where("subscriptions.status = ? AND subscriptions.expired_at > ?", "active", time.Now()).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	limits := make(map[int64]planLimits, len(rows))
+	for _, r := range rows {
+		current, ok := limits[r.UserID]
+		if !ok {
+			limits[r.UserID] = planLimits{
+				DeviceLimit:        r.DeviceLimit,
+				UploadSpeedLimit:   r.UploadSpeedLimit,
+				DownloadSpeedLimit: r.DownloadSpeedLimit,
+			}
+			continue
+		}
+		limits[r.UserID] = planLimits{
+			DeviceLimit:        looserLimit(current.DeviceLimit, r.DeviceLimit),
+			UploadSpeedLimit:   looserLimit(current.UploadSpeedLimit, r.UploadSpeedLimit),
+			DownloadSpeedLimit: looserLimit(current.DownloadSpeedLimit, r.DownloadSpeedLimit),
+		}
+	}
+	return limits, nil
+}
+
+// looserLimit 取两个限制中较宽松的一个，0 表示不限制
+func looserLimit[T int | int64](a, b T) T {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// ReportOnlineIPs 记录节点上报的用户在线 IP，在所有节点范围内检查设备数限制。
+// 超出限制的用户被标记，节点用户列表中只允许其最早上线的设备接入。
+// 未启用 Redis 时不统计在线设备，也不限制设备数。
+func (s *NodeAgentService) ReportOnlineIPs(reports []OnlineUserIPs) (*OnlineReportResult, error) {
+	result := &OnlineReportResult{Violations: make([]DeviceLimitViolation, 0)}
+	if cache.RedisClient == nil || len(reports) == 0 {
+		return result, nil
+	}
+
+	userIDs := make([]int64, 0, len(reports))
+	for _, report := range reports {
+		userIDs = append(userIDs, report.UserID)
+	}
+	limits, err := userPlanLimits(userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, report := range reports {
+		ips := make([]string, 0, len(report.IPs))
+		for _, ip := range report.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				ips = append(ips, parsed.String())
+			}
+		}
+
+		online, err := trackOnlineIPs(ctx, report.UserID, ips, now)
+		if err != nil {
+			return nil, err
+		}
+
+		limit := limits[report.UserID].DeviceLimit
+		if limit <= 0 || len(online) <= limit {
+			if err := cache.RedisClient.SRem(ctx, onlineOverLimit, report.UserID).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		added, err := cache.RedisClient.SAdd(ctx, onlineOverLimit, report.UserID).Result()
+		if err != nil {
+			return nil, err
+		}
+		if added > 0 {
+			log.Printf("用户 %d 在线设备数 %d 超出限制 %d", report.UserID, len(online), limit)
+		}
+		result.Violations = append(result.Violations, DeviceLimitViolation{
+			UserID:     report.UserID,
+			Limit:      limit,
+			Online:     len(online),
+			AllowedIPs: online[:limit],
+		})
+	}
+
+	return result, nil
+}
+
+// applyDeviceLimits 为超出设备数限制的用户填充允许接入的 IP，并相应更新 ETag。
+// 在线 IP 变化频繁，不随用户列表缓存，每次请求时读取。
+func applyDeviceLimits(list *NodeUserList) *NodeUserList {
+	if cache.RedisClient == nil {
+		return list
+	}
+
+	ctx := context.Background()
+	members, err := cache.RedisClient.SMembers(ctx, onlineOverLimit).Result()
+	if err != nil || len(members) == 0 {
+		return list
+	}
+	flagged := make(map[int64]bool, len(members))
+	for _, m := range members {
+		if id, err := strconv.ParseInt(m, 10, 64); err == nil {
+			flagged[id] = true
+		}
+	}
+
+	users := make([]NodeUser, len(list.Users))
+	copy(users, list.Users)
+	changed := false
+	now := time.Now()
+	for i := range users {
+		user := &users[i]
+		if !flagged[user.ID] || user.DeviceLimit <= 0 {
+			continue
+		}
+
+		online, err := trackOnlineIPs(ctx, user.ID, nil, now)
+		if err != nil {
+			log.Printf("读取用户 %d 在线设备失败: %v", user.ID, err)
+			continue
+		}
+		if len(online) <= user.DeviceLimit {
+			// 设备已下线，解除标记
+			cache.RedisClient.SRem(ctx, onlineOverLimit, user.ID)
+			continue
+		}
+
+		user.AllowedIPs = online[:user.DeviceLimit]
+		changed = true
+	}
+
+	if !changed {
+		return list
+	}
+
+	etag, err := nodeUsersETag(users)
+	if err != nil {
+		return list
+	}
+	return &NodeUserList{ETag: etag, Users: users}
+}
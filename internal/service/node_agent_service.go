@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+)
+
+// NodeUser 节点可接入的用户
+type NodeUser struct {
+	ID          int64  `json:"id"`
+	UUID        string `json:"uuid"`        // vmess/vless uuid，trojan/shadowsocks 密码
+	SpeedLimit  int64  `json:"speedLimit"`  // 限速 Mbps，0 表示不限速 (兼容只支持单一限速的节点，取上传/下载中较严的限速)
+	DeviceLimit int    `json:"deviceLimit"` // 同时在线设备数，0 表示不限制；取用户所有有效订阅中最宽松的套餐限制
+	// UploadSpeedLimit/DownloadSpeedLimit 上传/下载限速 Mbps，0 表示不限速；
+	// 用户单独设置的限速优先，未设置时与设备数一样取所有有效订阅中最宽松的套餐限速
+	UploadSpeedLimit   int64 `json:"uploadSpeedLimit"`
+	DownloadSpeedLimit int64 `json:"downloadSpeedLimit"`
+	// AllowedIPs 超出设备数限制时只允许这些 IP 接入，其余连接应拒绝；为空表示不限制
+	AllowedIPs []string `json:"allowedIps,omitempty" gorm:"-"`
+}
+
+// NodeUserList 节点用户列表
+type NodeUserList struct {
+	ETag  string     `json:"etag"`
+	Users []NodeUser `json:"users"`
+}
+
+// NodeHeartbeat 节点心跳上报的运行状态
+type NodeHeartbeat struct {
+	CPU                float64 `json:"cpu" binding:"min=0,max=100"`    // CPU 使用率 %
+	Memory             float64 `json:"memory" binding:"min=0,max=100"` // 内存使用率 %
+	Uptime             int64   `json:"uptime" binding:"min=0"`         // 运行时长 秒
+	CurrentConnections int     `json:"currentConnections" binding:"min=0"`
+	LoadPercentage     int     `json:"loadPercentage" binding:"min=0,max=100"`
+}
+
+// NodeAgentService 节点通讯服务（供节点端程序调用）
+type NodeAgentService struct{}
+
+// NewNodeAgentService 创建节点通讯服务实例
+func NewNodeAgentService() *NodeAgentService {
+	return &NodeAgentService{}
+}
+
+// GetNodeUsers 获取当前允许接入节点的用户列表。
+// 用户需持有未过期的节点访问权限，且对应订阅处于有效期内、流量未用完。
+// 超出设备数限制的用户附带允许接入的 IP 列表。
+func (s *NodeAgentService) GetNodeUsers(nodeID int64) (*NodeUserList, error) {
+	if list := getCachedNodeUsers(nodeID); list != nil {
+		return applyDeviceLimits(list), nil
+	}
+
+	var node model.Node
+	if err := db.DB.Select("id", "is_active").First(&node, nodeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("节点不存在")
+		}
+		return nil, err
+	}
+	if !node.IsActive {
+		return nil, errors.New("节点已停用")
+	}
+
+	// 用户单独设置的限速为空时使用套餐限速
+	type row struct {
+		ID                 int64
+		UUID               string
+		UploadSpeedLimit   *int64
+		DownloadSpeedLimit *int64
+	}
+
+	now := time.Now()
+	var rows []row
+	if err := db.DB.Table("user_node_access").
+		Select("users.id AS id, users.uuid AS uuid, "+
+			"users.upload_speed_limit AS upload_speed_limit, users.download_speed_limit AS download_speed_limit").
+		Joins("JOIN subscriptions ON subscriptions.id = user_node_access.subscription_id").
+		Joins("JOIN users ON users.id = user_node_access.user_id").
+		Where("user_node_access.node_id = ?", nodeID).
+		Where("(user_node_access.expired_at IS NULL OR user_node_access.expired_at > ?)", now).
+		Where("subscriptions.status = ? AND subscriptions.expired_at > ?", "active", now).
+		Where("subscriptions.traffic_used < subscriptions.traffic_limit + subscriptions.extra_traffic").
+		Where("users.status = ?", "active").
+		Order("users.id ASC").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// 设备数与限速使用同一优先级：用户单独设置 > 用户所有有效订阅中最宽松的套餐限制，
+	// 与在线 IP 上报时的设备数检查一致
+	userIDs := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		userIDs = append(userIDs, r.ID)
+	}
+	limits, err := userPlanLimits(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]NodeUser, 0, len(rows))
+	for _, r := range rows {
+		plan := limits[r.ID]
+		u := NodeUser{
+			ID:                 r.ID,
+			UUID:               r.UUID,
+			DeviceLimit:        plan.DeviceLimit,
+			UploadSpeedLimit:   speedLimitOverride(r.UploadSpeedLimit, plan.UploadSpeedLimit),
+			DownloadSpeedLimit: speedLimitOverride(r.DownloadSpeedLimit, plan.DownloadSpeedLimit),
+		}
+		u.SpeedLimit = combinedSpeedLimit(u.UploadSpeedLimit, u.DownloadSpeedLimit)
+		users = append(users, u)
+	}
+
+	etag, err := nodeUsersETag(users)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &NodeUserList{
+		ETag:  etag,
+		Users: users,
+	}
+	setCachedNodeUsers(nodeID, list)
+
+	return applyDeviceLimits(list), nil
+}
+
+// speedLimitOverride 用户单独设置的限速优先，未设置时使用套餐限速
+func speedLimitOverride(override *int64, plan int64) int64 {
+	if override != nil {
+		return *override
+	}
+	return plan
+}
+
+// combinedSpeedLimit 合并上传/下载限速为单一限速，取非零限速中较小的一个，都为 0 时不限速
+func combinedSpeedLimit(upload, download int64) int64 {
+	switch {
+	case upload <= 0:
+		return max(download, 0)
+	case download <= 0:
+		return upload
+	default:
+		return min(upload, download)
+	}
+}
+
+// nodeUsersETag 根据用户列表内容生成 ETag
+func nodeUsersETag(users []NodeUser) (string, error) {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:16])), nil
+}
+
+// RecordHeartbeat 记录节点心跳并更新运行状态。
+// 离线节点恢复心跳后重新标记为在线 (连续探测失败达到阈值的除外)，维护中的节点保持原状态。
+func (s *NodeAgentService) RecordHeartbeat(nodeID int64, hb NodeHeartbeat) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"cpu_usage":           hb.CPU,
+		"memory_usage":        hb.Memory,
+		"uptime":              hb.Uptime,
+		"current_connections": hb.CurrentConnections,
+		"load_percentage":     hb.LoadPercentage,
+		"last_heartbeat_at":   now,
+		"status": gorm.Expr("CASE WHEN status = ? THEN status WHEN consecutive_failures >= ? THEN ? ELSE ? END",
+			model.NodeStatusMaintenance, nodeHealth.failureThreshold, model.NodeStatusOffline, model.NodeStatusOnline),
+	}
+
+	result := db.DB.Model(&model.Node{}).Where("id = ? AND is_active = ?", nodeID, true).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("节点不存在或已停用")
+	}
+
+	return nil
+}
+
+// MarkStaleNodes 将超过 timeout 未上报心跳的在线节点标记为离线，返回受影响的节点数。
+// 从未上报过心跳的节点 (尚未部署节点程序) 不处理，其状态由健康检查决定。
+func (s *NodeAgentService) MarkStaleNodes(timeout time.Duration) (int64, error) {
+	deadline := time.Now().Add(-timeout)
+	result := db.DB.Model(&model.Node{}).
+		Where("status = ?", model.NodeStatusOnline).
+		Where("last_heartbeat_at IS NOT NULL AND last_heartbeat_at < ?", deadline).
+		Update("status", model.NodeStatusOffline)
+
+	return result.RowsAffected, result.Error
+}
+
+// RunHeartbeatChecker 定期检查节点心跳，直到 ctx 结束
+func (s *NodeAgentService) RunHeartbeatChecker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.MarkStaleNodes(nodeHealth.heartbeatTimeout)
+			if err != nil {
+				log.Printf("节点心跳检查失败: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("%d 个节点心跳超时，已标记为离线", n)
+			}
+		}
+	}
+}
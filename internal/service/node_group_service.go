@@ -0,0 +1,184 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// planNodesQuery 返回套餐可访问的活跃节点查询，套餐未配置分组时为所有活跃节点
+func planNodesQuery(tx *gorm.DB, planID int64) *gorm.DB {
+	return tx.Model(&model.Node{}).
+		Where("nodes.is_active = ?", true).
+		Where(`NOT EXISTS (SELECT 1 FROM plan_node_groups WHERE plan_node_groups.subscription_plan_id = ?)
+			OR nodes.id IN (SELECT node_group_nodes.node_id FROM node_group_nodes
+				JOIN plan_node_groups ON plan_node_groups.node_group_id = node_group_nodes.node_group_id
+				WHERE plan_node_groups.subscription_plan_id = ?)`, planID, planID)
+}
+
+// laterExpiry 新的过期时间晚于已有权限时成立，已有权限不过期 (NULL) 时不更新
+const laterExpiry = "user_node_access.expired_at IS NOT NULL AND excluded.expired_at > user_node_access.expired_at"
+
+// upsertNodeAccess 创建或更新用户的节点访问权限。
+// 已有权限的过期时间更晚时保留原权限，避免购买短期套餐缩短长期订阅的访问时间。
+func upsertNodeAccess(tx *gorm.DB, userID, nodeID, subscriptionID int64, expiredAt time.Time) error {
+	access := model.UserNodeAccess{
+		UserID:         userID,
+		NodeID:         nodeID,
+		SubscriptionID: subscriptionID,
+		ExpiredAt:      &expiredAt,
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "node_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"subscription_id": gorm.Expr("CASE WHEN " + laterExpiry + " THEN excluded.subscription_id ELSE user_node_access.subscription_id END"),
+			"expired_at":      gorm.Expr("CASE WHEN " + laterExpiry + " THEN excluded.expired_at ELSE user_node_access.expired_at END"),
+		}),
+	}).Create(&access).Error
+}
+
+// CreateNode 创建节点并加入分组，同时为套餐可访问该节点的有效订阅分配访问权限
+func (s *NodeService) CreateNode(node *model.Node, groupIDs []int64) error {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(node).Error; err != nil {
+			return err
+		}
+		if err := replaceNodeGroups(tx, node, groupIDs); err != nil {
+			return err
+		}
+		return syncNodeAccess(tx, node.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	InvalidateNodeUsers()
+	return nil
+}
+
+// SetNodeGroups 修改节点所属分组，并按新的分组重新分配访问权限
+func (s *NodeService) SetNodeGroups(nodeID int64, groupIDs []int64) error {
+	node, err := s.GetNodeDetail(nodeID)
+	if err != nil {
+		return err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := replaceNodeGroups(tx, node, groupIDs); err != nil {
+			return err
+		}
+		return syncNodeAccess(tx, node.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	InvalidateNodeUsers()
+	return nil
+}
+
+// SetPlanNodeGroups 修改套餐可访问的节点分组，并为该套餐的有效订阅重新分配访问权限
+func (s *SubscriptionService) SetPlanNodeGroups(planID int64, groupIDs []int64) error {
+	var plan model.SubscriptionPlan
+	if err := db.DB.First(&plan, planID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("套餐不存在")
+		}
+		return err
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		groups, err := findNodeGroups(tx, groupIDs)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&plan).Association("NodeGroups").Replace(groups); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var subscriptions []model.Subscription
+		if err := tx.Where("plan_id = ? AND status = ? AND expired_at > ?", planID, "active", now).
+			Find(&subscriptions).Error; err != nil {
+			return err
+		}
+		for i := range subscriptions {
+			if err := s.revokeNodeAccessTx(tx, &subscriptions[i], now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	InvalidateNodeUsers()
+	return nil
+}
+
+// findNodeGroups 获取指定的节点分组，有分组不存在时返回错误
+func findNodeGroups(tx *gorm.DB, groupIDs []int64) ([]model.NodeGroup, error) {
+	groups := make([]model.NodeGroup, 0, len(groupIDs))
+	if len(groupIDs) > 0 {
+		if err := tx.Where("id IN ?", groupIDs).Find(&groups).Error; err != nil {
+			return nil, err
+		}
+		if len(groups) != len(groupIDs) {
+			return nil, errors.New("节点分组不存在")
+		}
+	}
+	return groups, nil
+}
+
+// replaceNodeGroups 替换节点所属分组
+func replaceNodeGroups(tx *gorm.DB, node *model.Node, groupIDs []int64) error {
+	groups, err := findNodeGroups(tx, groupIDs)
+	if err != nil {
+		return err
+	}
+	return tx.Model(node).Association("Groups").Replace(groups)
+}
+
+// syncNodeAccess 按套餐分组同步节点的访问权限:
+// 为可访问该节点的有效订阅分配权限，撤销不再可访问的用户的权限
+func syncNodeAccess(tx *gorm.DB, nodeID int64) error {
+	var node model.Node
+	if err := tx.Select("id", "is_active").First(&node, nodeID).Error; err != nil {
+		return err
+	}
+	if !node.IsActive {
+		return nil
+	}
+
+	// 按过期时间升序处理，同一用户有多个订阅时保留最晚的过期时间
+	var subscriptions []model.Subscription
+	if err := tx.Where("status = ? AND expired_at > ?", "active", time.Now()).
+		Where(`NOT EXISTS (SELECT 1 FROM plan_node_groups WHERE plan_node_groups.subscription_plan_id = subscriptions.plan_id)
+			OR EXISTS (SELECT 1 FROM plan_node_groups
+				JOIN node_group_nodes ON node_group_nodes.node_group_id = plan_node_groups.node_group_id
+				WHERE plan_node_groups.subscription_plan_id = subscriptions.plan_id AND node_group_nodes.node_id = ?)`, nodeID).
+		Order("expired_at ASC").
+		Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	userIDs := make([]int64, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		if err := upsertNodeAccess(tx, sub.UserID, nodeID, sub.ID, sub.ExpiredAt); err != nil {
+			return err
+		}
+		userIDs = append(userIDs, sub.UserID)
+	}
+
+	revoke := tx.Where("node_id = ?", nodeID)
+	if len(userIDs) > 0 {
+		revoke = revoke.Where("user_id NOT IN ?", userIDs)
+	}
+	return revoke.Delete(&model.UserNodeAccess{}).Error
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/mariclezhang/vps_backend/pkg/probe"
+	"gorm.io/gorm"
+)
+
+// nodeHealth 节点在线判定参数:
+// 心跳在 heartbeatTimeout 内且连续探测失败次数小于 failureThreshold 的节点视为在线
+var nodeHealth = struct {
+	heartbeatTimeout time.Duration
+	failureThreshold int
+}{
+	heartbeatTimeout: 90 * time.Second,
+	failureThreshold: 3,
+}
+
+// InitNodeHealth 设置节点心跳超时与连续探测失败阈值
+func InitNodeHealth(heartbeatTimeout time.Duration, failureThreshold int) {
+	if heartbeatTimeout > 0 {
+		nodeHealth.heartbeatTimeout = heartbeatTimeout
+	}
+	if failureThreshold > 0 {
+		nodeHealth.failureThreshold = failureThreshold
+	}
+}
+
+// updateNodeHealth 根据探测结果更新节点状态:
+// 失败累加连续失败次数，达到阈值标记离线；成功清零，心跳正常或从未上报过心跳 (未部署节点程序) 时恢复在线。
+// 维护中的节点只记录失败次数，不改变状态。
+func updateNodeHealth(nodeID int64, result *probe.Result) error {
+	query := db.DB.Model(&model.Node{}).Where("id = ?", nodeID)
+
+	if result.Received == 0 {
+		return query.Updates(map[string]interface{}{
+			"consecutive_failures": gorm.Expr("consecutive_failures + 1"),
+			"status": gorm.Expr("CASE WHEN status <> ? AND consecutive_failures + 1 >= ? THEN ? ELSE status END",
+				model.NodeStatusMaintenance, nodeHealth.failureThreshold, model.NodeStatusOffline),
+		}).Error
+	}
+
+	// 节点列表展示最近一次成功探测的延迟
+	return query.Updates(map[string]interface{}{
+		"latency":              result.Latency,
+		"consecutive_failures": 0,
+		"status": gorm.Expr("CASE WHEN status = ? AND (last_heartbeat_at IS NULL OR last_heartbeat_at >= ?) THEN ? ELSE status END",
+			model.NodeStatusOffline, time.Now().Add(-nodeHealth.heartbeatTimeout), model.NodeStatusOnline),
+	}).Error
+}
+
+// CheckAllNodes 使用最多 workers 个并发探测所有启用的节点，返回探测失败的节点数
+func (s *NodeService) CheckAllNodes(ctx context.Context, workers int) (int, error) {
+	var nodes []model.Node
+	if err := db.DB.Where("is_active = ?", true).Find(&nodes).Error; err != nil {
+		return 0, err
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	queue := make(chan *model.Node)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range queue {
+				result, err := s.probeNode(ctx, node)
+				if err != nil || result.Received == 0 {
+					if err != nil {
+						log.Printf("节点 %d 探测失败: %v", node.ID, err)
+					}
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := range nodes {
+		select {
+		case queue <- &nodes[i]:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return failed, ctx.Err()
+}
+
+// RunHealthChecker 定期探测所有节点，直到 ctx 结束
+func (s *NodeService) RunHealthChecker(ctx context.Context, interval time.Duration, workers int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			failed, err := s.CheckAllNodes(ctx, workers)
+			if err != nil {
+				log.Printf("节点健康检查失败: %v", err)
+				continue
+			}
+			if failed > 0 {
+				log.Printf("节点健康检查完成，%d 个节点不可达", failed)
+			}
+		}
+	}
+}
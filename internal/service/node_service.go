@@ -1,11 +1,19 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/mariclezhang/vps_backend/internal/model"
 	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/mariclezhang/vps_backend/pkg/probe"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // NodeService 节点服务
@@ -16,26 +24,61 @@ func NewNodeService() *NodeService {
 	return &NodeService{}
 }
 
-// GetNodes 获取节点列表
-func (s *NodeService) GetNodes(location, protocol string) ([]model.Node, error) {
-	query := db.DB.Where("is_active = ?", true)
+// ErrNodeAccessDenied 用户无权访问节点
+var ErrNodeAccessDenied = errors.New("无权访问该节点")
+
+// GetNodes 获取用户有权访问的节点列表
+func (s *NodeService) GetNodes(userID int64, location, protocol string) ([]model.Node, error) {
+	query := db.DB.Model(&model.Node{}).
+		Joins("JOIN user_node_access ON user_node_access.node_id = nodes.id").
+		Where("user_node_access.user_id = ?", userID).
+		Where("(user_node_access.expired_at IS NULL OR user_node_access.expired_at > ?)", time.Now()).
+		Where("nodes.is_active = ?", true)
 
 	if location != "" {
-		query = query.Where("location = ?", location)
+		query = query.Where("nodes.location = ?", location)
 	}
 
 	if protocol != "" {
-		query = query.Where("protocol = ?", protocol)
+		query = query.Where("nodes.protocol = ?", protocol)
 	}
 
 	var nodes []model.Node
-	if err := query.Order("location ASC, name ASC").Find(&nodes).Error; err != nil {
+	if err := query.Order("nodes.location ASC, nodes.name ASC").Find(&nodes).Error; err != nil {
 		return nil, err
 	}
 
 	return nodes, nil
 }
 
+// GetNodeDetailForUser 获取用户可见的节点详情，无访问权限时隐藏连接信息
+func (s *NodeService) GetNodeDetailForUser(userID, nodeID int64) (*model.Node, error) {
+	node, err := s.GetNodeDetail(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsActive {
+		return nil, errors.New("节点不存在")
+	}
+
+	hasAccess, err := s.CheckUserNodeAccess(userID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAccess {
+		redactNode(node)
+	}
+
+	return node, nil
+}
+
+// redactNode 清除节点的地址、端口和连接配置
+func redactNode(node *model.Node) {
+	node.ServerAddress = ""
+	node.ServerPort = 0
+	node.Config = nil
+}
+
 // GetNodeDetail 获取节点详情
 func (s *NodeService) GetNodeDetail(nodeID int64) (*model.Node, error) {
 	var node model.Node
@@ -49,27 +92,83 @@ func (s *NodeService) GetNodeDetail(nodeID int64) (*model.Node, error) {
 	return &node, nil
 }
 
-// TestLatency 测试节点延迟
-func (s *NodeService) TestLatency(nodeID int64) (int, error) {
-	var node model.Node
-	if err := db.DB.First(&node, nodeID).Error; err != nil {
-		return 0, err
+// latencyProbeOptions 节点延迟探测参数
+var latencyProbeOptions = probe.DefaultOptions
+
+// InitLatencyProbe 设置延迟探测的采样次数与单次超时
+func InitLatencyProbe(samples int, timeout time.Duration) {
+	if samples > 0 {
+		latencyProbeOptions.Samples = samples
+	}
+	if timeout > 0 {
+		latencyProbeOptions.Timeout = timeout
+	}
+}
+
+// TestLatency 测试节点延迟，对节点地址进行多次 TCP 连接探测 (启用 TLS 的节点包含握手)，
+// 结果写入延迟时间序列。用户需有权访问该节点，ctx 结束 (如客户端断开) 时停止探测。
+func (s *NodeService) TestLatency(ctx context.Context, userID, nodeID int64) (*probe.Result, error) {
+	node, err := s.GetNodeDetail(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	hasAccess, err := s.CheckUserNodeAccess(userID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAccess {
+		return nil, ErrNodeAccessDenied
+	}
+
+	return s.probeNode(ctx, node)
+}
+
+// probeNode 探测节点并记录结果，同时更新节点的连续失败次数与在线状态
+func (s *NodeService) probeNode(ctx context.Context, node *model.Node) (*probe.Result, error) {
+	if node.ServerAddress == "" || node.ServerPort <= 0 {
+		return nil, errors.New("节点地址未配置")
+	}
+
+	opts := latencyProbeOptions
+	if tlsEnabled, _ := node.Config[model.NodeConfigTLS].(bool); tlsEnabled || node.Protocol == model.NodeProtocolTrojan {
+		opts.TLS = true
+		opts.ServerName, _ = node.Config[model.NodeConfigSNI].(string)
+	}
+
+	address := net.JoinHostPort(node.ServerAddress, strconv.Itoa(node.ServerPort))
+	result, err := probe.TCP(ctx, address, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: 实际的延迟测试逻辑
-	// 这里仅模拟返回延迟值
-	latency := 120 // ms
+	latencyLog := model.NodeLatencyLog{
+		NodeID:   node.ID,
+		Latency:  result.Latency,
+		Min:      result.Min,
+		Max:      result.Max,
+		Jitter:   result.Jitter,
+		Loss:     result.Loss,
+		Samples:  result.Samples,
+		Received: result.Received,
+		TLS:      result.TLS,
+	}
+	if err := db.DB.Create(&latencyLog).Error; err != nil {
+		return nil, err
+	}
 
-	// 更新节点延迟
-	db.DB.Model(&node).Update("latency", latency)
+	if err := updateNodeHealth(node.ID, result); err != nil {
+		return nil, err
+	}
 
-	return latency, nil
+	return result, nil
 }
 
-// CheckUserNodeAccess 检查用户是否有权访问节点
+// CheckUserNodeAccess 检查用户是否有权访问节点 (访问权限未过期)
 func (s *NodeService) CheckUserNodeAccess(userID, nodeID int64) (bool, error) {
 	var access model.UserNodeAccess
 	err := db.DB.Where("user_id = ? AND node_id = ?", userID, nodeID).
+		Where("expired_at IS NULL OR expired_at > ?", time.Now()).
 		First(&access).Error
 
 	if err != nil {
@@ -81,3 +180,61 @@ func (s *NodeService) CheckUserNodeAccess(userID, nodeID int64) (bool, error) {
 
 	return true, nil
 }
+
+// GetUserAccessibleNodes 获取用户当前有权访问的节点
+func (s *NodeService) GetUserAccessibleNodes(userID int64) ([]model.Node, error) {
+	return s.GetNodes(userID, "", "")
+}
+
+// GetNodeCredential 根据密钥ID获取节点ID与签名密钥
+func (s *NodeService) GetNodeCredential(keyID string) (int64, string, error) {
+	var credential model.NodeCredential
+	if err := db.DB.Where("key_id = ?", keyID).First(&credential).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, "", errors.New("节点密钥不存在")
+		}
+		return 0, "", err
+	}
+
+	return credential.NodeID, credential.Secret, nil
+}
+
+// RotateNodeKey 生成或轮换节点通讯密钥，旧密钥立即失效，不影响其他节点
+func (s *NodeService) RotateNodeKey(nodeID int64) (*model.NodeCredential, error) {
+	if _, err := s.GetNodeDetail(nodeID); err != nil {
+		return nil, err
+	}
+
+	keyID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := model.NodeCredential{
+		NodeID: nodeID,
+		KeyID:  "nk_" + keyID,
+		Secret: secret,
+	}
+
+	if err := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"key_id", "secret", "updated_at"}),
+	}).Create(&credential).Error; err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+// randomHex 生成 n 字节随机数的十六进制字符串
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
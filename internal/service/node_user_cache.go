@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// nodeUsersVersionKey 节点用户列表缓存版本号，递增即可使所有节点的缓存失效
+const nodeUsersVersionKey = "node:users:version"
+
+// nodeUserCacheTTL 节点用户列表缓存时间
+var nodeUserCacheTTL = 60 * time.Second
+
+// InitNodeAgent 设置节点用户列表缓存时间
+func InitNodeAgent(cacheTTL time.Duration) {
+	if cacheTTL > 0 {
+		nodeUserCacheTTL = cacheTTL
+	}
+}
+
+// nodeUsersCacheKey 生成带版本号的缓存键
+func nodeUsersCacheKey(ctx context.Context, nodeID int64) (string, error) {
+	version, err := cache.RedisClient.Get(ctx, nodeUsersVersionKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+	return fmt.Sprintf("node:users:%d:%d", version, nodeID), nil
+}
+
+// getCachedNodeUsers 读取缓存的节点用户列表，未启用Redis或未命中时返回 nil
+func getCachedNodeUsers(nodeID int64) *NodeUserList {
+	if cache.RedisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	key, err := nodeUsersCacheKey(ctx, nodeID)
+	if err != nil {
+		return nil
+	}
+
+	data, err := cache.RedisClient.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	var list NodeUserList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil
+	}
+	return &list
+}
+
+// setCachedNodeUsers 缓存节点用户列表
+func setCachedNodeUsers(nodeID int64, list *NodeUserList) {
+	if cache.RedisClient == nil {
+		return
+	}
+
+	ctx := context.Background()
+	key, err := nodeUsersCacheKey(ctx, nodeID)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+
+	if err := cache.RedisClient.Set(ctx, key, data, nodeUserCacheTTL).Err(); err != nil {
+		log.Printf("缓存节点用户列表失败: %v", err)
+	}
+}
+
+// InvalidateNodeUsers 使所有节点的用户列表缓存失效，在用户可用状态变化时调用
+func InvalidateNodeUsers() {
+	if cache.RedisClient == nil {
+		return
+	}
+
+	if err := cache.RedisClient.Incr(context.Background(), nodeUsersVersionKey).Err(); err != nil {
+		log.Printf("刷新节点用户列表缓存失败: %v", err)
+	}
+}
+
+// nodeUserEventsChannel 用户可用状态变化的 Redis 发布频道
+const nodeUserEventsChannel = "node:users:events"
+
+// NodeUserEvent 用户可用状态变化事件
+type NodeUserEvent struct {
+	UserID         int64  `json:"userId"`
+	SubscriptionID int64  `json:"subscriptionId"`
+	Status         string `json:"status"` // 订阅的新状态 active/expired/exhausted/cancelled
+}
+
+// publishNodeUserEvents 使节点用户列表缓存失效并发布状态变化事件
+func publishNodeUserEvents(events ...NodeUserEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	InvalidateNodeUsers()
+	if cache.RedisClient == nil {
+		return
+	}
+
+	ctx := context.Background()
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if err := cache.RedisClient.Publish(ctx, nodeUserEventsChannel, data).Err(); err != nil {
+			log.Printf("发布用户状态变化事件失败: %v", err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/mariclezhang/vps_backend/pkg/payment"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrOrderNotFound 订单不存在
+var ErrOrderNotFound = errors.New("订单不存在")
+
+// paymentNotifyBaseURL 支付渠道回调的公开访问地址
+var paymentNotifyBaseURL = "http://localhost:8080"
+
+// InitPayment 设置支付渠道回调的公开访问地址，回调地址为 <baseURL>/api/payments/<支付方式>/notify
+func InitPayment(notifyBaseURL string) {
+	if notifyBaseURL != "" {
+		paymentNotifyBaseURL = strings.TrimRight(notifyBaseURL, "/")
+	}
+}
+
+// RechargeResult 发起充值的结果
+type RechargeResult struct {
+	OrderNo       string  `json:"orderNo"`
+	Amount        float64 `json:"amount"`
+	PaymentMethod string  `json:"paymentMethod"`
+	PayURL        string  `json:"payUrl"` // 用户完成支付的地址
+}
+
+// PaymentService 支付服务
+type PaymentService struct{}
+
+// NewPaymentService 创建支付服务实例
+func NewPaymentService() *PaymentService {
+	return &PaymentService{}
+}
+
+// toCents 金额转换为分，用于比较
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// CreateRecharge 创建待支付的充值订单并向支付渠道发起支付，余额在支付成功回调后到账
+func (s *PaymentService) CreateRecharge(userID int64, amount float64, method string) (*RechargeResult, error) {
+	amount = float64(toCents(amount)) / 100
+	if amount <= 0 {
+		return nil, errors.New("金额必须大于0")
+	}
+
+	provider, err := payment.Get(method)
+	if err != nil {
+		return nil, err
+	}
+
+	order := model.Order{
+		UserID:        userID,
+		OrderNo:       generateOrderNo(userID),
+		Type:          "recharge",
+		Amount:        amount,
+		PaymentMethod: method,
+		Status:        "pending",
+	}
+	if err := db.DB.Create(&order).Error; err != nil {
+		return nil, err
+	}
+
+	pay, err := provider.CreatePayment(context.Background(), payment.Request{
+		OrderNo:   order.OrderNo,
+		Amount:    amount,
+		Subject:   fmt.Sprintf("账户充值 %.2f 元", amount),
+		NotifyURL: fmt.Sprintf("%s/api/payments/%s/notify", paymentNotifyBaseURL, method),
+	})
+	if err != nil {
+		db.DB.Model(&order).Update("status", "cancelled")
+		return nil, err
+	}
+
+	if err := db.DB.Model(&order).Update("trade_no", pay.TradeNo).Error; err != nil {
+		return nil, err
+	}
+
+	return &RechargeResult{
+		OrderNo:       order.OrderNo,
+		Amount:        amount,
+		PaymentMethod: method,
+		PayURL:        pay.PayURL,
+	}, nil
+}
+
+// HandleCallback 处理支付渠道的异步通知，验签通过且支付成功时为充值订单入账。
+// 重复通知不会重复入账。
+func (s *PaymentService) HandleCallback(method string, r *http.Request) error {
+	provider, err := payment.Get(method)
+	if err != nil {
+		return err
+	}
+
+	notification, err := provider.VerifyCallback(r)
+	if err != nil {
+		return err
+	}
+
+	if notification.Status != payment.StatusPaid {
+		return nil
+	}
+
+	_, err = s.settleRecharge(method, notification.OrderNo, notification.TradeNo, notification.Amount)
+	return err
+}
+
+// settleRecharge 将待支付的充值订单标记为已支付并增加余额，返回本次是否入账
+func (s *PaymentService) settleRecharge(method, orderNo, tradeNo string, amount float64) (bool, error) {
+	var settled bool
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var order model.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("order_no = ? AND type = ?", orderNo, "recharge").
+			First(&order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrOrderNotFound
+			}
+			return err
+		}
+
+		if order.Status == "paid" {
+			// 重复通知
+			return nil
+		}
+		if order.Status != "pending" {
+			return fmt.Errorf("订单状态为 %s，无法入账", order.Status)
+		}
+		if order.PaymentMethod != method {
+			return errors.New("支付方式与订单不符")
+		}
+		if toCents(amount) != toCents(order.Amount) {
+			return errors.New("支付金额与订单不符")
+		}
+
+		now := time.Now()
+		if err := tx.Model(&order).Updates(map[string]interface{}{
+			"status":   "paid",
+			"trade_no": tradeNo,
+			"paid_at":  now,
+		}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&model.User{}).Where("id = ?", order.UserID).
+			Update("balance", gorm.Expr("balance + ?", order.Amount)).Error; err != nil {
+			return err
+		}
+
+		settled = true
+		return nil
+	})
+
+	return settled, err
+}
+
+// GetRecharge 获取用户的充值订单，未收到回调时向支付渠道查询并补单
+func (s *PaymentService) GetRecharge(userID int64, orderNo string) (*model.Order, error) {
+	var order model.Order
+	if err := db.DB.Where("order_no = ? AND user_id = ? AND type = ?", orderNo, userID, "recharge").
+		First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+
+	if order.Status != "pending" {
+		return &order, nil
+	}
+
+	provider, err := payment.Get(order.PaymentMethod)
+	if err != nil {
+		return &order, nil
+	}
+
+	result, err := provider.Query(context.Background(), order.OrderNo)
+	if err != nil || result.Status != payment.StatusPaid {
+		return &order, nil
+	}
+
+	if _, err := s.settleRecharge(order.PaymentMethod, order.OrderNo, result.TradeNo, result.Amount); err != nil {
+		return nil, err
+	}
+	if err := db.DB.First(&order, order.ID).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// RefundRecharge 对已支付的充值订单全额退款，从用户余额中扣回充值金额。
+// 先扣回余额并将订单标记为退款中，提交后再调用支付渠道退款，避免在事务中等待外部请求：
+// 渠道退款成功后订单标记为已退款；确认未退款时退回余额并恢复为已支付；
+// 结果无法确认时订单保持退款中，再次调用即可重试。
+func (s *PaymentService) RefundRecharge(orderNo string) error {
+	order, err := s.holdRefund(orderNo)
+	if err != nil {
+		return err
+	}
+
+	provider, err := payment.Get(order.PaymentMethod)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	refundErr := provider.Refund(ctx, order.OrderNo, order.Amount)
+	if refundErr != nil {
+		// 退款请求失败时以渠道的订单状态为准 (例如重试时渠道已完成退款)
+		result, err := provider.Query(ctx, order.OrderNo)
+		switch {
+		case err != nil:
+			return fmt.Errorf("退款结果未知，订单保持退款中，可稍后重试: %w", refundErr)
+		case result.Status == payment.StatusPaid:
+			if err := s.releaseRefund(order); err != nil {
+				return err
+			}
+			return refundErr
+		case result.Status != payment.StatusRefunded:
+			return fmt.Errorf("退款结果未知，订单保持退款中，可稍后重试: %w", refundErr)
+		}
+	}
+
+	return db.DB.Model(&model.Order{}).
+		Where("id = ? AND status = ?", order.ID, "refunding").
+		Update("status", "refunded").Error
+}
+
+// holdRefund 扣回充值金额并将订单标记为退款中，订单已在退款中时直接返回以便重试
+func (s *PaymentService) holdRefund(orderNo string) (*model.Order, error) {
+	var order model.Order
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("order_no = ? AND type = ?", orderNo, "recharge").
+			First(&order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrOrderNotFound
+			}
+			return err
+		}
+
+		if order.Status == "refunding" {
+			return nil
+		}
+		if order.Status != "paid" {
+			return errors.New("订单未支付，无法退款")
+		}
+
+		var user model.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, order.UserID).Error; err != nil {
+			return err
+		}
+		if user.Balance < order.Amount {
+			return errors.New("余额不足，无法退款")
+		}
+
+		if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", order.Amount)).Error; err != nil {
+			return err
+		}
+		return tx.Model(&order).Update("status", "refunding").Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// releaseRefund 渠道确认未退款时退回余额，订单恢复为已支付
+func (s *PaymentService) releaseRefund(order *model.Order) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.Order{}).
+			Where("id = ? AND status = ?", order.ID, "refunding").
+			Update("status", "paid")
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return tx.Model(&model.User{}).Where("id = ?", order.UserID).
+			Update("balance", gorm.Expr("balance + ?", order.Amount)).Error
+	})
+}
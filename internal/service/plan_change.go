@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PlanChangeResult 更换套餐结果
+type PlanChangeResult struct {
+	Subscription *model.Subscription `json:"subscription"`
+	Credit       float64             `json:"credit"` // 原订阅未使用部分折算的金额
+	Price        float64             `json:"price"`  // 新套餐价格
+	Amount       float64             `json:"amount"` // 实际扣除的余额，负数表示退回余额
+	OrderNo      string              `json:"orderNo"`
+}
+
+// prorateCredit 计算订阅未使用部分的价值。
+// 当前周期按 剩余时间比例 与 剩余套餐流量比例 中较小者折算，续费预付的后续整周期全额折算。
+func prorateCredit(sub *model.Subscription, now time.Time) float64 {
+	if sub.DurationDays <= 0 || !sub.ExpiredAt.After(now) {
+		return 0
+	}
+
+	period := time.Duration(sub.DurationDays) * 24 * time.Hour
+	remaining := float64(sub.ExpiredAt.Sub(now)) / float64(period)
+	future := math.Ceil(remaining) - 1
+	current := remaining - future
+
+	trafficRatio := 0.0
+	if sub.TrafficLimit > 0 && sub.TrafficUsed < sub.TrafficLimit {
+		trafficRatio = float64(sub.TrafficLimit-sub.TrafficUsed) / float64(sub.TrafficLimit)
+	}
+
+	credit := sub.Price * (math.Min(current, trafficRatio) + future)
+	return math.Round(credit*100) / 100
+}
+
+// ChangePlan 将订阅更换为其他套餐。
+// 原订阅未使用部分折算抵扣新套餐价格，差额从余额扣除或退回余额；
+// 订阅从当前时间开始按新套餐计算时长和流量，订阅链接和流量包保持不变。
+func (s *SubscriptionService) ChangePlan(userID, subscriptionID, planID int64) (*PlanChangeResult, error) {
+	// 取出该用户在 Redis 中待同步的流量，随本次更换一并入库，按最新用量折算
+	ctx := context.Background()
+	var pending map[trafficKey]*trafficCounter
+	if cache.RedisClient != nil {
+		var err error
+		if pending, err = takeUserTraffic(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	var result *PlanChangeResult
+	var events []NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		for key, counter := range pending {
+			event, err := s.recordTrafficTx(tx, key.UserID, key.NodeID, counter.Upload, counter.Download, trafficLimitNone)
+			if err != nil && !errors.Is(err, ErrNoActiveSubscription) {
+				return err
+			}
+			if event != nil {
+				events = append(events, *event)
+			}
+		}
+
+		var subscription model.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, subscriptionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("订阅不存在")
+			}
+			return err
+		}
+
+		if subscription.UserID != userID {
+			return errors.New("无权操作此订阅")
+		}
+
+		now := time.Now()
+		if (subscription.Status != "active" && subscription.Status != "exhausted") || !subscription.ExpiredAt.After(now) {
+			return errors.New("订阅已失效，无法更换套餐")
+		}
+
+		if subscription.PlanID == planID {
+			return errors.New("已是该套餐")
+		}
+
+		var plan model.SubscriptionPlan
+		if err := tx.Where("id = ? AND is_active = ?", planID, true).First(&plan).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("套餐不存在")
+			}
+			return err
+		}
+
+		credit := prorateCredit(&subscription, now)
+		amount := math.Round((plan.Price-credit)*100) / 100
+
+		// 结算余额
+		var user model.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		if user.Balance < amount {
+			return errors.New("余额不足")
+		}
+
+		if amount != 0 {
+			if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", amount)).Error; err != nil {
+				return err
+			}
+		}
+
+		// 归档原套餐的用量，超出套餐流量的部分从流量包中扣除
+		periodStart := subscription.StartedAt
+		if subscription.LastResetAt != nil && subscription.LastResetAt.After(periodStart) {
+			periodStart = *subscription.LastResetAt
+		}
+		if err := tx.Create(&model.TrafficUsagePeriod{
+			SubscriptionID: subscription.ID,
+			UserID:         subscription.UserID,
+			PeriodStart:    periodStart,
+			PeriodEnd:      now,
+			TrafficUsed:    subscription.TrafficUsed,
+			TrafficLimit:   subscription.TotalTrafficLimit(),
+		}).Error; err != nil {
+			return err
+		}
+
+		extra, err := consumeTrafficPacksTx(tx, &subscription)
+		if err != nil {
+			return err
+		}
+
+		// 按新套餐重新计算订阅
+		if err := tx.Model(&subscription).Updates(map[string]interface{}{
+			"plan_id":       plan.ID,
+			"name":          plan.Name,
+			"status":        "active",
+			"traffic_limit": plan.TrafficLimit,
+			"traffic_used":  0,
+			"extra_traffic": extra,
+			"price":         plan.Price,
+			"duration_days": plan.DurationDays,
+			"started_at":    now,
+			"last_reset_at": nil,
+			"expired_at":    now.AddDate(0, 0, plan.DurationDays),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&subscription, subscription.ID).Error; err != nil {
+			return err
+		}
+
+		// 按新套餐的节点分组重新分配节点访问权限
+		if err := s.revokeNodeAccessTx(tx, &subscription, now); err != nil {
+			return err
+		}
+
+		// 创建订单记录
+		order := model.Order{
+			UserID:         userID,
+			OrderNo:        generateOrderNo(userID),
+			Type:           "change_plan",
+			PlanID:         &plan.ID,
+			SubscriptionID: &subscription.ID,
+			Amount:         amount,
+			PaymentMethod:  "balance",
+			Status:         "paid",
+			PaidAt:         &now,
+		}
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+
+		result = &PlanChangeResult{
+			Subscription: &subscription,
+			Credit:       credit,
+			Price:        plan.Price,
+			Amount:       amount,
+			OrderNo:      order.OrderNo,
+		}
+		return nil
+	})
+	if err != nil {
+		if len(pending) > 0 {
+			if restoreErr := restoreUserTraffic(ctx, pending); restoreErr != nil {
+				log.Printf("放回用户 %d 待同步的流量失败: %v", userID, restoreErr)
+			}
+		}
+		return nil, err
+	}
+
+	events = append(events, NodeUserEvent{UserID: userID, SubscriptionID: subscriptionID, Status: "active"})
+	publishNodeUserEvents(events...)
+	s.fillSubscribeURL(result.Subscription)
+	return result, nil
+}
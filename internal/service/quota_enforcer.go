@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// suspendSubscriptionTx 将订阅标记为 status (expired/exhausted/cancelled) 并使其节点访问权限失效。
+// 用户的其他有效订阅会重新分配节点权限，避免误伤。
+func (s *SubscriptionService) suspendSubscriptionTx(tx *gorm.DB, sub *model.Subscription, status string, now time.Time) (*NodeUserEvent, error) {
+	if err := tx.Model(&model.Subscription{}).Where("id = ?", sub.ID).
+		Update("status", status).Error; err != nil {
+		return nil, err
+	}
+	sub.Status = status
+
+	if err := s.revokeNodeAccessTx(tx, sub, now); err != nil {
+		return nil, err
+	}
+
+	return &NodeUserEvent{UserID: sub.UserID, SubscriptionID: sub.ID, Status: status}, nil
+}
+
+// revokeNodeAccessTx 使订阅已分配的节点访问权限失效，再为用户当前所有有效订阅重新分配权限
+func (s *SubscriptionService) revokeNodeAccessTx(tx *gorm.DB, sub *model.Subscription, now time.Time) error {
+	if err := tx.Model(&model.UserNodeAccess{}).
+		Where("subscription_id = ?", sub.ID).
+		Where("expired_at IS NULL OR expired_at > ?", now).
+		Update("expired_at", now).Error; err != nil {
+		return err
+	}
+
+	// 按过期时间升序重新分配，同一节点保留最晚的过期时间
+	var subscriptions []model.Subscription
+	if err := tx.Where("user_id = ? AND status = ? AND expired_at > ?", sub.UserID, "active", now).
+		Where("traffic_used < traffic_limit + extra_traffic").
+		Order("expired_at ASC").
+		Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	for _, other := range subscriptions {
+		if err := s.grantNodeAccess(tx, other.UserID, other.ID, other.PlanID, other.ExpiredAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreSubscriptionTx 订阅未过期且仍有剩余流量时恢复为 active 并重新分配节点权限。
+// 否则按原因标记为 expired 或 exhausted。返回订阅是否可用。
+func (s *SubscriptionService) restoreSubscriptionTx(tx *gorm.DB, sub *model.Subscription, now time.Time) (bool, error) {
+	status := "active"
+	switch {
+	case !sub.ExpiredAt.After(now):
+		status = "expired"
+	case sub.TrafficUsed >= sub.TotalTrafficLimit():
+		status = "exhausted"
+	}
+
+	if err := tx.Model(&model.Subscription{}).Where("id = ?", sub.ID).
+		Update("status", status).Error; err != nil {
+		return false, err
+	}
+	sub.Status = status
+
+	if status != "active" {
+		return false, nil
+	}
+	return true, s.grantNodeAccess(tx, sub.UserID, sub.ID, sub.PlanID, sub.ExpiredAt)
+}
+
+// overQuotaQuery 已过期或流量用完但仍为 active 的订阅
+func overQuotaQuery(tx *gorm.DB, now time.Time) *gorm.DB {
+	return tx.Model(&model.Subscription{}).Where("status = ?", "active").
+		Where("expired_at <= ? OR traffic_used >= traffic_limit + extra_traffic", now)
+}
+
+// EnforceQuotasOnce 将已过期或流量用完的活跃订阅标记为 expired/exhausted 并收回节点权限，
+// 返回处理的订阅数。到期的流量包先行扣除。
+func (s *SubscriptionService) EnforceQuotasOnce(now time.Time) (int, error) {
+	if _, err := s.ExpireTrafficPacksOnce(now); err != nil {
+		return 0, err
+	}
+
+	var subscriptionIDs []int64
+	if err := overQuotaQuery(db.DB, now).Pluck("id", &subscriptionIDs).Error; err != nil {
+		return 0, err
+	}
+
+	events := make([]NodeUserEvent, 0, len(subscriptionIDs))
+	for _, id := range subscriptionIDs {
+		event, err := s.suspendIfOverQuota(id, now)
+		if err != nil {
+			log.Printf("订阅 %d 状态更新失败: %v", id, err)
+			continue
+		}
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	publishNodeUserEvents(events...)
+	return len(events), nil
+}
+
+// suspendIfOverQuota 加锁后重新检查订阅，仍已过期或流量用完时暂停，返回状态变化事件。
+// 用户可能在查出候选订阅后续费或购买了流量包，此时不做处理并返回 nil。
+func (s *SubscriptionService) suspendIfOverQuota(subscriptionID int64, now time.Time) (*NodeUserEvent, error) {
+	var event *NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var sub model.Subscription
+		if err := overQuotaQuery(tx.Clauses(clause.Locking{Strength: "UPDATE"}), now).
+			Where("id = ?", subscriptionID).Limit(1).Find(&sub).Error; err != nil || sub.ID == 0 {
+			return err
+		}
+
+		status := "exhausted"
+		if !sub.ExpiredAt.After(now) {
+			status = "expired"
+		}
+		var err error
+		event, err = s.suspendSubscriptionTx(tx, &sub, status, now)
+		return err
+	})
+	return event, err
+}
+
+// RunQuotaEnforcer 定期检查订阅的到期时间与流量配额，直到 ctx 结束
+func (s *SubscriptionService) RunQuotaEnforcer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.EnforceQuotasOnce(time.Now())
+			if err != nil {
+				log.Printf("订阅配额检查失败: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("%d 个订阅已到期或流量用完，已收回节点权限", n)
+			}
+		}
+	}
+}
@@ -1,11 +1,23 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+
 	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
 	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/mariclezhang/vps_backend/pkg/payment"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -13,24 +25,50 @@ import (
 
 func setupTestDB(t *testing.T) {
 	var err error
-	db.DB, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	db.DB, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{TranslateError: true})
 	if err != nil {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
+	// 内存数据库每个连接相互独立，并发访问时需共用同一连接
+	sqlDB, _ := db.DB.DB()
+	sqlDB.SetMaxOpenConns(1)
+
 	// 自动迁移
 	db.DB.AutoMigrate(
 		&model.User{},
 		&model.SubscriptionPlan{},
 		&model.Subscription{},
+		&model.TrafficUsagePeriod{},
+		&model.TrafficPack{},
+		&model.TrafficPackPurchase{},
 		&model.Node{},
+		&model.NodeGroup{},
 		&model.UserNodeAccess{},
+		&model.NodeCredential{},
+		&model.NodeLatencyLog{},
 		&model.TrafficLog{},
+		&model.TrafficReport{},
+		&model.TrafficFlush{},
+		&model.TrafficHourly{},
+		&model.TrafficDaily{},
+		&model.TrafficRollupState{},
 		&model.Order{},
 		&model.PasswordReset{},
 	)
 }
 
+// setupTestRedis 启动内存 Redis，测试结束后恢复为未启用 Redis
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = nil
+	})
+	return mr
+}
+
 // createTestVerificationCode 创建测试验证码
 func createTestVerificationCode(email, code string) {
 	resetRecord := model.PasswordReset{
@@ -197,3 +235,1806 @@ func TestUserService_Balance(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "余额不足")
 }
+
+func TestSubscriptionService_GetSubscriptionByToken(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	nodeService := NewNodeService()
+
+	user := model.User{Email: "sub@example.com", Username: "sub", Status: "active"}
+	db.DB.Create(&user)
+
+	node := model.Node{Name: "香港-01", Location: "HK", Protocol: "vmess", IsActive: true}
+	db.DB.Create(&node)
+
+	expiredAt := time.Now().Add(24 * time.Hour)
+	token := "0123456789abcdef0123456789abcdef"
+	subscription := model.Subscription{
+		UserID:       user.ID,
+		Status:       "active",
+		TrafficLimit: 1024,
+		Token:        token,
+		ExpiredAt:    expiredAt,
+	}
+	db.DB.Create(&subscription)
+	db.DB.Create(&model.UserNodeAccess{UserID: user.ID, NodeID: node.ID, SubscriptionID: subscription.ID, ExpiredAt: &expiredAt})
+
+	// 测试通过token获取订阅及节点
+	result, err := subscriptionService.GetSubscriptionByToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, subscription.ID, result.ID)
+
+	nodes, err := nodeService.GetUserAccessibleNodes(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+
+	// 测试无效token
+	_, err = subscriptionService.GetSubscriptionByToken("%")
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+
+	// 测试流量用完
+	db.DB.Model(&subscription).Update("traffic_used", 1024)
+	_, err = subscriptionService.GetSubscriptionByToken(token)
+	assert.ErrorIs(t, err, ErrTrafficExhausted)
+
+	// 测试订阅已取消
+	db.DB.Model(&subscription).Updates(map[string]interface{}{"traffic_used": 0, "status": "cancelled"})
+	_, err = subscriptionService.GetSubscriptionByToken(token)
+	assert.ErrorIs(t, err, ErrSubscriptionInactive)
+}
+
+func TestSubscriptionService_ResetSubscribeToken(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	InitSubscribeBaseURL("https://sub.example.com/")
+
+	user := model.User{Email: "reset@example.com", Username: "reset", Status: "active"}
+	db.DB.Create(&user)
+
+	oldToken := "0123456789abcdef0123456789abcdef"
+	subscription := model.Subscription{
+		UserID:       user.ID,
+		Status:       "active",
+		TrafficLimit: 1024,
+		Token:        oldToken,
+		ExpiredAt:    time.Now().Add(24 * time.Hour),
+	}
+	db.DB.Create(&subscription)
+
+	// 测试无权重置他人订阅
+	_, err := subscriptionService.ResetSubscribeToken(user.ID+1, subscription.ID)
+	assert.Error(t, err)
+
+	// 测试重置后旧链接失效、新链接可用
+	result, err := subscriptionService.ResetSubscribeToken(user.ID, subscription.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldToken, result.Token)
+	assert.Equal(t, "https://sub.example.com/sub/"+result.Token, result.SubscribeURL)
+
+	_, err = subscriptionService.GetSubscriptionByToken(oldToken)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+
+	_, err = subscriptionService.GetSubscriptionByToken(result.Token)
+	assert.NoError(t, err)
+}
+
+func TestNodeAgentService_GetNodeUsers(t *testing.T) {
+	setupTestDB(t)
+	nodeAgentService := NewNodeAgentService()
+
+	node := model.Node{Name: "日本-东京-01", Location: "JP", Protocol: "vmess", IsActive: true}
+	db.DB.Create(&node)
+
+	expiredAt := time.Now().Add(24 * time.Hour)
+	createUser := func(email string, trafficUsed int64) model.User {
+		user := model.User{Email: email, Username: email, Status: "active"}
+		db.DB.Create(&user)
+		subscription := model.Subscription{
+			UserID:       user.ID,
+			Status:       "active",
+			TrafficLimit: 1024,
+			TrafficUsed:  trafficUsed,
+			Token:        email,
+			ExpiredAt:    expiredAt,
+		}
+		db.DB.Create(&subscription)
+		db.DB.Create(&model.UserNodeAccess{UserID: user.ID, NodeID: node.ID, SubscriptionID: subscription.ID, ExpiredAt: &expiredAt})
+		return user
+	}
+
+	active := createUser("active@example.com", 0)
+	createUser("exhausted@example.com", 1024)
+
+	list, err := nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, list.ETag)
+	assert.Len(t, list.Users, 1)
+	assert.Equal(t, active.ID, list.Users[0].ID)
+	assert.Equal(t, active.UUID, list.Users[0].UUID)
+	assert.Len(t, active.UUID, 36)
+
+	// 相同数据 ETag 不变
+	again, err := nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, list.ETag, again.ETag)
+
+	// 节点不存在
+	_, err = nodeAgentService.GetNodeUsers(999)
+	assert.Error(t, err)
+}
+
+func TestSubscriptionService_RecordTrafficBatch(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	node := model.Node{Name: "新加坡-01", Location: "SG", Protocol: "vmess", IsActive: true}
+	db.DB.Create(&node)
+
+	user := model.User{Email: "traffic@example.com", Username: "traffic", Status: "active"}
+	db.DB.Create(&user)
+	subscription := model.Subscription{
+		UserID:       user.ID,
+		Status:       "active",
+		TrafficLimit: 1000,
+		Token:        "traffic",
+		ExpiredAt:    time.Now().Add(24 * time.Hour),
+	}
+	db.DB.Create(&subscription)
+
+	items := []TrafficDelta{
+		{UserID: user.ID, Upload: 100, Download: 200},
+		{UserID: 999, Upload: 100, Download: 100},
+	}
+
+	// 测试批量上报，无订阅的用户被跳过
+	result, err := subscriptionService.RecordTrafficBatch(node.ID, "report-1", items)
+	assert.NoError(t, err)
+	assert.False(t, result.Duplicate)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Len(t, result.Rejected, 1)
+
+	// 测试重试的上报不会重复计费
+	result, err = subscriptionService.RecordTrafficBatch(node.ID, "report-1", items)
+	assert.NoError(t, err)
+	assert.True(t, result.Duplicate)
+
+	db.DB.First(&subscription, subscription.ID)
+	assert.Equal(t, int64(300), subscription.TrafficUsed)
+
+	var logCount int64
+	db.DB.Model(&model.TrafficLog{}).Where("user_id = ?", user.ID).Count(&logCount)
+	assert.Equal(t, int64(1), logCount)
+
+	// 测试超出流量限额: 计满配额为止，订阅随即暂停
+	result, err = subscriptionService.RecordTrafficBatch(node.ID, "report-2", []TrafficDelta{{UserID: user.ID, Download: 800}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Empty(t, result.Rejected)
+
+	db.DB.First(&subscription, subscription.ID)
+	assert.Equal(t, int64(1000), subscription.TrafficUsed)
+	assert.Equal(t, "exhausted", subscription.Status)
+
+	var capped model.TrafficLog
+	db.DB.Where("user_id = ?", user.ID).Order("id DESC").First(&capped)
+	assert.Equal(t, int64(800), capped.TotalBytes)
+	assert.Equal(t, int64(700), capped.ChargedBytes)
+
+	result, err = subscriptionService.RecordTrafficBatch(node.ID, "report-3", []TrafficDelta{{UserID: user.ID, Download: 100}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Accepted)
+	assert.Len(t, result.Rejected, 1)
+
+	// 测试并发重试同一上报只计费一次
+	db.DB.Model(&subscription).Updates(map[string]interface{}{"status": "active", "traffic_used": 0})
+	var wg sync.WaitGroup
+	results := make([]*TrafficBatchResult, 4)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = subscriptionService.RecordTrafficBatch(node.ID, "report-4",
+				[]TrafficDelta{{UserID: user.ID, Download: 100}})
+		}(i)
+	}
+	wg.Wait()
+	duplicates := 0
+	for i := range results {
+		assert.NoError(t, errs[i])
+		if results[i] != nil && results[i].Duplicate {
+			duplicates++
+		}
+	}
+	assert.Equal(t, len(results)-1, duplicates)
+	db.DB.First(&subscription, subscription.ID)
+	assert.Equal(t, int64(100), subscription.TrafficUsed)
+
+	// 测试检查后、写入前被并发重试抢先入库时触发唯一索引，同样返回 Duplicate
+	callback := db.DB.Callback().Create()
+	assert.NoError(t, callback.Before("gorm:create").Register("test:concurrent_report", func(tx *gorm.DB) {
+		if tx.Statement.Table == "traffic_reports" {
+			tx.Exec("INSERT INTO traffic_reports (node_id, idempotency_key, item_count) VALUES (?, ?, ?)",
+				node.ID, "report-5", 1)
+		}
+	}))
+	result, err = subscriptionService.RecordTrafficBatch(node.ID, "report-5", []TrafficDelta{{UserID: user.ID, Download: 100}})
+	assert.NoError(t, callback.Remove("test:concurrent_report"))
+	assert.NoError(t, err)
+	assert.True(t, result.Duplicate)
+	db.DB.First(&subscription, subscription.ID)
+	assert.Equal(t, int64(100), subscription.TrafficUsed)
+}
+
+func TestNodeService_RotateNodeKey(t *testing.T) {
+	setupTestDB(t)
+	nodeService := NewNodeService()
+
+	nodeA := model.Node{Name: "节点A", IsActive: true}
+	nodeB := model.Node{Name: "节点B", IsActive: true}
+	db.DB.Create(&nodeA)
+	db.DB.Create(&nodeB)
+
+	credA, err := nodeService.RotateNodeKey(nodeA.ID)
+	assert.NoError(t, err)
+	credB, err := nodeService.RotateNodeKey(nodeB.ID)
+	assert.NoError(t, err)
+
+	nodeID, secret, err := nodeService.GetNodeCredential(credA.KeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, nodeA.ID, nodeID)
+	assert.Equal(t, credA.Secret, secret)
+
+	// 轮换后旧密钥失效，其他节点不受影响
+	rotated, err := nodeService.RotateNodeKey(nodeA.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, credA.KeyID, rotated.KeyID)
+
+	_, _, err = nodeService.GetNodeCredential(credA.KeyID)
+	assert.Error(t, err)
+
+	_, secret, err = nodeService.GetNodeCredential(credB.KeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, credB.Secret, secret)
+
+	var count int64
+	db.DB.Model(&model.NodeCredential{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+
+	// 节点不存在
+	_, err = nodeService.RotateNodeKey(999)
+	assert.Error(t, err)
+}
+
+func TestNodeAgentService_Heartbeat(t *testing.T) {
+	setupTestDB(t)
+	agentService := NewNodeAgentService()
+
+	node := model.Node{Name: "节点A", IsActive: true, Status: model.NodeStatusOffline}
+	maintenance := model.Node{Name: "节点B", IsActive: true, Status: model.NodeStatusMaintenance}
+	noAgent := model.Node{Name: "节点C", IsActive: true, Status: model.NodeStatusOnline}
+	db.DB.Create(&node)
+	db.DB.Create(&maintenance)
+	db.DB.Create(&noAgent)
+
+	// 心跳恢复后重新上线，并记录运行状态
+	err := agentService.RecordHeartbeat(node.ID, NodeHeartbeat{
+		CPU: 12.5, Memory: 40, Uptime: 3600, CurrentConnections: 35, LoadPercentage: 20,
+	})
+	assert.NoError(t, err)
+
+	var updated model.Node
+	db.DB.First(&updated, node.ID)
+	assert.Equal(t, model.NodeStatusOnline, updated.Status)
+	assert.Equal(t, 12.5, updated.CPUUsage)
+	assert.Equal(t, 35, updated.CurrentConnections)
+	assert.Equal(t, 20, updated.LoadPercentage)
+	assert.NotNil(t, updated.LastHeartbeatAt)
+
+	// 维护中的节点保持原状态
+	assert.NoError(t, agentService.RecordHeartbeat(maintenance.ID, NodeHeartbeat{}))
+	var unchanged model.Node
+	db.DB.First(&unchanged, maintenance.ID)
+	assert.Equal(t, model.NodeStatusMaintenance, unchanged.Status)
+
+	// 心跳未超时不下线
+	n, err := agentService.MarkStaleNodes(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// 心跳超时后标记离线
+	db.DB.Model(&model.Node{}).Where("id = ?", node.ID).
+		Update("last_heartbeat_at", time.Now().Add(-2*time.Minute))
+	n, err = agentService.MarkStaleNodes(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	var offline model.Node
+	db.DB.First(&offline, node.ID)
+	assert.Equal(t, model.NodeStatusOffline, offline.Status)
+
+	// 从未上报心跳的节点不受影响
+	var online model.Node
+	db.DB.First(&online, noAgent.ID)
+	assert.Equal(t, model.NodeStatusOnline, online.Status)
+
+	// 节点不存在
+	assert.Error(t, agentService.RecordHeartbeat(999, NodeHeartbeat{}))
+}
+
+func TestNodeService_TestLatency(t *testing.T) {
+	setupTestDB(t)
+	nodeService := NewNodeService()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	node := model.Node{Name: "本地节点", ServerAddress: "127.0.0.1", ServerPort: port, IsActive: true}
+	db.DB.Create(&node)
+
+	expiredAt := time.Now().Add(time.Hour)
+	db.DB.Create(&model.UserNodeAccess{UserID: 1, NodeID: node.ID, ExpiredAt: &expiredAt})
+
+	// 无访问权限的用户不能测试
+	_, err = nodeService.TestLatency(context.Background(), 2, node.ID)
+	assert.ErrorIs(t, err, ErrNodeAccessDenied)
+
+	result, err := nodeService.TestLatency(context.Background(), 1, node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Samples, result.Received)
+	assert.Equal(t, float64(0), result.Loss)
+
+	// 每次探测追加一条记录
+	_, err = nodeService.TestLatency(context.Background(), 1, node.ID)
+	assert.NoError(t, err)
+
+	var count int64
+	db.DB.Model(&model.NodeLatencyLog{}).Where("node_id = ?", node.ID).Count(&count)
+	assert.Equal(t, int64(2), count)
+
+	var updated model.Node
+	db.DB.First(&updated, node.ID)
+	assert.Positive(t, updated.Latency)
+
+	// 节点不存在
+	_, err = nodeService.TestLatency(context.Background(), 1, 999)
+	assert.Error(t, err)
+}
+
+func TestNodeService_CheckAllNodes(t *testing.T) {
+	setupTestDB(t)
+	nodeService := NewNodeService()
+	InitLatencyProbe(2, time.Second)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	now := time.Now()
+	alive := model.Node{Name: "正常节点", ServerAddress: "127.0.0.1", ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		IsActive: true, Status: model.NodeStatusOnline, LastHeartbeatAt: &now}
+	dead := model.Node{Name: "故障节点", ServerAddress: "127.0.0.1", ServerPort: deadPort,
+		IsActive: true, Status: model.NodeStatusOnline, LastHeartbeatAt: &now}
+	db.DB.Create(&alive)
+	db.DB.Create(&dead)
+
+	// 未达到失败阈值前保持在线
+	failed, err := nodeService.CheckAllNodes(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed)
+
+	var node model.Node
+	db.DB.First(&node, dead.ID)
+	assert.Equal(t, 1, node.ConsecutiveFailures)
+	assert.Equal(t, model.NodeStatusOnline, node.Status)
+
+	for i := 0; i < 2; i++ {
+		_, err = nodeService.CheckAllNodes(context.Background(), 2)
+		assert.NoError(t, err)
+	}
+
+	var offline model.Node
+	db.DB.First(&offline, dead.ID)
+	assert.Equal(t, 3, offline.ConsecutiveFailures)
+	assert.Equal(t, model.NodeStatusOffline, offline.Status)
+
+	var healthy model.Node
+	db.DB.First(&healthy, alive.ID)
+	assert.Equal(t, 0, healthy.ConsecutiveFailures)
+	assert.Equal(t, model.NodeStatusOnline, healthy.Status)
+
+	// 离线期间心跳不会使节点重新上线
+	assert.NoError(t, NewNodeAgentService().RecordHeartbeat(dead.ID, NodeHeartbeat{}))
+	var stillOffline model.Node
+	db.DB.First(&stillOffline, dead.ID)
+	assert.Equal(t, model.NodeStatusOffline, stillOffline.Status)
+
+	// 探测恢复后重新上线
+	db.DB.Model(&model.Node{}).Where("id = ?", dead.ID).Update("server_port", alive.ServerPort)
+	_, err = nodeService.CheckAllNodes(context.Background(), 2)
+	assert.NoError(t, err)
+
+	var recovered model.Node
+	db.DB.First(&recovered, dead.ID)
+	assert.Equal(t, 0, recovered.ConsecutiveFailures)
+	assert.Equal(t, model.NodeStatusOnline, recovered.Status)
+
+	// 探测记录按节点追加
+	var count int64
+	db.DB.Model(&model.NodeLatencyLog{}).Where("node_id = ?", dead.ID).Count(&count)
+	assert.Equal(t, int64(4), count)
+
+	// 未部署节点程序 (从未上报心跳) 的节点只按探测结果判定在线
+	agentless := model.Node{Name: "无心跳节点", ServerAddress: "127.0.0.1", ServerPort: deadPort,
+		IsActive: true, Status: model.NodeStatusOnline}
+	db.DB.Create(&agentless)
+	for i := 0; i < 3; i++ {
+		_, err = nodeService.CheckAllNodes(context.Background(), 2)
+		assert.NoError(t, err)
+	}
+	var agentlessOffline model.Node
+	db.DB.First(&agentlessOffline, agentless.ID)
+	assert.Nil(t, agentlessOffline.LastHeartbeatAt)
+	assert.Equal(t, model.NodeStatusOffline, agentlessOffline.Status)
+
+	db.DB.Model(&model.Node{}).Where("id = ?", agentless.ID).Update("server_port", alive.ServerPort)
+	_, err = nodeService.CheckAllNodes(context.Background(), 2)
+	assert.NoError(t, err)
+	var agentlessRecovered model.Node
+	db.DB.First(&agentlessRecovered, agentless.ID)
+	assert.Equal(t, 0, agentlessRecovered.ConsecutiveFailures)
+	assert.Equal(t, model.NodeStatusOnline, agentlessRecovered.Status)
+}
+
+func TestNodeGroups_GrantByPlan(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	nodeService := NewNodeService()
+
+	standard := model.Node{Name: "标准节点", IsActive: true}
+	premium := model.Node{Name: "高级节点", IsActive: true}
+	db.DB.Create(&standard)
+	db.DB.Create(&premium)
+
+	standardGroup := model.NodeGroup{Name: "标准", Nodes: []model.Node{standard}}
+	premiumGroup := model.NodeGroup{Name: "高级", Nodes: []model.Node{premium}}
+	db.DB.Create(&standardGroup)
+	db.DB.Create(&premiumGroup)
+
+	basicPlan := model.SubscriptionPlan{Name: "基础套餐", Price: 10, TrafficLimit: 1 << 30, DurationDays: 30,
+		IsActive: true, NodeGroups: []model.NodeGroup{standardGroup}}
+	allPlan := model.SubscriptionPlan{Name: "旗舰套餐", Price: 10, TrafficLimit: 1 << 30, DurationDays: 30,
+		IsActive: true}
+	db.DB.Create(&basicPlan)
+	db.DB.Create(&allPlan)
+
+	basicUser := model.User{Email: "basic@example.com", Username: "basic", PasswordHash: "x", Balance: 100}
+	allUser := model.User{Email: "all@example.com", Username: "all", PasswordHash: "x", Balance: 100}
+	db.DB.Create(&basicUser)
+	db.DB.Create(&allUser)
+
+	_, err := subscriptionService.PurchaseSubscription(basicUser.ID, basicPlan.ID, "balance")
+	assert.NoError(t, err)
+	_, err = subscriptionService.PurchaseSubscription(allUser.ID, allPlan.ID, "balance")
+	assert.NoError(t, err)
+
+	// 基础套餐只能访问其分组内的节点，未配置分组的套餐可访问所有节点
+	nodes, err := nodeService.GetUserAccessibleNodes(basicUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, standard.ID, nodes[0].ID)
+
+	nodes, err = nodeService.GetUserAccessibleNodes(allUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+
+	// 新增节点时同步给可访问的订阅
+	newNode := model.Node{Name: "新标准节点", IsActive: true}
+	assert.NoError(t, nodeService.CreateNode(&newNode, []int64{standardGroup.ID}))
+
+	nodes, err = nodeService.GetUserAccessibleNodes(basicUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+
+	nodes, err = nodeService.GetUserAccessibleNodes(allUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 3)
+
+	// 节点移出分组后撤销不再可访问的用户的权限
+	assert.NoError(t, nodeService.SetNodeGroups(newNode.ID, []int64{premiumGroup.ID}))
+
+	nodes, err = nodeService.GetUserAccessibleNodes(basicUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+
+	nodes, err = nodeService.GetUserAccessibleNodes(allUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 3)
+
+	// 分组不存在
+	assert.Error(t, nodeService.SetNodeGroups(newNode.ID, []int64{999}))
+
+	// 调整套餐分组后重新分配已有订阅的权限
+	assert.NoError(t, subscriptionService.SetPlanNodeGroups(basicPlan.ID, []int64{premiumGroup.ID}))
+	nodes, err = nodeService.GetUserAccessibleNodes(basicUser.ID)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	hasAccess, _ := nodeService.CheckUserNodeAccess(basicUser.ID, standard.ID)
+	assert.False(t, hasAccess)
+	hasAccess, _ = nodeService.CheckUserNodeAccess(basicUser.ID, premium.ID)
+	assert.True(t, hasAccess)
+	assert.Error(t, subscriptionService.SetPlanNodeGroups(basicPlan.ID, []int64{999}))
+}
+
+func TestNodeAccess_KeepsLaterExpiry(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+	yearly := model.SubscriptionPlan{Name: "年付", Price: 100, TrafficLimit: 1 << 30, DurationDays: 365, IsActive: true}
+	monthly := model.SubscriptionPlan{Name: "月付", Price: 10, TrafficLimit: 1 << 30, DurationDays: 30, IsActive: true}
+	db.DB.Create(&yearly)
+	db.DB.Create(&monthly)
+	user := model.User{Email: "expiry@example.com", Username: "expiry", PasswordHash: "x", Balance: 200}
+	db.DB.Create(&user)
+
+	long, err := subscriptionService.PurchaseSubscription(user.ID, yearly.ID, "balance")
+	assert.NoError(t, err)
+	short, err := subscriptionService.PurchaseSubscription(user.ID, monthly.ID, "balance")
+	assert.NoError(t, err)
+
+	// 购买短期套餐不会缩短年付订阅的访问时间
+	var access model.UserNodeAccess
+	db.DB.Where("user_id = ? AND node_id = ?", user.ID, node.ID).First(&access)
+	assert.Equal(t, long.ID, access.SubscriptionID)
+	assert.WithinDuration(t, long.ExpiredAt, *access.ExpiredAt, time.Second)
+
+	// 年付订阅取消后由月付订阅接管
+	assert.NoError(t, subscriptionService.CancelSubscription(user.ID, long.ID))
+	db.DB.Where("user_id = ? AND node_id = ?", user.ID, node.ID).First(&access)
+	assert.Equal(t, short.ID, access.SubscriptionID)
+	assert.WithinDuration(t, short.ExpiredAt, *access.ExpiredAt, time.Second)
+}
+
+func TestNodeService_UserVisibility(t *testing.T) {
+	setupTestDB(t)
+	nodeService := NewNodeService()
+
+	usNode := model.Node{Name: "美国", Location: "US", ServerAddress: "us.example.com", ServerPort: 443,
+		Config: model.NodeConfig{"uuid": "secret"}, IsActive: true}
+	jpNode := model.Node{Name: "日本", Location: "JP", ServerAddress: "jp.example.com", ServerPort: 443,
+		Config: model.NodeConfig{"uuid": "secret"}, IsActive: true}
+	db.DB.Create(&usNode)
+	db.DB.Create(&jpNode)
+
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	db.DB.Create(&model.UserNodeAccess{UserID: 1, NodeID: usNode.ID, ExpiredAt: &future})
+	db.DB.Create(&model.UserNodeAccess{UserID: 1, NodeID: jpNode.ID, ExpiredAt: &past})
+
+	// 列表只包含未过期的访问权限对应的节点
+	nodes, err := nodeService.GetNodes(1, "", "")
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, usNode.ID, nodes[0].ID)
+
+	nodes, err = nodeService.GetNodes(1, "JP", "")
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+
+	nodes, err = nodeService.GetNodes(2, "", "")
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+
+	// 有权限时返回完整信息
+	node, err := nodeService.GetNodeDetailForUser(1, usNode.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "us.example.com", node.ServerAddress)
+	assert.Equal(t, "secret", node.Config["uuid"])
+
+	// 权限过期或无权限时隐藏连接信息
+	node, err = nodeService.GetNodeDetailForUser(1, jpNode.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, node.ServerAddress)
+	assert.Zero(t, node.ServerPort)
+	assert.Nil(t, node.Config)
+
+	node, err = nodeService.GetNodeDetailForUser(2, usNode.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, node.ServerAddress)
+	assert.Nil(t, node.Config)
+}
+
+func TestParseTrafficFields(t *testing.T) {
+	counters := parseTrafficFields(map[string]string{
+		trafficField("u", 1, 10): "100",
+		trafficField("d", 1, 10): "200",
+		trafficField("d", 2, 10): "50",
+		"invalid":                "1",
+		"u:x:10":                 "1",
+	})
+
+	assert.Len(t, counters, 2)
+	assert.Equal(t, &trafficCounter{Upload: 100, Download: 200}, counters[trafficKey{UserID: 1, NodeID: 10}])
+	assert.Equal(t, &trafficCounter{Download: 50}, counters[trafficKey{UserID: 2, NodeID: 10}])
+}
+
+func TestSubscriptionService_FlushTrafficWithoutRedis(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	// 未启用 Redis 时流量直接入库，无需同步
+	n, err := subscriptionService.FlushTraffic()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// createTrafficTestSubscription 创建流量测试用的节点与有效订阅
+func createTrafficTestSubscription(t *testing.T, email string, limit int64) (model.Node, model.Subscription) {
+	node := model.Node{Name: "香港-01", Location: "HK", Protocol: "vmess", IsActive: true, TrafficRate: 1}
+	db.DB.Create(&node)
+
+	user := model.User{Email: email, Username: email, Status: "active"}
+	db.DB.Create(&user)
+	subscription := model.Subscription{
+		UserID:       user.ID,
+		Status:       "active",
+		TrafficLimit: limit,
+		Token:        email,
+		ExpiredAt:    time.Now().Add(24 * time.Hour),
+	}
+	db.DB.Create(&subscription)
+	return node, subscription
+}
+
+func TestSubscriptionService_FlushTrafficRedis(t *testing.T) {
+	setupTestDB(t)
+	mr := setupTestRedis(t)
+	subscriptionService := NewSubscriptionService()
+	node, sub := createTrafficTestSubscription(t, "flush@example.com", 1<<30)
+	ctx := context.Background()
+
+	trafficUsed := func() int64 {
+		var s model.Subscription
+		db.DB.First(&s, sub.ID)
+		return s.TrafficUsed
+	}
+	push := func(key string, bytes int64) {
+		_, err := subscriptionService.RecordTrafficBatch(node.ID, key, []TrafficDelta{{UserID: sub.UserID, Download: bytes}})
+		assert.NoError(t, err)
+	}
+
+	// 没有活跃订阅的用户在上报时拒绝
+	result, err := subscriptionService.RecordTrafficBatch(node.ID, "r0", []TrafficDelta{{UserID: sub.UserID + 100, Download: 10}})
+	assert.NoError(t, err)
+	assert.Zero(t, result.Accepted)
+	assert.Len(t, result.Rejected, 1)
+	assert.ErrorIs(t, subscriptionService.RecordTraffic(sub.UserID+100, node.ID, 0, 10), ErrNoActiveSubscription)
+	assert.False(t, mr.Exists(trafficPendingKey))
+
+	// 上报先累加到 Redis，同步后入库
+	push("r1", 100)
+	assert.Zero(t, trafficUsed())
+	n, err := subscriptionService.FlushTraffic()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(100), trafficUsed())
+
+	// 入库后、清理 Redis 前崩溃: 重启后的同步跳过已入库批次并清理
+	push("r2", 50)
+	batchID, counters, err := claimTrafficBatch(ctx)
+	assert.NoError(t, err)
+	_, err = subscriptionService.commitTrafficBatch(batchID, counters)
+	assert.NoError(t, err)
+	assert.True(t, mr.Exists(trafficFlushingKey))
+
+	n, err = subscriptionService.FlushTraffic()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.False(t, mr.Exists(trafficFlushingKey))
+	assert.False(t, mr.Exists(trafficBatchIDKey))
+	assert.Equal(t, int64(150), trafficUsed())
+
+	// 重放同一批次不会重复计费
+	_, err = subscriptionService.commitTrafficBatch(batchID, counters)
+	assert.ErrorIs(t, err, errBatchCommitted)
+	assert.Equal(t, int64(150), trafficUsed())
+
+	// 延迟的同步不会删除其他同步刚取出的新批次
+	push("r3", 30)
+	staleID, staleCounters, err := claimTrafficBatch(ctx)
+	assert.NoError(t, err)
+	_, err = subscriptionService.commitTrafficBatch(staleID, staleCounters)
+	assert.NoError(t, err)
+	_, err = subscriptionService.FlushTraffic() // 其他同步清理了已入库批次
+	assert.NoError(t, err)
+	push("r4", 20)
+	newID, _, err := claimTrafficBatch(ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, staleID, newID)
+
+	assert.NoError(t, releaseTrafficBatch(ctx, staleID))
+	assert.True(t, mr.Exists(trafficFlushingKey))
+	n, err = subscriptionService.FlushTraffic()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(200), trafficUsed())
+}
+
+func TestSubscriptionService_FlushTrafficConcurrent(t *testing.T) {
+	setupTestDB(t)
+	setupTestRedis(t)
+	subscriptionService := NewSubscriptionService()
+	node, sub := createTrafficTestSubscription(t, "concurrent@example.com", 1<<30)
+
+	const reports = 50
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := subscriptionService.FlushTraffic(); err != nil {
+					t.Errorf("flush: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < reports; i++ {
+		_, err := subscriptionService.RecordTrafficBatch(node.ID, fmt.Sprintf("report-%d", i),
+			[]TrafficDelta{{UserID: sub.UserID, Upload: 4, Download: 6}})
+		assert.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+
+	// 处理剩余的批次
+	for {
+		n, err := subscriptionService.FlushTraffic()
+		assert.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+
+	db.DB.First(&sub, sub.ID)
+	assert.Equal(t, int64(reports*10), sub.TrafficUsed)
+}
+
+func TestLastResetBoundary(t *testing.T) {
+	loc := time.UTC
+
+	// 当月重置日已过
+	now := time.Date(2025, 3, 15, 10, 0, 0, 0, loc)
+	assert.Equal(t, time.Date(2025, 3, 1, 0, 0, 0, 0, loc), lastResetBoundary(now, 1))
+
+	// 当月重置日未到，取上月
+	assert.Equal(t, time.Date(2025, 2, 20, 0, 0, 0, 0, loc), lastResetBoundary(now, 20))
+
+	// 跨年
+	now = time.Date(2025, 1, 5, 0, 0, 0, 0, loc)
+	assert.Equal(t, time.Date(2024, 12, 10, 0, 0, 0, 0, loc), lastResetBoundary(now, 10))
+
+	// 超过当月天数时取月末
+	now = time.Date(2025, 3, 15, 0, 0, 0, 0, loc)
+	assert.Equal(t, time.Date(2025, 2, 28, 0, 0, 0, 0, loc), lastResetBoundary(now, 31))
+}
+
+func TestSubscriptionService_ResetTrafficOnce(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	InitTrafficReset(1)
+
+	monthly := model.SubscriptionPlan{Name: "月付", Price: 10, TrafficLimit: 100, DurationDays: 365,
+		TrafficResetMode: model.TrafficResetMonthly}
+	anniversary := model.SubscriptionPlan{Name: "按开始日", Price: 10, TrafficLimit: 100, DurationDays: 365,
+		TrafficResetMode: model.TrafficResetAnniversary}
+	none := model.SubscriptionPlan{Name: "不重置", Price: 10, TrafficLimit: 100, DurationDays: 365,
+		TrafficResetMode: model.TrafficResetNone}
+	short := model.SubscriptionPlan{Name: "30天", Price: 10, TrafficLimit: 100, DurationDays: 30,
+		TrafficResetMode: model.TrafficResetMonthly}
+	db.DB.Create(&monthly)
+	db.DB.Create(&anniversary)
+	db.DB.Create(&none)
+	db.DB.Create(&short)
+
+	started := time.Date(2025, 1, 15, 12, 0, 0, 0, time.Local)
+	expired := started.AddDate(1, 0, 0)
+	subs := []model.Subscription{
+		{UserID: 1, PlanID: monthly.ID, Status: "active", TrafficLimit: 100, TrafficUsed: 80,
+			Token: "reset-monthly", StartedAt: started, ExpiredAt: expired},
+		{UserID: 2, PlanID: anniversary.ID, Status: "active", TrafficLimit: 100, TrafficUsed: 60,
+			Token: "reset-anniversary", StartedAt: started, ExpiredAt: expired},
+		{UserID: 3, PlanID: none.ID, Status: "active", TrafficLimit: 100, TrafficUsed: 50,
+			Token: "reset-none", StartedAt: started, ExpiredAt: expired},
+		{UserID: 4, PlanID: short.ID, Status: "active", TrafficLimit: 100, TrafficUsed: 70,
+			Token: "reset-short", StartedAt: started, ExpiredAt: started.AddDate(0, 0, 30)},
+	}
+	for i := range subs {
+		db.DB.Create(&subs[i])
+	}
+
+	// 2月10日: 只有按每月1号重置的订阅进入新周期，不超过一个月的订阅不重置
+	now := time.Date(2025, 2, 10, 0, 0, 0, 0, time.Local)
+	n, err := subscriptionService.ResetTrafficOnce(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var sub model.Subscription
+	db.DB.First(&sub, subs[0].ID)
+	assert.Equal(t, int64(0), sub.TrafficUsed)
+	assert.NotNil(t, sub.LastResetAt)
+
+	var period model.TrafficUsagePeriod
+	assert.NoError(t, db.DB.Where("subscription_id = ?", subs[0].ID).First(&period).Error)
+	assert.Equal(t, int64(80), period.TrafficUsed)
+	assert.True(t, period.PeriodEnd.Equal(time.Date(2025, 2, 1, 0, 0, 0, 0, time.Local)))
+
+	// 同一周期内重复执行不会再次重置
+	n, err = subscriptionService.ResetTrafficOnce(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// 2月15日: 按开始日重置的订阅进入新周期
+	now = time.Date(2025, 2, 15, 1, 0, 0, 0, time.Local)
+	n, err = subscriptionService.ResetTrafficOnce(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var anniversarySub model.Subscription
+	db.DB.First(&anniversarySub, subs[1].ID)
+	assert.Equal(t, int64(0), anniversarySub.TrafficUsed)
+
+	var noneSub model.Subscription
+	db.DB.First(&noneSub, subs[2].ID)
+	assert.Equal(t, int64(50), noneSub.TrafficUsed)
+
+	var shortSub model.Subscription
+	db.DB.First(&shortSub, subs[3].ID)
+	assert.Equal(t, int64(70), shortSub.TrafficUsed)
+
+	var count int64
+	db.DB.Model(&model.TrafficUsagePeriod{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestSubscriptionService_ResetTrafficAfterRenew(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	plan := model.SubscriptionPlan{Name: "30天", Price: 10, TrafficLimit: 100, DurationDays: 30, IsActive: true}
+	db.DB.Create(&plan)
+	user := model.User{Email: "renew-reset@example.com", Username: "renew-reset", PasswordHash: "x", Balance: 200}
+	db.DB.Create(&user)
+
+	sub, err := subscriptionService.PurchaseSubscription(user.ID, plan.ID, "balance")
+	assert.NoError(t, err)
+	db.DB.Model(&model.Subscription{}).Where("id = ?", sub.ID).Update("traffic_used", 90)
+
+	// 单个周期的订阅不重置
+	n, err := subscriptionService.ResetTrafficOnce(time.Now().AddDate(0, 0, 20))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// 续费后订阅跨越多个月，按订阅开始日每月重置
+	assert.NoError(t, subscriptionService.RenewSubscription(user.ID, sub.ID, 11))
+	n, err = subscriptionService.ResetTrafficOnce(time.Now().AddDate(0, 2, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var renewed model.Subscription
+	db.DB.First(&renewed, sub.ID)
+	assert.Equal(t, int64(0), renewed.TrafficUsed)
+	assert.NotNil(t, renewed.LastResetAt)
+}
+
+func TestSubscriptionService_GetSubscriptionUsage(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	node, sub := createTrafficTestSubscription(t, "usage@example.com", 1<<30)
+	db.DB.Model(&node).Update("traffic_rate", 2)
+
+	assert.NoError(t, subscriptionService.RecordTraffic(sub.UserID, node.ID, 100, 300))
+
+	// 原始流量日志清理后仍按累计上下行比例拆分已用流量
+	db.DB.Where("subscription_id = ?", sub.ID).Delete(&model.TrafficLog{})
+	db.DB.First(&sub, sub.ID)
+	upload, download, err := subscriptionService.GetSubscriptionUsage(&sub)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), upload)
+	assert.Equal(t, int64(600), download)
+
+	// 旧订阅从尚未清理的流量日志补全累计流量
+	db.DB.Model(&sub).Updates(map[string]interface{}{"upload_total": 0, "download_total": 0})
+	db.DB.Create(&model.TrafficLog{UserID: sub.UserID, SubscriptionID: sub.ID, NodeID: node.ID,
+		UploadBytes: 50, DownloadBytes: 150, TotalBytes: 200, Rate: 1, ChargedBytes: 200})
+	assert.NoError(t, subscriptionService.BackfillSubscriptionTrafficTotals())
+	db.DB.First(&sub, sub.ID)
+	assert.Equal(t, int64(50), sub.UploadTotal)
+	assert.Equal(t, int64(150), sub.DownloadTotal)
+}
+
+func TestSubscriptionService_TrafficRate(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	premium := model.Node{Name: "IPLC", IsActive: true, TrafficRate: 1.5}
+	budget := model.Node{Name: "经济", IsActive: true, TrafficRate: 0.5}
+	db.DB.Create(&premium)
+	db.DB.Create(&budget)
+
+	subscription := model.Subscription{
+		UserID:       1,
+		Status:       "active",
+		TrafficLimit: 10000,
+		Token:        "rate",
+		ExpiredAt:    time.Now().Add(24 * time.Hour),
+	}
+	db.DB.Create(&subscription)
+
+	assert.NoError(t, subscriptionService.RecordTraffic(1, premium.ID, 400, 600))
+	assert.NoError(t, subscriptionService.RecordTraffic(1, budget.ID, 400, 600))
+
+	// 订阅按倍率计费: 1000×1.5 + 1000×0.5
+	db.DB.First(&subscription, subscription.ID)
+	assert.Equal(t, int64(2000), subscription.TrafficUsed)
+
+	// 流量日志保留实际流量与倍率
+	var trafficLog model.TrafficLog
+	db.DB.Where("node_id = ?", premium.ID).First(&trafficLog)
+	assert.Equal(t, int64(1000), trafficLog.TotalBytes)
+	assert.Equal(t, 1.5, trafficLog.Rate)
+	assert.Equal(t, int64(1500), trafficLog.ChargedBytes)
+
+	// 倍率不为正数时按 1 倍计算
+	for _, rate := range []float64{0, -1} {
+		db.DB.Model(&budget).Update("traffic_rate", rate)
+		got, err := nodeTrafficRate(db.DB, budget.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, got)
+	}
+
+	// 配额按计费后的流量检查
+	err := subscriptionService.RecordTraffic(1, premium.ID, 0, 6000)
+	assert.ErrorIs(t, err, ErrTrafficExhausted)
+}
+
+func TestSubscriptionService_GetTrafficHistory(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+
+	nodeA := model.Node{Name: "节点A", IsActive: true}
+	nodeB := model.Node{Name: "节点B", IsActive: true}
+	db.DB.Create(&nodeA)
+	db.DB.Create(&nodeB)
+
+	day := time.Date(2025, 3, 10, 0, 0, 0, 0, time.Local)
+	logs := []model.TrafficLog{
+		{UserID: 1, NodeID: nodeA.ID, UploadBytes: 10, DownloadBytes: 100, ChargedBytes: 110, RecordedAt: day.Add(1 * time.Hour)},
+		{UserID: 1, NodeID: nodeB.ID, UploadBytes: 20, DownloadBytes: 200, ChargedBytes: 110, RecordedAt: day.Add(1*time.Hour + 30*time.Minute)},
+		{UserID: 1, NodeID: nodeA.ID, UploadBytes: 5, DownloadBytes: 50, ChargedBytes: 55, RecordedAt: day.Add(26 * time.Hour)},
+		{UserID: 2, NodeID: nodeA.ID, UploadBytes: 1000, DownloadBytes: 1000, ChargedBytes: 2000, RecordedAt: day.Add(time.Hour)},
+	}
+	for i := range logs {
+		db.DB.Create(&logs[i])
+	}
+
+	// 按天汇总，没有流量的日期补零
+	history, err := subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: day, To: day.AddDate(0, 0, 3), Granularity: GranularityDay,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history.Points, 3)
+	assert.Equal(t, int64(30), history.Points[0].Upload)
+	assert.Equal(t, int64(300), history.Points[0].Download)
+	assert.Equal(t, int64(220), history.Points[0].Charged)
+	assert.Equal(t, int64(50), history.Points[1].Download)
+	assert.Equal(t, int64(0), history.Points[2].Download)
+
+	// 按小时并按节点分组
+	history, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: day, To: day.AddDate(0, 0, 1), Granularity: GranularityHour, GroupBy: "node",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history.Points, 2)
+	assert.Equal(t, nodeA.ID, history.Points[0].NodeID)
+	assert.Equal(t, "节点A", history.Points[0].NodeName)
+	assert.Equal(t, int64(100), history.Points[0].Download)
+	assert.Equal(t, "节点B", history.Points[1].NodeName)
+	assert.True(t, history.Points[0].Time.Equal(day.Add(time.Hour)))
+
+	// 按月汇总
+	history, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: time.Date(2025, 3, 1, 0, 0, 0, 0, time.Local), To: time.Date(2025, 4, 1, 0, 0, 0, 0, time.Local),
+		Granularity: GranularityMonth,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history.Points, 1)
+	assert.Equal(t, int64(350), history.Points[0].Download)
+
+	// 参数校验
+	_, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{From: day, To: day.AddDate(0, 0, 1), Granularity: "week"})
+	assert.Error(t, err)
+	_, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{From: day, To: day.AddDate(0, 2, 0), Granularity: GranularityHour})
+	assert.Error(t, err)
+	_, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{From: day, To: day, Granularity: GranularityDay})
+	assert.Error(t, err)
+}
+
+func TestSubscriptionService_RollupTraffic(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	InitTrafficRetention(30, 90)
+
+	now := time.Date(2025, 6, 15, 12, 30, 0, 0, time.Local)
+	old := now.AddDate(0, 0, -40)
+	logs := []model.TrafficLog{
+		// 40 天前的流量，汇总后原始日志被清理
+		{UserID: 1, NodeID: 1, UploadBytes: 1, DownloadBytes: 10, ChargedBytes: 11, RecordedAt: old},
+		{UserID: 1, NodeID: 1, UploadBytes: 2, DownloadBytes: 20, ChargedBytes: 22, RecordedAt: old.Add(10 * time.Minute)},
+		{UserID: 1, NodeID: 2, UploadBytes: 3, DownloadBytes: 30, ChargedBytes: 33, RecordedAt: old.Add(2 * time.Hour)},
+		// 昨天的流量
+		{UserID: 1, NodeID: 1, UploadBytes: 4, DownloadBytes: 40, ChargedBytes: 44, RecordedAt: now.AddDate(0, 0, -1)},
+		// 当前小时的流量尚未汇总
+		{UserID: 1, NodeID: 1, UploadBytes: 5, DownloadBytes: 50, ChargedBytes: 55, RecordedAt: now.Add(-5 * time.Minute)},
+	}
+	for i := range logs {
+		db.DB.Create(&logs[i])
+	}
+
+	// 首次启用时分多次追赶历史数据
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, subscriptionService.RollupTrafficOnce(now))
+	}
+
+	var hourly []model.TrafficHourly
+	db.DB.Where("user_id = ? AND node_id = ?", 1, 1).Order("bucket_start ASC").Find(&hourly)
+	assert.Len(t, hourly, 2)
+	assert.Equal(t, int64(30), hourly[0].DownloadBytes)
+
+	var dailyCount int64
+	db.DB.Model(&model.TrafficDaily{}).Count(&dailyCount)
+	assert.Equal(t, int64(3), dailyCount)
+
+	// 40 天前的原始日志已清理，未汇总的日志保留
+	var rawCount int64
+	db.DB.Model(&model.TrafficLog{}).Count(&rawCount)
+	assert.Equal(t, int64(2), rawCount)
+
+	// 重复执行结果不变
+	assert.NoError(t, subscriptionService.RollupTrafficOnce(now))
+	db.DB.Where("user_id = ? AND node_id = ?", 1, 1).Order("bucket_start ASC").Find(&hourly)
+	assert.Equal(t, int64(30), hourly[0].DownloadBytes)
+
+	// 历史查询合并汇总表与未汇总的原始日志
+	history, err := subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: now.AddDate(0, 0, -60), To: now.Add(time.Hour), Granularity: GranularityMonth,
+	})
+	assert.NoError(t, err)
+	var total int64
+	for _, p := range history.Points {
+		total += p.Download
+	}
+	assert.Equal(t, int64(150), total)
+
+	// 起始时间不对齐时包含其所在的整个时间段
+	history, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: old.Add(time.Hour), To: now.Add(time.Hour), Granularity: GranularityDay,
+	})
+	assert.NoError(t, err)
+	assert.True(t, history.Points[0].Time.Equal(truncateToBucket(old, GranularityDay)))
+	assert.Equal(t, int64(60), history.Points[0].Download)
+
+	history, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: now.Add(-10 * time.Minute), To: now.Add(time.Hour), Granularity: GranularityHour,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), history.Points[0].Download)
+
+	history, err = subscriptionService.GetTrafficHistory(1, TrafficHistoryQuery{
+		From: truncateToBucket(old, GranularityDay), To: truncateToBucket(old, GranularityDay).AddDate(0, 0, 1),
+		Granularity: GranularityDay, GroupBy: "node",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, history.Points, 2)
+	assert.Equal(t, int64(30), history.Points[0].Download)
+	assert.Equal(t, int64(30), history.Points[1].Download)
+}
+
+func TestSubscriptionService_QuotaEnforcement(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	nodeService := NewNodeService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+
+	plan := model.SubscriptionPlan{Name: "套餐", Price: 10, TrafficLimit: 1000, DurationDays: 30, IsActive: true}
+	db.DB.Create(&plan)
+
+	user := model.User{Email: "quota@example.com", Username: "quota", PasswordHash: "x", Balance: 100}
+	db.DB.Create(&user)
+
+	sub, err := subscriptionService.PurchaseSubscription(user.ID, plan.ID, "balance")
+	assert.NoError(t, err)
+
+	hasAccess, err := nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+
+	// 流量用完后立即暂停并收回节点权限
+	assert.NoError(t, subscriptionService.RecordTraffic(user.ID, node.ID, 600, 400))
+
+	var exhausted model.Subscription
+	db.DB.First(&exhausted, sub.ID)
+	assert.Equal(t, "exhausted", exhausted.Status)
+
+	hasAccess, err = nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.False(t, hasAccess)
+
+	// 暂停后的上报被拒绝
+	assert.Error(t, subscriptionService.RecordTraffic(user.ID, node.ID, 1, 0))
+
+	// 后台任务将到期的活跃订阅标记为 expired
+	db.DB.Model(&model.Subscription{}).Where("id = ?", sub.ID).Updates(map[string]interface{}{
+		"status":       "active",
+		"traffic_used": 0,
+		"expired_at":   time.Now().Add(-time.Hour),
+	})
+
+	// 到期后、状态更新前上报的流量不计入已到期的订阅
+	assert.ErrorIs(t, subscriptionService.RecordTraffic(user.ID, node.ID, 1, 0), ErrNoActiveSubscription)
+	result, err := subscriptionService.RecordTrafficBatch(node.ID, "after-expiry", []TrafficDelta{{UserID: user.ID, Download: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Accepted)
+	assert.Equal(t, ErrNoActiveSubscription.Error(), result.Rejected[0].Reason)
+	db.DB.First(&exhausted, sub.ID)
+	assert.Equal(t, int64(0), exhausted.TrafficUsed)
+
+	n, err := subscriptionService.EnforceQuotasOnce(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var expired model.Subscription
+	db.DB.First(&expired, sub.ID)
+	assert.Equal(t, "expired", expired.Status)
+
+	// 续费后恢复节点权限，时长从续费时开始计算
+	assert.NoError(t, subscriptionService.RenewSubscription(user.ID, sub.ID, 1))
+
+	var renewed model.Subscription
+	db.DB.First(&renewed, sub.ID)
+	assert.Equal(t, "active", renewed.Status)
+	assert.True(t, renewed.ExpiredAt.After(time.Now()))
+
+	hasAccess, err = nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+
+	// 已处理的订阅不会重复处理
+	n, err = subscriptionService.EnforceQuotasOnce(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// 查出候选订阅后用户已续费: 加锁重新检查时跳过，不会误收回权限
+	event, err := subscriptionService.suspendIfOverQuota(sub.ID, time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, event)
+	db.DB.First(&renewed, sub.ID)
+	assert.Equal(t, "active", renewed.Status)
+	hasAccess, err = nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+}
+
+func TestNodeAgentService_DeviceLimit(t *testing.T) {
+	setupTestDB(t)
+	nodeAgentService := NewNodeAgentService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+
+	limited := model.SubscriptionPlan{Name: "基础套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30, DeviceLimit: 5}
+	unlimited := model.SubscriptionPlan{Name: "高级套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30}
+	db.DB.Create(&limited)
+	db.DB.Create(&unlimited)
+
+	user := model.User{Email: "device@example.com", Username: "device", Status: "active"}
+	db.DB.Create(&user)
+
+	expiredAt := time.Now().Add(24 * time.Hour)
+	sub := model.Subscription{UserID: user.ID, PlanID: limited.ID, Status: "active", TrafficLimit: 1024,
+		Token: "device-limited", ExpiredAt: expiredAt}
+	db.DB.Create(&sub)
+	db.DB.Create(&model.UserNodeAccess{UserID: user.ID, NodeID: node.ID, SubscriptionID: sub.ID, ExpiredAt: &expiredAt})
+
+	list, err := nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Len(t, list.Users, 1)
+	assert.Equal(t, 5, list.Users[0].DeviceLimit)
+	assert.Empty(t, list.Users[0].AllowedIPs)
+
+	limits, err := userPlanLimits([]int64{user.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, limits[user.ID].DeviceLimit)
+
+	// 同时持有不限设备数的订阅时不限制
+	db.DB.Create(&model.Subscription{UserID: user.ID, PlanID: unlimited.ID, Status: "active", TrafficLimit: 1024,
+		Token: "device-unlimited", ExpiredAt: expiredAt})
+	limits, err = userPlanLimits([]int64{user.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, limits[user.ID].DeviceLimit)
+
+	// 未启用 Redis 时不统计在线设备
+	result, err := nodeAgentService.ReportOnlineIPs([]OnlineUserIPs{{UserID: user.ID, IPs: []string{"1.2.3.4"}}})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Violations)
+}
+
+func TestNodeAgentService_DeviceLimitRedis(t *testing.T) {
+	setupTestDB(t)
+	setupTestRedis(t)
+	nodeAgentService := NewNodeAgentService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+
+	single := model.SubscriptionPlan{Name: "单设备套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30, DeviceLimit: 1}
+	double := model.SubscriptionPlan{Name: "双设备套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30, DeviceLimit: 2}
+	db.DB.Create(&single)
+	db.DB.Create(&double)
+
+	user := model.User{Email: "devices@example.com", Username: "devices", Status: "active"}
+	other := model.User{Email: "other@example.com", Username: "other", Status: "active"}
+	db.DB.Create(&user)
+	db.DB.Create(&other)
+
+	// 节点访问权限来自单设备套餐，另持有双设备套餐，两处均应按较宽松的 2 台限制
+	expiredAt := time.Now().Add(24 * time.Hour)
+	sub := model.Subscription{UserID: user.ID, PlanID: single.ID, Status: "active", TrafficLimit: 1024,
+		Token: "devices-single", ExpiredAt: expiredAt}
+	db.DB.Create(&sub)
+	db.DB.Create(&model.Subscription{UserID: user.ID, PlanID: double.ID, Status: "active", TrafficLimit: 1024,
+		Token: "devices-double", ExpiredAt: expiredAt})
+	db.DB.Create(&model.UserNodeAccess{UserID: user.ID, NodeID: node.ID, SubscriptionID: sub.ID, ExpiredAt: &expiredAt})
+
+	otherSub := model.Subscription{UserID: other.ID, PlanID: double.ID, Status: "active", TrafficLimit: 1024,
+		Token: "devices-other", ExpiredAt: expiredAt}
+	db.DB.Create(&otherSub)
+	db.DB.Create(&model.UserNodeAccess{UserID: other.ID, NodeID: node.ID, SubscriptionID: otherSub.ID, ExpiredAt: &expiredAt})
+
+	result, err := nodeAgentService.ReportOnlineIPs([]OnlineUserIPs{
+		{UserID: user.ID, IPs: []string{"1.1.1.1", "2.2.2.2"}},
+		{UserID: other.ID, IPs: []string{"4.4.4.4", "5.5.5.5"}},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Violations)
+
+	// 其他节点上报第三个 IP，合计超出限制，保留先上线的设备
+	result, err = nodeAgentService.ReportOnlineIPs([]OnlineUserIPs{{UserID: user.ID, IPs: []string{"3.3.3.3", "invalid"}}})
+	assert.NoError(t, err)
+	assert.Len(t, result.Violations, 1)
+	violation := result.Violations[0]
+	assert.Equal(t, user.ID, violation.UserID)
+	assert.Equal(t, 2, violation.Limit)
+	assert.Equal(t, 3, violation.Online)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, violation.AllowedIPs)
+
+	flagged, err := cache.RedisClient.SIsMember(context.Background(), onlineOverLimit, user.ID).Result()
+	assert.NoError(t, err)
+	assert.True(t, flagged)
+
+	list, err := nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Len(t, list.Users, 2)
+	for _, u := range list.Users {
+		assert.Equal(t, 2, u.DeviceLimit)
+		if u.ID == user.ID {
+			assert.Equal(t, violation.AllowedIPs, u.AllowedIPs)
+		} else {
+			assert.Empty(t, u.AllowedIPs)
+		}
+	}
+
+	// 设备下线后解除标记，缓存的用户列表不再限制 IP
+	onlineIPTTL = time.Second
+	t.Cleanup(func() { onlineIPTTL = 3 * time.Minute })
+	_, err = trackOnlineIPs(context.Background(), user.ID, []string{"1.1.1.1"}, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	list, err = nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	for _, u := range list.Users {
+		assert.Empty(t, u.AllowedIPs)
+	}
+	flagged, err = cache.RedisClient.SIsMember(context.Background(), onlineOverLimit, user.ID).Result()
+	assert.NoError(t, err)
+	assert.False(t, flagged)
+}
+
+func TestNodeAgentService_SpeedLimit(t *testing.T) {
+	setupTestDB(t)
+	nodeAgentService := NewNodeAgentService()
+	userService := NewUserService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+
+	plan := model.SubscriptionPlan{Name: "基础套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30,
+		UploadSpeedLimit: 20, DownloadSpeedLimit: 100}
+	db.DB.Create(&plan)
+
+	user := model.User{Email: "speed@example.com", Username: "speed", Status: "active"}
+	db.DB.Create(&user)
+
+	expiredAt := time.Now().Add(24 * time.Hour)
+	sub := model.Subscription{UserID: user.ID, PlanID: plan.ID, Status: "active", TrafficLimit: 1024,
+		Token: "speed", ExpiredAt: expiredAt}
+	db.DB.Create(&sub)
+	db.DB.Create(&model.UserNodeAccess{UserID: user.ID, NodeID: node.ID, SubscriptionID: sub.ID, ExpiredAt: &expiredAt})
+
+	// 默认使用套餐限速
+	list, err := nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Len(t, list.Users, 1)
+	assert.Equal(t, int64(20), list.Users[0].UploadSpeedLimit)
+	assert.Equal(t, int64(100), list.Users[0].DownloadSpeedLimit)
+	assert.Equal(t, int64(20), list.Users[0].SpeedLimit)
+
+	// 用户单独设置的限速优先，0 表示不限速
+	upload, download := int64(0), int64(500)
+	assert.NoError(t, userService.SetSpeedLimitOverride(user.ID, &upload, &download))
+
+	list, err = nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), list.Users[0].UploadSpeedLimit)
+	assert.Equal(t, int64(500), list.Users[0].DownloadSpeedLimit)
+	assert.Equal(t, int64(500), list.Users[0].SpeedLimit)
+
+	// 清除后恢复套餐限速
+	assert.NoError(t, userService.SetSpeedLimitOverride(user.ID, nil, nil))
+	list, err = nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), list.Users[0].UploadSpeedLimit)
+
+	// 持有多个有效订阅时与设备数一样取最宽松的套餐限速，不依赖授予节点权限的订阅
+	premium := model.SubscriptionPlan{Name: "高级套餐", Price: 10, TrafficLimit: 1024, DurationDays: 30,
+		UploadSpeedLimit: 50, DownloadSpeedLimit: 0, DeviceLimit: 3}
+	db.DB.Create(&premium)
+	db.DB.Create(&model.Subscription{UserID: user.ID, PlanID: premium.ID, Status: "active", TrafficLimit: 1024,
+		Token: "speed-premium", ExpiredAt: expiredAt})
+
+	list, err = nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Len(t, list.Users, 1)
+	assert.Equal(t, int64(50), list.Users[0].UploadSpeedLimit)
+	assert.Equal(t, int64(0), list.Users[0].DownloadSpeedLimit)
+	assert.Equal(t, int64(50), list.Users[0].SpeedLimit)
+	assert.Equal(t, 0, list.Users[0].DeviceLimit)
+
+	// 用户单独设置的限速仍优先于所有套餐
+	upload = 10
+	assert.NoError(t, userService.SetSpeedLimitOverride(user.ID, &upload, nil))
+	list, err = nodeAgentService.GetNodeUsers(node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), list.Users[0].UploadSpeedLimit)
+	assert.Equal(t, int64(0), list.Users[0].DownloadSpeedLimit)
+
+	negative := int64(-1)
+	assert.Error(t, userService.SetSpeedLimitOverride(user.ID, &negative, nil))
+	assert.Error(t, userService.SetSpeedLimitOverride(999, nil, nil))
+}
+
+func TestSubscriptionService_TrafficPack(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	nodeService := NewNodeService()
+	InitTrafficReset(1)
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+
+	plan := model.SubscriptionPlan{Name: "套餐", Price: 10, TrafficLimit: 1000, DurationDays: 90, IsActive: true}
+	db.DB.Create(&plan)
+	pack := model.TrafficPack{Name: "流量包", Traffic: 500, Price: 5, IsActive: true}
+	db.DB.Create(&pack)
+
+	user := model.User{Email: "pack@example.com", Username: "pack", PasswordHash: "x", Balance: 100}
+	db.DB.Create(&user)
+
+	sub, err := subscriptionService.PurchaseSubscription(user.ID, plan.ID, "balance")
+	assert.NoError(t, err)
+
+	// 流量用完后购买流量包立即恢复
+	assert.NoError(t, subscriptionService.RecordTraffic(user.ID, node.ID, 1000, 0))
+	hasAccess, err := nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.False(t, hasAccess)
+
+	purchase, err := subscriptionService.PurchaseTrafficPack(user.ID, sub.ID, pack.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), purchase.Remaining)
+
+	var restored model.Subscription
+	db.DB.First(&restored, sub.ID)
+	assert.Equal(t, "active", restored.Status)
+	assert.Equal(t, int64(500), restored.ExtraTraffic)
+	assert.Equal(t, int64(1500), restored.TotalTrafficLimit())
+
+	hasAccess, err = nodeService.CheckUserNodeAccess(user.ID, node.ID)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+
+	var order model.Order
+	assert.NoError(t, db.DB.Where("type = ?", "traffic_pack").First(&order).Error)
+	assert.Equal(t, sub.ID, *order.SubscriptionID)
+	assert.Equal(t, 5.0, order.Amount)
+
+	var balance model.User
+	db.DB.First(&balance, user.ID)
+	assert.InDelta(t, 85.0, balance.Balance, 0.001)
+
+	// 流量重置时扣除本周期用掉的流量包流量，剩余部分延续
+	assert.NoError(t, subscriptionService.RecordTraffic(user.ID, node.ID, 200, 0))
+	db.DB.Model(&model.Subscription{}).Where("id = ?", sub.ID).
+		Update("started_at", time.Now().AddDate(0, -2, 0))
+	_, err = subscriptionService.ResetTrafficOnce(time.Now())
+	assert.NoError(t, err)
+
+	var reset model.Subscription
+	db.DB.First(&reset, sub.ID)
+	assert.Equal(t, int64(0), reset.TrafficUsed)
+	assert.Equal(t, int64(300), reset.ExtraTraffic)
+
+	// 流量包到期后扣除剩余流量
+	_, err = subscriptionService.ExpireTrafficPacksOnce(reset.ExpiredAt.Add(time.Second))
+	assert.NoError(t, err)
+
+	var expired model.Subscription
+	db.DB.First(&expired, sub.ID)
+	assert.Equal(t, int64(0), expired.ExtraTraffic)
+
+	var expiredPurchase model.TrafficPackPurchase
+	db.DB.First(&expiredPurchase, purchase.ID)
+	assert.True(t, expiredPurchase.Expired)
+
+	// 其他用户的订阅或不存在的流量包
+	_, err = subscriptionService.PurchaseTrafficPack(user.ID+1, sub.ID, pack.ID)
+	assert.Error(t, err)
+	_, err = subscriptionService.PurchaseTrafficPack(user.ID, sub.ID, 999)
+	assert.Error(t, err)
+}
+
+func TestAllocatePackUsage(t *testing.T) {
+	purchases := []model.TrafficPackPurchase{{Remaining: 100}, {Remaining: 200}, {Remaining: 50}}
+
+	assert.Equal(t, []int64{0, 0, 0}, allocatePackUsage(purchases, -10))
+	assert.Equal(t, []int64{100, 50, 0}, allocatePackUsage(purchases, 150))
+	assert.Equal(t, []int64{100, 200, 50}, allocatePackUsage(purchases, 1000))
+}
+
+func TestProrateCredit(t *testing.T) {
+	now := time.Date(2025, 3, 1, 0, 0, 0, 0, time.Local)
+	sub := model.Subscription{Price: 30, DurationDays: 30, TrafficLimit: 1000,
+		ExpiredAt: now.AddDate(0, 0, 15)}
+
+	// 剩余一半时间、未使用流量
+	assert.InDelta(t, 15.0, prorateCredit(&sub, now), 0.001)
+
+	// 流量用掉 80% 时按剩余流量折算
+	sub.TrafficUsed = 800
+	assert.InDelta(t, 6.0, prorateCredit(&sub, now), 0.001)
+
+	// 续费预付的整周期全额折算
+	sub.ExpiredAt = now.AddDate(0, 0, 45)
+	assert.InDelta(t, 36.0, prorateCredit(&sub, now), 0.001)
+
+	// 已到期
+	sub.ExpiredAt = now.Add(-time.Hour)
+	assert.Equal(t, 0.0, prorateCredit(&sub, now))
+}
+
+func TestSubscriptionService_ChangePlan(t *testing.T) {
+	setupTestDB(t)
+	subscriptionService := NewSubscriptionService()
+	nodeService := NewNodeService()
+
+	standard := model.Node{Name: "标准节点", IsActive: true}
+	premium := model.Node{Name: "高级节点", IsActive: true}
+	db.DB.Create(&standard)
+	db.DB.Create(&premium)
+	standardGroup := model.NodeGroup{Name: "标准", Nodes: []model.Node{standard}}
+	db.DB.Create(&standardGroup)
+
+	basic := model.SubscriptionPlan{Name: "基础套餐", Price: 30, TrafficLimit: 1000, DurationDays: 30,
+		IsActive: true, NodeGroups: []model.NodeGroup{standardGroup}}
+	advanced := model.SubscriptionPlan{Name: "高级套餐", Price: 100, TrafficLimit: 5000, DurationDays: 30, IsActive: true}
+	db.DB.Create(&basic)
+	db.DB.Create(&advanced)
+
+	user := model.User{Email: "change@example.com", Username: "change", PasswordHash: "x", Balance: 200}
+	db.DB.Create(&user)
+
+	sub, err := subscriptionService.PurchaseSubscription(user.ID, basic.ID, "balance")
+	assert.NoError(t, err)
+	assert.NoError(t, subscriptionService.RecordTraffic(user.ID, standard.ID, 500, 0))
+
+	hasAccess, _ := nodeService.CheckUserNodeAccess(user.ID, premium.ID)
+	assert.False(t, hasAccess)
+
+	// 升级: 剩余约一个周期、流量用掉一半，折算约 15 元
+	result, err := subscriptionService.ChangePlan(user.ID, sub.ID, advanced.ID)
+	assert.NoError(t, err)
+	assert.InDelta(t, 15.0, result.Credit, 0.01)
+	assert.InDelta(t, 85.0, result.Amount, 0.01)
+
+	var upgraded model.Subscription
+	db.DB.First(&upgraded, sub.ID)
+	assert.Equal(t, advanced.ID, upgraded.PlanID)
+	assert.Equal(t, sub.Token, upgraded.Token)
+	assert.Equal(t, int64(5000), upgraded.TrafficLimit)
+	assert.Equal(t, int64(0), upgraded.TrafficUsed)
+
+	hasAccess, _ = nodeService.CheckUserNodeAccess(user.ID, premium.ID)
+	assert.True(t, hasAccess)
+
+	var balance model.User
+	db.DB.First(&balance, user.ID)
+	assert.InDelta(t, 200-30-result.Amount, balance.Balance, 0.001)
+
+	var order model.Order
+	assert.NoError(t, db.DB.Where("type = ?", "change_plan").First(&order).Error)
+	assert.Equal(t, sub.ID, *order.SubscriptionID)
+
+	// 降级: 差额退回余额，收回高级节点权限
+	result, err = subscriptionService.ChangePlan(user.ID, sub.ID, basic.ID)
+	assert.NoError(t, err)
+	assert.Less(t, result.Amount, 0.0)
+
+	hasAccess, _ = nodeService.CheckUserNodeAccess(user.ID, premium.ID)
+	assert.False(t, hasAccess)
+	hasAccess, _ = nodeService.CheckUserNodeAccess(user.ID, standard.ID)
+	assert.True(t, hasAccess)
+
+	// 相同套餐、其他用户
+	_, err = subscriptionService.ChangePlan(user.ID, sub.ID, basic.ID)
+	assert.Error(t, err)
+	_, err = subscriptionService.ChangePlan(user.ID+1, sub.ID, advanced.ID)
+	assert.Error(t, err)
+
+	// 流量统计汇总所有有效订阅
+	_, err = subscriptionService.PurchaseSubscription(user.ID, advanced.ID, "balance")
+	assert.NoError(t, err)
+	traffic, err := subscriptionService.GetUserTraffic(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6000), traffic["total"])
+	assert.Equal(t, 2, traffic["subscriptions"])
+}
+
+func TestSubscriptionService_ChangePlanRedis(t *testing.T) {
+	setupTestDB(t)
+	mr := setupTestRedis(t)
+	subscriptionService := NewSubscriptionService()
+
+	node := model.Node{Name: "节点", IsActive: true}
+	db.DB.Create(&node)
+	basic := model.SubscriptionPlan{Name: "基础套餐", Price: 30, TrafficLimit: 1000, DurationDays: 30, IsActive: true}
+	advanced := model.SubscriptionPlan{Name: "高级套餐", Price: 100, TrafficLimit: 5000, DurationDays: 30, IsActive: true}
+	db.DB.Create(&basic)
+	db.DB.Create(&advanced)
+
+	user := model.User{Email: "change-redis@example.com", Username: "change-redis", PasswordHash: "x", Balance: 200}
+	other := model.User{Email: "change-other@example.com", Username: "change-other", PasswordHash: "x", Balance: 200}
+	db.DB.Create(&user)
+	db.DB.Create(&other)
+
+	sub, err := subscriptionService.PurchaseSubscription(user.ID, basic.ID, "balance")
+	assert.NoError(t, err)
+	_, err = subscriptionService.PurchaseSubscription(other.ID, basic.ID, "balance")
+	assert.NoError(t, err)
+	assert.NoError(t, subscriptionService.RecordTraffic(user.ID, node.ID, 200, 300))
+	assert.NoError(t, subscriptionService.RecordTraffic(other.ID, node.ID, 0, 100))
+
+	// 更换失败时待同步的流量放回 Redis
+	_, err = subscriptionService.ChangePlan(user.ID, sub.ID, basic.ID)
+	assert.Error(t, err)
+	assert.Equal(t, "200", mr.HGet(trafficPendingKey, trafficField("u", user.ID, node.ID)))
+	assert.Equal(t, "300", mr.HGet(trafficPendingKey, trafficField("d", user.ID, node.ID)))
+
+	// 只入库该用户待同步的流量，按最新用量折算
+	result, err := subscriptionService.ChangePlan(user.ID, sub.ID, advanced.ID)
+	assert.NoError(t, err)
+	assert.InDelta(t, 15.0, result.Credit, 0.01)
+
+	var period model.TrafficUsagePeriod
+	assert.NoError(t, db.DB.Where("subscription_id = ?", sub.ID).First(&period).Error)
+	assert.Equal(t, int64(500), period.TrafficUsed)
+
+	assert.Empty(t, mr.HGet(trafficPendingKey, trafficField("u", user.ID, node.ID)))
+	assert.Empty(t, mr.HGet(trafficPendingKey, trafficField("d", user.ID, node.ID)))
+	assert.Equal(t, "100", mr.HGet(trafficPendingKey, trafficField("d", other.ID, node.ID)))
+}
+
+func TestPaymentService_Recharge(t *testing.T) {
+	setupTestDB(t)
+	paymentService := NewPaymentService()
+	provider := payment.NewFakeProvider("test-secret")
+	payment.Register(provider)
+
+	user := model.User{Email: "pay@example.com", Username: "pay", PasswordHash: "x"}
+	db.DB.Create(&user)
+
+	balanceOf := func() float64 {
+		var u model.User
+		db.DB.First(&u, user.ID)
+		return u.Balance
+	}
+
+	_, err := paymentService.CreateRecharge(user.ID, 50, "unknown")
+	assert.ErrorIs(t, err, payment.ErrProviderNotFound)
+
+	// 发起充值不增加余额
+	result, err := paymentService.CreateRecharge(user.ID, 50, payment.FakeName)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result.PayURL)
+	assert.Equal(t, 0.0, balanceOf())
+
+	// 篡改金额或签名的通知被拒绝
+	payURL, _ := url.Parse(result.PayURL)
+	tampered := payURL.Query()
+	tampered.Set("amount", "500.00")
+	assert.Error(t, paymentService.HandleCallback(payment.FakeName,
+		httptest.NewRequest("POST", "/notify?"+tampered.Encode(), nil)))
+	forged := payment.NewFakeProvider("other-secret").
+		SignNotification(result.OrderNo, "FORGED", 50, payment.StatusPaid)
+	assert.Error(t, paymentService.HandleCallback(payment.FakeName,
+		httptest.NewRequest("POST", "/notify?"+forged.Encode(), nil)))
+	assert.Equal(t, 0.0, balanceOf())
+
+	// 支付成功回调入账，重复通知不重复入账
+	assert.NoError(t, paymentService.HandleCallback(payment.FakeName, httptest.NewRequest("GET", result.PayURL, nil)))
+	assert.NoError(t, paymentService.HandleCallback(payment.FakeName, httptest.NewRequest("GET", result.PayURL, nil)))
+	assert.InDelta(t, 50.0, balanceOf(), 0.001)
+
+	order, err := paymentService.GetRecharge(user.ID, result.OrderNo)
+	assert.NoError(t, err)
+	assert.Equal(t, "paid", order.Status)
+	assert.NotNil(t, order.PaidAt)
+	_, err = paymentService.GetRecharge(user.ID+1, result.OrderNo)
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+
+	// 未收到回调时查询订单补单
+	missed, err := paymentService.CreateRecharge(user.ID, 20, payment.FakeName)
+	assert.NoError(t, err)
+	payURL, _ = url.Parse(missed.PayURL)
+	_, err = provider.VerifyCallback(httptest.NewRequest("GET", "/notify?"+payURL.RawQuery, nil))
+	assert.NoError(t, err)
+	order, err = paymentService.GetRecharge(user.ID, missed.OrderNo)
+	assert.NoError(t, err)
+	assert.Equal(t, "paid", order.Status)
+	assert.InDelta(t, 70.0, balanceOf(), 0.001)
+
+	// 退款扣回余额
+	assert.NoError(t, paymentService.RefundRecharge(result.OrderNo))
+	assert.InDelta(t, 20.0, balanceOf(), 0.001)
+	assert.Error(t, paymentService.RefundRecharge(result.OrderNo))
+}
+
+// flakyRefundProvider 退款请求总是返回错误的支付渠道，refunded 表示渠道实际是否完成退款
+type flakyRefundProvider struct {
+	*payment.FakeProvider
+	refunded  bool
+	queryFail bool
+}
+
+func (p *flakyRefundProvider) Refund(ctx context.Context, orderNo string, amount float64) error {
+	if p.refunded {
+		if err := p.FakeProvider.Refund(ctx, orderNo, amount); err != nil {
+			return err
+		}
+	}
+	return errors.New("支付渠道超时")
+}
+
+func (p *flakyRefundProvider) Query(ctx context.Context, orderNo string) (*payment.QueryResult, error) {
+	if p.queryFail {
+		return nil, errors.New("支付渠道超时")
+	}
+	return p.FakeProvider.Query(ctx, orderNo)
+}
+
+func TestPaymentService_RefundRecharge(t *testing.T) {
+	setupTestDB(t)
+	paymentService := NewPaymentService()
+	fake := payment.NewFakeProvider("test-secret")
+	payment.Register(fake)
+	t.Cleanup(func() { payment.Register(fake) })
+
+	user := model.User{Email: "refund@example.com", Username: "refund", PasswordHash: "x"}
+	db.DB.Create(&user)
+
+	balanceOf := func() float64 {
+		var u model.User
+		db.DB.First(&u, user.ID)
+		return u.Balance
+	}
+	statusOf := func(orderNo string) string {
+		var o model.Order
+		db.DB.Where("order_no = ?", orderNo).First(&o)
+		return o.Status
+	}
+	recharge := func(amount float64) string {
+		result, err := paymentService.CreateRecharge(user.ID, amount, payment.FakeName)
+		assert.NoError(t, err)
+		assert.NoError(t, paymentService.HandleCallback(payment.FakeName, httptest.NewRequest("GET", result.PayURL, nil)))
+		return result.OrderNo
+	}
+
+	first := recharge(50)
+	second := recharge(20)
+	assert.InDelta(t, 70.0, balanceOf(), 0.001)
+
+	// 渠道确认未退款: 退回余额，订单恢复为已支付
+	payment.Register(&flakyRefundProvider{FakeProvider: fake})
+	assert.Error(t, paymentService.RefundRecharge(first))
+	assert.Equal(t, "paid", statusOf(first))
+	assert.InDelta(t, 70.0, balanceOf(), 0.001)
+
+	// 请求报错但渠道已完成退款: 以渠道状态为准
+	payment.Register(&flakyRefundProvider{FakeProvider: fake, refunded: true})
+	assert.NoError(t, paymentService.RefundRecharge(first))
+	assert.Equal(t, "refunded", statusOf(first))
+	assert.InDelta(t, 20.0, balanceOf(), 0.001)
+
+	// 结果未知: 保持退款中且余额已扣回，重试时不重复扣回
+	payment.Register(&flakyRefundProvider{FakeProvider: fake, queryFail: true})
+	assert.Error(t, paymentService.RefundRecharge(second))
+	assert.Equal(t, "refunding", statusOf(second))
+	assert.InDelta(t, 0.0, balanceOf(), 0.001)
+
+	payment.Register(fake)
+	assert.NoError(t, paymentService.RefundRecharge(second))
+	assert.Equal(t, "refunded", statusOf(second))
+	assert.InDelta(t, 0.0, balanceOf(), 0.001)
+	assert.Error(t, paymentService.RefundRecharge(second))
+}
@@ -1,17 +1,59 @@
 package service
 
 import (
-	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
 	"github.com/mariclezhang/vps_backend/pkg/db"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// 订阅链接相关错误
+var (
+	ErrSubscriptionNotFound = errors.New("订阅不存在")
+	ErrSubscriptionInactive = errors.New("订阅已过期或已停用")
+	ErrTrafficExhausted     = errors.New("流量已用完")
+	ErrNoActiveSubscription = errors.New("没有活跃的订阅")
+)
+
+// TrafficDelta 节点上报的单个用户流量增量
+type TrafficDelta struct {
+	UserID   int64 `json:"userId" binding:"required"`
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// TrafficRejection 未能入账的流量记录
+type TrafficRejection struct {
+	UserID int64  `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// TrafficBatchResult 批量流量上报结果
+type TrafficBatchResult struct {
+	Duplicate bool               `json:"duplicate"`
+	Accepted  int                `json:"accepted"`
+	Rejected  []TrafficRejection `json:"rejected"`
+}
+
+// subscribeBaseURL 订阅链接的公开访问地址
+var subscribeBaseURL = "http://localhost:8080"
+
+// InitSubscribeBaseURL 设置订阅链接的公开访问地址
+func InitSubscribeBaseURL(baseURL string) {
+	if baseURL != "" {
+		subscribeBaseURL = strings.TrimRight(baseURL, "/")
+	}
+}
+
 // SubscriptionService 订阅服务
 type SubscriptionService struct {
 	userService *UserService
@@ -32,37 +74,53 @@ func (s *SubscriptionService) GetUserSubscriptions(userID int64) ([]model.Subscr
 		Find(&subscriptions).Error; err != nil {
 		return nil, err
 	}
+
+	for i := range subscriptions {
+		s.fillSubscribeURL(&subscriptions[i])
+	}
 	return subscriptions, nil
 }
 
-// GetUserTraffic 获取用户流量使用情况
+// GetUserTraffic 获取用户流量使用情况，汇总所有有效订阅 (包括流量已用完的订阅)
 func (s *SubscriptionService) GetUserTraffic(userID int64) (map[string]interface{}, error) {
-	// 获取用户的活跃订阅
-	var subscription model.Subscription
-	if err := db.DB.Where("user_id = ? AND status = ?", userID, "active").
+	var subscriptions []model.Subscription
+	if err := db.DB.Where("user_id = ? AND status IN ?", userID, []string{"active", "exhausted"}).
+		Where("expired_at > ?", time.Now()).
 		Order("expired_at DESC").
-		First(&subscription).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return map[string]interface{}{
-				"used":       0,
-				"total":      0,
-				"percentage": 0,
-				"resetDate":  nil,
-			}, nil
-		}
+		Find(&subscriptions).Error; err != nil {
 		return nil, err
 	}
 
+	if len(subscriptions) == 0 {
+		return map[string]interface{}{
+			"used":          0,
+			"total":         0,
+			"extra":         0,
+			"percentage":    0,
+			"resetDate":     nil,
+			"subscriptions": 0,
+		}, nil
+	}
+
+	var used, total, extra int64
+	for _, subscription := range subscriptions {
+		used += subscription.TrafficUsed
+		total += subscription.TotalTrafficLimit()
+		extra += subscription.ExtraTraffic
+	}
+
 	percentage := 0.0
-	if subscription.TrafficLimit > 0 {
-		percentage = float64(subscription.TrafficUsed) / float64(subscription.TrafficLimit) * 100
+	if total > 0 {
+		percentage = float64(used) / float64(total) * 100
 	}
 
 	return map[string]interface{}{
-		"used":       subscription.TrafficUsed,
-		"total":      subscription.TrafficLimit,
-		"percentage": percentage,
-		"resetDate":  subscription.ExpiredAt,
+		"used":          used,
+		"total":         total,
+		"extra":         extra,
+		"percentage":    percentage,
+		"resetDate":     subscriptions[0].ExpiredAt,
+		"subscriptions": len(subscriptions),
 	}, nil
 }
 
@@ -70,6 +128,7 @@ func (s *SubscriptionService) GetUserTraffic(userID int64) (map[string]interface
 func (s *SubscriptionService) GetAllPlans() ([]model.SubscriptionPlan, error) {
 	var plans []model.SubscriptionPlan
 	if err := db.DB.Where("is_active = ?", true).
+		Preload("NodeGroups").
 		Order("sort_order ASC, price ASC").
 		Find(&plans).Error; err != nil {
 		return nil, err
@@ -110,6 +169,11 @@ func (s *SubscriptionService) PurchaseSubscription(userID, planID int64, payment
 		}
 
 		// 创建订阅
+		token, err := generateSubscribeToken()
+		if err != nil {
+			return err
+		}
+
 		now := time.Now()
 		expiredAt := now.AddDate(0, 0, plan.DurationDays)
 
@@ -123,7 +187,7 @@ func (s *SubscriptionService) PurchaseSubscription(userID, planID int64, payment
 			TrafficUsed:  0,
 			Price:        plan.Price,
 			DurationDays: plan.DurationDays,
-			SubscribeURL: s.generateSubscribeURL(userID),
+			Token:        token,
 			StartedAt:    now,
 			ExpiredAt:    expiredAt,
 		}
@@ -133,7 +197,7 @@ func (s *SubscriptionService) PurchaseSubscription(userID, planID int64, payment
 		}
 
 		// 创建订单记录
-		orderNo := s.generateOrderNo(userID)
+		orderNo := generateOrderNo(userID)
 		order := model.Order{
 			UserID:        userID,
 			OrderNo:       orderNo,
@@ -150,7 +214,7 @@ func (s *SubscriptionService) PurchaseSubscription(userID, planID int64, payment
 		}
 
 		// 分配节点访问权限
-		if err := s.grantNodeAccess(tx, userID, subscription.ID, expiredAt); err != nil {
+		if err := s.grantNodeAccess(tx, userID, subscription.ID, plan.ID, expiredAt); err != nil {
 			return err
 		}
 
@@ -161,6 +225,8 @@ func (s *SubscriptionService) PurchaseSubscription(userID, planID int64, payment
 		return nil, err
 	}
 
+	InvalidateNodeUsers()
+	s.fillSubscribeURL(subscription)
 	return subscription, nil
 }
 
@@ -189,7 +255,7 @@ func (s *SubscriptionService) RenewSubscription(userID, subscriptionID int64, mo
 	totalPrice := plan.Price * float64(months)
 
 	// 开始事务
-	return db.DB.Transaction(func(tx *gorm.DB) error {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
 		// 扣除余额
 		var user model.User
 		if err := tx.First(&user, userID).Error; err != nil {
@@ -204,31 +270,52 @@ func (s *SubscriptionService) RenewSubscription(userID, subscriptionID int64, mo
 			return err
 		}
 
-		// 延长过期时间
-		newExpiredAt := subscription.ExpiredAt.AddDate(0, months, 0)
-		if err := tx.Model(&subscription).Updates(map[string]interface{}{
-			"expired_at": newExpiredAt,
-			"status":     "active",
-		}).Error; err != nil {
+		// 延长过期时间，已过期的订阅从当前时间开始计算
+		now := time.Now()
+		base := subscription.ExpiredAt
+		if base.Before(now) {
+			base = now
+		}
+		subscription.ExpiredAt = base.AddDate(0, months, 0)
+		if err := tx.Model(&subscription).Update("expired_at", subscription.ExpiredAt).Error; err != nil {
+			return err
+		}
+
+		// 流量包不随订阅延期，扣除已到期的流量包
+		if err := expireTrafficPacksTx(tx, subscription.ID, now); err != nil {
+			return err
+		}
+		if err := tx.First(&subscription, subscription.ID).Error; err != nil {
+			return err
+		}
+
+		// 恢复订阅状态，节点访问权限随订阅延期
+		if _, err := s.restoreSubscriptionTx(tx, &subscription, now); err != nil {
 			return err
 		}
 
 		// 创建订单记录
-		now := time.Now()
-		orderNo := s.generateOrderNo(userID)
+		orderNo := generateOrderNo(userID)
 		order := model.Order{
-			UserID:        userID,
-			OrderNo:       orderNo,
-			Type:          "renew",
-			PlanID:        &plan.ID,
-			Amount:        totalPrice,
-			PaymentMethod: "balance",
-			Status:        "paid",
-			PaidAt:        &now,
+			UserID:         userID,
+			OrderNo:        orderNo,
+			Type:           "renew",
+			PlanID:         &plan.ID,
+			SubscriptionID: &subscription.ID,
+			Amount:         totalPrice,
+			PaymentMethod:  "balance",
+			Status:         "paid",
+			PaidAt:         &now,
 		}
 
 		return tx.Create(&order).Error
 	})
+	if err != nil {
+		return err
+	}
+
+	publishNodeUserEvents(NodeUserEvent{UserID: userID, SubscriptionID: subscription.ID, Status: subscription.Status})
+	return nil
 }
 
 // CancelSubscription 取消订阅
@@ -242,100 +329,458 @@ func (s *SubscriptionService) CancelSubscription(userID, subscriptionID int64) e
 		return errors.New("无权操作此订阅")
 	}
 
-	if err := db.DB.Model(&subscription).Update("status", "cancelled").Error; err != nil {
+	// 取消订阅并收回节点权限
+	var event *NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		event, err = s.suspendSubscriptionTx(tx, &subscription, "cancelled", time.Now())
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
+	publishNodeUserEvents(*event)
 	return nil
 }
 
-// RecordTraffic 记录流量使用
+// RecordTraffic 记录流量使用，启用 Redis 时先累加到 Redis，由 FlushTraffic 定期入库
 func (s *SubscriptionService) RecordTraffic(userID, nodeID int64, uploadBytes, downloadBytes int64) error {
-	totalBytes := uploadBytes + downloadBytes
+	if uploadBytes < 0 || downloadBytes < 0 {
+		return errors.New("流量不能为负数")
+	}
 
-	// 获取用户的活跃订阅
-	var subscription model.Subscription
-	if err := db.DB.Where("user_id = ? AND status = ?", userID, "active").
-		Order("expired_at DESC").
-		First(&subscription).Error; err != nil {
-		return errors.New("没有活跃的订阅")
+	if cache.RedisClient != nil {
+		active, err := usersWithActiveSubscription([]int64{userID})
+		if err != nil {
+			return err
+		}
+		if !active[userID] {
+			return ErrNoActiveSubscription
+		}
+
+		key, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		_, err = accumulateTraffic(nodeID, key, []TrafficDelta{{UserID: userID, Upload: uploadBytes, Download: downloadBytes}})
+		return err
 	}
 
-	// 检查流量是否超限
-	if subscription.TrafficUsed+totalBytes > subscription.TrafficLimit {
-		return errors.New("流量已用完")
+	var event *NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		event, err = s.recordTrafficTx(tx, userID, nodeID, uploadBytes, downloadBytes, trafficLimitReject)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	// 开始事务
-	return db.DB.Transaction(func(tx *gorm.DB) error {
-		// 记录流量日志
-		trafficLog := model.TrafficLog{
-			UserID:         userID,
-			SubscriptionID: subscription.ID,
-			NodeID:         nodeID,
-			UploadBytes:    uploadBytes,
-			DownloadBytes:  downloadBytes,
-			TotalBytes:     totalBytes,
+	if event != nil {
+		publishNodeUserEvents(*event)
+	}
+	return nil
+}
+
+// errDuplicateReport 相同幂等键的上报已由并发的重试入库
+var errDuplicateReport = errors.New("重复的流量上报")
+
+// RecordTrafficBatch 记录节点上报的一批流量。
+// 相同节点的相同幂等键只会生效一次，重试的上报直接返回 Duplicate。
+// 启用 Redis 时累加到 Redis，由 FlushTraffic 定期入库，没有活跃订阅的用户在上报时拒绝，配额在入库时检查；
+// 否则在同一事务中入库，超出剩余配额的流量计满配额为止，没有活跃订阅或流量已用完的用户会被跳过并在结果中列出。
+// 并发重试时由唯一索引兜底，同样返回 Duplicate。
+func (s *SubscriptionService) RecordTrafficBatch(nodeID int64, idempotencyKey string, items []TrafficDelta) (*TrafficBatchResult, error) {
+	if idempotencyKey == "" {
+		return nil, errors.New("缺少幂等键")
+	}
+
+	result := &TrafficBatchResult{Rejected: make([]TrafficRejection, 0)}
+
+	if cache.RedisClient != nil {
+		userIDs := make([]int64, 0, len(items))
+		for _, item := range items {
+			userIDs = append(userIDs, item.UserID)
+		}
+		active, err := usersWithActiveSubscription(userIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		valid := make([]TrafficDelta, 0, len(items))
+		for _, item := range items {
+			if item.Upload < 0 || item.Download < 0 {
+				result.Rejected = append(result.Rejected, TrafficRejection{UserID: item.UserID, Reason: "流量不能为负数"})
+				continue
+			}
+			if item.Upload+item.Download == 0 {
+				continue
+			}
+			if !active[item.UserID] {
+				result.Rejected = append(result.Rejected, TrafficRejection{UserID: item.UserID, Reason: ErrNoActiveSubscription.Error()})
+				continue
+			}
+			valid = append(valid, item)
 		}
 
-		if err := tx.Create(&trafficLog).Error; err != nil {
+		duplicate, err := accumulateTraffic(nodeID, idempotencyKey, valid)
+		if err != nil {
+			return nil, err
+		}
+		result.Duplicate = duplicate
+		if !duplicate {
+			result.Accepted = len(valid)
+		} else {
+			result.Rejected = result.Rejected[:0]
+		}
+		return result, nil
+	}
+
+	var events []NodeUserEvent
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&model.TrafficReport{}).
+			Where("node_id = ? AND idempotency_key = ?", nodeID, idempotencyKey).
+			Count(&count).Error; err != nil {
 			return err
 		}
+		if count > 0 {
+			result.Duplicate = true
+			return nil
+		}
 
-		// 更新订阅的已用流量
-		if err := tx.Model(&subscription).
-			Update("traffic_used", gorm.Expr("traffic_used + ?", totalBytes)).Error; err != nil {
+		report := model.TrafficReport{
+			NodeID:         nodeID,
+			IdempotencyKey: idempotencyKey,
+			ItemCount:      len(items),
+		}
+		if err := tx.Create(&report).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return errDuplicateReport
+			}
 			return err
 		}
 
+		for _, item := range items {
+			if item.Upload < 0 || item.Download < 0 {
+				result.Rejected = append(result.Rejected, TrafficRejection{UserID: item.UserID, Reason: "流量不能为负数"})
+				continue
+			}
+			if item.Upload+item.Download == 0 {
+				continue
+			}
+
+			event, err := s.recordTrafficTx(tx, item.UserID, nodeID, item.Upload, item.Download, trafficLimitCap)
+			if errors.Is(err, ErrNoActiveSubscription) || errors.Is(err, ErrTrafficExhausted) {
+				result.Rejected = append(result.Rejected, TrafficRejection{UserID: item.UserID, Reason: err.Error()})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if event != nil {
+				events = append(events, *event)
+			}
+			result.Accepted++
+		}
+
 		return nil
 	})
+	if errors.Is(err, errDuplicateReport) {
+		return &TrafficBatchResult{Duplicate: true, Rejected: make([]TrafficRejection, 0)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	publishNodeUserEvents(events...)
+	return result, nil
 }
 
-// generateSubscribeURL 生成订阅链接
-func (s *SubscriptionService) generateSubscribeURL(userID int64) string {
-	// 使用用户ID和时间戳生成唯一token
-	data := fmt.Sprintf("%d-%d", userID, time.Now().UnixNano())
-	hash := md5.Sum([]byte(data))
-	token := hex.EncodeToString(hash[:])
-	return fmt.Sprintf("https://api.example.com/sub/%s", token)
+// usersWithActiveSubscription 返回有活跃订阅的用户
+func usersWithActiveSubscription(userIDs []int64) (map[int64]bool, error) {
+	var ids []int64
+	if err := db.DB.Model(&model.Subscription{}).
+		Where("user_id IN ? AND status = ? AND expired_at > ?", userIDs, "active", time.Now()).
+		Distinct().Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	active := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		active[id] = true
+	}
+	return active, nil
 }
 
-// generateOrderNo 生成订单号
-func (s *SubscriptionService) generateOrderNo(userID int64) string {
-	return fmt.Sprintf("ORD%d%d", time.Now().Unix(), userID)
+// trafficLimitMode 记录流量时对剩余配额的处理方式
+type trafficLimitMode int
+
+const (
+	// trafficLimitReject 拒绝超出剩余配额的流量
+	trafficLimitReject trafficLimitMode = iota
+	// trafficLimitCap 超出剩余配额的部分不计费，订阅计满配额后暂停；没有剩余配额时拒绝
+	trafficLimitCap
+	// trafficLimitNone 流量已实际产生，全部计入，流量已用完的订阅也会继续计入
+	trafficLimitNone
+)
+
+// recordTrafficTx 在事务中记录一条流量，按节点流量倍率计入订阅，配额按 mode 处理。
+// 订阅因此用完流量时立即暂停并返回状态变化事件。
+func (s *SubscriptionService) recordTrafficTx(tx *gorm.DB, userID, nodeID int64, uploadBytes, downloadBytes int64, mode trafficLimitMode) (*NodeUserEvent, error) {
+	totalBytes := uploadBytes + downloadBytes
+
+	rate, err := nodeTrafficRate(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	chargedBytes := int64(math.Round(float64(totalBytes) * rate))
+
+	// 获取用户的活跃订阅，已到期但尚未被配额检查改为 expired 的订阅不再计费
+	statuses := []string{"active"}
+	if mode == trafficLimitNone {
+		statuses = append(statuses, "exhausted")
+	}
+	var subscription model.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND status IN ? AND expired_at > ?", userID, statuses, time.Now()).
+		Order("status ASC, expired_at DESC").
+		First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoActiveSubscription
+		}
+		return nil, err
+	}
+
+	// 检查流量是否超限
+	if remaining := subscription.TotalTrafficLimit() - subscription.TrafficUsed; chargedBytes > remaining {
+		switch {
+		case mode == trafficLimitReject || (mode == trafficLimitCap && remaining <= 0):
+			return nil, ErrTrafficExhausted
+		case mode == trafficLimitCap:
+			chargedBytes = remaining
+		}
+	}
+
+	// 记录流量日志，保留实际流量与倍率
+	trafficLog := model.TrafficLog{
+		UserID:         userID,
+		SubscriptionID: subscription.ID,
+		NodeID:         nodeID,
+		UploadBytes:    uploadBytes,
+		DownloadBytes:  downloadBytes,
+		TotalBytes:     totalBytes,
+		Rate:           rate,
+		ChargedBytes:   chargedBytes,
+	}
+
+	if err := tx.Create(&trafficLog).Error; err != nil {
+		return nil, err
+	}
+
+	// 更新订阅的已用流量与累计上下行流量
+	if err := tx.Model(&subscription).Updates(map[string]interface{}{
+		"traffic_used":   gorm.Expr("traffic_used + ?", chargedBytes),
+		"upload_total":   gorm.Expr("upload_total + ?", uploadBytes),
+		"download_total": gorm.Expr("download_total + ?", downloadBytes),
+	}).Error; err != nil {
+		return nil, err
+	}
+	subscription.TrafficUsed += chargedBytes
+
+	// 流量用完立即收回节点权限
+	if subscription.Status == "active" && subscription.TrafficUsed >= subscription.TotalTrafficLimit() {
+		return s.suspendSubscriptionTx(tx, &subscription, "exhausted", time.Now())
+	}
+	return nil, nil
+}
+
+// nodeTrafficRate 获取节点流量倍率，节点不存在或倍率不为正数时按 1 倍计算。
+// 启用 Redis 时计数只记录实际流量，倍率在 FlushTraffic 入库时读取，期间修改的倍率对尚未同步的流量同样生效。
+func nodeTrafficRate(tx *gorm.DB, nodeID int64) (float64, error) {
+	var rates []float64
+	if err := tx.Model(&model.Node{}).Where("id = ?", nodeID).Limit(1).Pluck("traffic_rate", &rates).Error; err != nil {
+		return 0, err
+	}
+	if len(rates) == 0 || rates[0] <= 0 {
+		return 1, nil
+	}
+	return rates[0], nil
+}
+
+// ResetSubscribeToken 重置订阅链接token，旧链接立即失效
+func (s *SubscriptionService) ResetSubscribeToken(userID, subscriptionID int64) (*model.Subscription, error) {
+	var subscription model.Subscription
+	if err := db.DB.First(&subscription, subscriptionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, err
+	}
+
+	if subscription.UserID != userID {
+		return nil, errors.New("无权操作此订阅")
+	}
+
+	token, err := generateSubscribeToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.DB.Model(&subscription).Update("token", token).Error; err != nil {
+		return nil, err
+	}
+
+	s.fillSubscribeURL(&subscription)
+	return &subscription, nil
 }
 
-// grantNodeAccess 分配节点访问权限
-func (s *SubscriptionService) grantNodeAccess(tx *gorm.DB, userID, subscriptionID int64, expiredAt time.Time) error {
-	// 获取所有活跃节点
-	var nodes []model.Node
-	if err := tx.Where("is_active = ?", true).Find(&nodes).Error; err != nil {
+// BackfillSubscribeTokens 为旧订阅补全token。
+// 旧版本把 https://api.example.com/sub/<md5> 整体存在 subscribe_url 列中，
+// 这里沿用其中的md5作为token，保证用户已导入的链接继续可用。
+func (s *SubscriptionService) BackfillSubscribeTokens() error {
+	var subscriptions []model.Subscription
+	if err := db.DB.Where("token IS NULL OR token = ?", "").Find(&subscriptions).Error; err != nil {
 		return err
 	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
 
-	// 为用户分配所有节点的访问权限
-	for _, node := range nodes {
-		access := model.UserNodeAccess{
-			UserID:         userID,
-			NodeID:         node.ID,
-			SubscriptionID: subscriptionID,
-			ExpiredAt:      &expiredAt,
-		}
-
-		// 使用 ON CONFLICT DO UPDATE 避免重复
-		if err := tx.Create(&access).Error; err != nil {
-			// 如果已存在，更新过期时间
-			if err := tx.Model(&model.UserNodeAccess{}).
-				Where("user_id = ? AND node_id = ?", userID, node.ID).
-				Updates(map[string]interface{}{
-					"subscription_id": subscriptionID,
-					"expired_at":      &expiredAt,
-				}).Error; err != nil {
+	legacyTokens := make(map[int64]string)
+	if db.DB.Migrator().HasColumn(&model.Subscription{}, "subscribe_url") {
+		var rows []struct {
+			ID           int64
+			SubscribeURL string
+		}
+		if err := db.DB.Table("subscriptions").Select("id, subscribe_url").
+			Where("subscribe_url IS NOT NULL AND subscribe_url <> ?", "").
+			Scan(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			token := row.SubscribeURL[strings.LastIndex(row.SubscribeURL, "/")+1:]
+			if isValidSubscribeToken(token) {
+				legacyTokens[row.ID] = token
+			}
+		}
+	}
+
+	for _, subscription := range subscriptions {
+		token, ok := legacyTokens[subscription.ID]
+		if !ok {
+			var err error
+			if token, err = generateSubscribeToken(); err != nil {
 				return err
 			}
 		}
+		if err := db.DB.Model(&subscription).Update("token", token).Error; err != nil {
+			return err
+		}
+	}
+
+	log.Printf("已为 %d 个订阅补全token", len(subscriptions))
+	return nil
+}
+
+// fillSubscribeURL 根据token拼接订阅链接
+func (s *SubscriptionService) fillSubscribeURL(subscription *model.Subscription) {
+	if subscription.Token != "" {
+		subscription.SubscribeURL = fmt.Sprintf("%s/sub/%s", subscribeBaseURL, subscription.Token)
+	}
+}
+
+// generateSubscribeToken 生成随机订阅token（32位十六进制）
+func generateSubscribeToken() (string, error) {
+	return randomHex(16)
+}
+
+// generateOrderNo 生成订单号，包含微秒避免同一用户同一秒内的订单号冲突
+func generateOrderNo(userID int64) string {
+	now := time.Now()
+	return fmt.Sprintf("ORD%d%d%06d", now.Unix(), userID, now.Nanosecond()/1000)
+}
+
+// grantNodeAccess 按套餐的节点分组为用户分配节点访问权限，套餐未配置分组时分配所有活跃节点
+func (s *SubscriptionService) grantNodeAccess(tx *gorm.DB, userID, subscriptionID, planID int64, expiredAt time.Time) error {
+	var nodeIDs []int64
+	if err := planNodesQuery(tx, planID).Pluck("nodes.id", &nodeIDs).Error; err != nil {
+		return err
+	}
+
+	for _, nodeID := range nodeIDs {
+		if err := upsertNodeAccess(tx, userID, nodeID, subscriptionID, expiredAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetSubscriptionByToken 根据订阅链接中的token获取可用订阅
+func (s *SubscriptionService) GetSubscriptionByToken(token string) (*model.Subscription, error) {
+	if !isValidSubscribeToken(token) {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	var subscription model.Subscription
+	if err := db.DB.Where("token = ?", token).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, err
+	}
+
+	if subscription.Status != "active" || !subscription.ExpiredAt.After(time.Now()) {
+		return nil, ErrSubscriptionInactive
+	}
+
+	if subscription.TrafficUsed >= subscription.TotalTrafficLimit() {
+		return nil, ErrTrafficExhausted
+	}
+
+	return &subscription, nil
+}
+
+// GetSubscriptionUsage 获取订阅的上传/下载流量。
+// 已用流量以 TrafficUsed 为准，按订阅累计的上下行比例拆分，保证两者之和与配额计算一致。
+func (s *SubscriptionService) GetSubscriptionUsage(subscription *model.Subscription) (upload, download int64, err error) {
+	used := subscription.TrafficUsed
+	if total := subscription.UploadTotal + subscription.DownloadTotal; total > 0 {
+		upload = int64(float64(used) * float64(subscription.UploadTotal) / float64(total))
+	}
+	return upload, used - upload, nil
+}
+
+// BackfillSubscriptionTrafficTotals 根据尚未清理的流量日志为旧订阅补全累计上下行流量
+func (s *SubscriptionService) BackfillSubscriptionTrafficTotals() error {
+	result := db.DB.Model(&model.Subscription{}).
+		Where("upload_total = 0 AND download_total = 0").
+		Where("EXISTS (SELECT 1 FROM traffic_logs WHERE traffic_logs.subscription_id = subscriptions.id)").
+		Updates(map[string]interface{}{
+			"upload_total": gorm.Expr("(SELECT COALESCE(SUM(upload_bytes), 0) FROM traffic_logs " +
+				"WHERE traffic_logs.subscription_id = subscriptions.id)"),
+			"download_total": gorm.Expr("(SELECT COALESCE(SUM(download_bytes), 0) FROM traffic_logs " +
+				"WHERE traffic_logs.subscription_id = subscriptions.id)"),
+		})
+	if result.Error != nil {
+		return result.Error
 	}
 
+	if result.RowsAffected > 0 {
+		log.Printf("已为 %d 个订阅补全累计流量", result.RowsAffected)
+	}
 	return nil
 }
+
+// isValidSubscribeToken 校验token格式（32位十六进制）
+func isValidSubscribeToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
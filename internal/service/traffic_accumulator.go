@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// 流量累加器使用的 Redis 键:
+// 上报时累加到 pending，同步时整体改名为 flushing 并分配批次号，
+// 入库成功后删除 flushing。批次号在数据库中唯一，重启后重放同一批次不会重复计费。
+const (
+	trafficPendingKey   = "traffic:pending"
+	trafficFlushingKey  = "traffic:flushing"
+	trafficBatchIDKey   = "traffic:flushing:batch"
+	trafficReportPrefix = "traffic:report:"
+	trafficReportTTL    = 24 * time.Hour
+)
+
+// accumulateScript 幂等地累加一次上报的流量
+// KEYS[1] 幂等键 KEYS[2] pending; ARGV[1] 幂等键过期秒数, ARGV[2..] 交替为字段与增量
+var accumulateScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], 1, 'NX', 'EX', ARGV[1]) == false then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	redis.call('HINCRBY', KEYS[2], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+// claimBatchScript 取出待同步的流量批次，上次同步未完成时返回原批次
+// KEYS[1] pending KEYS[2] flushing KEYS[3] 批次号; ARGV[1] 新批次号
+var claimBatchScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	local id = redis.call('GET', KEYS[3])
+	if not id then
+		id = ARGV[1]
+		redis.call('SET', KEYS[3], id)
+	end
+	return id
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('SET', KEYS[3], ARGV[1])
+return ARGV[1]
+`)
+
+// releaseBatchScript 清理已入库的批次，仅当批次号仍为当前批次时删除，
+// 避免延迟的同步删除其他同步刚取出的新批次
+// KEYS[1] flushing KEYS[2] 批次号; ARGV[1] 已入库的批次号
+var releaseBatchScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1], KEYS[2])
+end
+return 0
+`)
+
+// takeUserTrafficScript 取出并删除单个用户待同步的流量计数
+// KEYS[1] pending; ARGV[1] 字段前缀 u:<用户ID>: ARGV[2] 字段前缀 d:<用户ID>:
+var takeUserTrafficScript = redis.NewScript(`
+local taken = {}
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	local prefix = string.sub(field, 1, #ARGV[1])
+	if prefix == ARGV[1] or prefix == ARGV[2] then
+		taken[#taken + 1] = field
+		taken[#taken + 1] = redis.call('HGET', KEYS[1], field)
+		redis.call('HDEL', KEYS[1], field)
+	end
+end
+return taken
+`)
+
+// trafficKey 流量计数的 Redis 字段
+type trafficKey struct {
+	UserID int64
+	NodeID int64
+}
+
+// trafficCounter 同一用户在同一节点上累计的流量
+type trafficCounter struct {
+	Upload   int64
+	Download int64
+}
+
+// trafficField 生成流量计数字段名，direction 为 u(上传) 或 d(下载)
+func trafficField(direction string, userID, nodeID int64) string {
+	return fmt.Sprintf("%s:%d:%d", direction, userID, nodeID)
+}
+
+// parseTrafficFields 将 Redis 哈希中的计数字段汇总为每个用户/节点的流量，忽略无法解析的字段
+func parseTrafficFields(fields map[string]string) map[trafficKey]*trafficCounter {
+	counters := make(map[trafficKey]*trafficCounter)
+	for field, value := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		userID, err1 := strconv.ParseInt(parts[1], 10, 64)
+		nodeID, err2 := strconv.ParseInt(parts[2], 10, 64)
+		bytes, err3 := strconv.ParseInt(value, 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			log.Printf("无法解析的流量计数: %s=%s", field, value)
+			continue
+		}
+
+		key := trafficKey{UserID: userID, NodeID: nodeID}
+		counter, ok := counters[key]
+		if !ok {
+			counter = &trafficCounter{}
+			counters[key] = counter
+		}
+		switch parts[0] {
+		case "u":
+			counter.Upload += bytes
+		case "d":
+			counter.Download += bytes
+		}
+	}
+	return counters
+}
+
+// accumulateTraffic 将一次上报的流量累加到 Redis，返回是否为重复上报。
+// 配额检查在同步入库时进行。
+func accumulateTraffic(nodeID int64, idempotencyKey string, items []TrafficDelta) (bool, error) {
+	args := []interface{}{int(trafficReportTTL / time.Second)}
+	for _, item := range items {
+		if item.Upload > 0 {
+			args = append(args, trafficField("u", item.UserID, nodeID), item.Upload)
+		}
+		if item.Download > 0 {
+			args = append(args, trafficField("d", item.UserID, nodeID), item.Download)
+		}
+	}
+
+	reportKey := fmt.Sprintf("%s%d:%s", trafficReportPrefix, nodeID, idempotencyKey)
+	accepted, err := accumulateScript.Run(context.Background(), cache.RedisClient,
+		[]string{reportKey, trafficPendingKey}, args...).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return accepted == 0, nil
+}
+
+// claimTrafficBatch 取出待同步的流量批次，没有待同步流量时返回空批次号
+func claimTrafficBatch(ctx context.Context) (string, map[trafficKey]*trafficCounter, error) {
+	newBatchID, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	batchID, err := claimBatchScript.Run(ctx, cache.RedisClient,
+		[]string{trafficPendingKey, trafficFlushingKey, trafficBatchIDKey}, newBatchID).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields, err := cache.RedisClient.HGetAll(ctx, trafficFlushingKey).Result()
+	if err != nil {
+		return "", nil, err
+	}
+	return batchID, parseTrafficFields(fields), nil
+}
+
+// takeUserTraffic 取出单个用户待同步的流量，由调用方入库；入库失败时应通过 restoreUserTraffic 放回。
+// 正在同步的批次由 FlushTraffic 负责，不在此处理。
+func takeUserTraffic(ctx context.Context, userID int64) (map[trafficKey]*trafficCounter, error) {
+	values, err := takeUserTrafficScript.Run(ctx, cache.RedisClient, []string{trafficPendingKey},
+		fmt.Sprintf("u:%d:", userID), fmt.Sprintf("d:%d:", userID)).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+	return parseTrafficFields(fields), nil
+}
+
+// restoreUserTraffic 将取出但未入库的流量放回 pending
+func restoreUserTraffic(ctx context.Context, counters map[trafficKey]*trafficCounter) error {
+	pipe := cache.RedisClient.TxPipeline()
+	for key, counter := range counters {
+		if counter.Upload > 0 {
+			pipe.HIncrBy(ctx, trafficPendingKey, trafficField("u", key.UserID, key.NodeID), counter.Upload)
+		}
+		if counter.Download > 0 {
+			pipe.HIncrBy(ctx, trafficPendingKey, trafficField("d", key.UserID, key.NodeID), counter.Download)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// errBatchCommitted 批次已由其他同步入库
+var errBatchCommitted = errors.New("流量批次已入库")
+
+// commitTrafficBatch 将一个批次的流量入库，返回订阅状态变化事件。
+// 批次已入库 (上次同步未来得及清理 Redis，或其他同步并发入库) 时返回 errBatchCommitted。
+func (s *SubscriptionService) commitTrafficBatch(batchID string, counters map[trafficKey]*trafficCounter) ([]NodeUserEvent, error) {
+	var events []NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&model.TrafficFlush{}).Where("batch_id = ?", batchID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errBatchCommitted
+		}
+
+		if err := tx.Create(&model.TrafficFlush{BatchID: batchID, ItemCount: len(counters)}).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return errBatchCommitted
+			}
+			return err
+		}
+
+		for key, counter := range counters {
+			if counter.Upload+counter.Download <= 0 {
+				continue
+			}
+
+			// 流量已实际产生，同步时不再按配额拒绝
+			event, err := s.recordTrafficTx(tx, key.UserID, key.NodeID, counter.Upload, counter.Download, trafficLimitNone)
+			if errors.Is(err, ErrNoActiveSubscription) {
+				log.Printf("用户 %d 没有活跃订阅，丢弃节点 %d 的流量 %d 字节",
+					key.UserID, key.NodeID, counter.Upload+counter.Download)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if event != nil {
+				events = append(events, *event)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// releaseTrafficBatch 删除已入库的批次
+func releaseTrafficBatch(ctx context.Context, batchID string) error {
+	return releaseBatchScript.Run(ctx, cache.RedisClient,
+		[]string{trafficFlushingKey, trafficBatchIDKey}, batchID).Err()
+}
+
+// FlushTraffic 将 Redis 中累计的流量同步到数据库，返回同步的记录数。
+// 未启用 Redis 时流量直接入库，无需同步。
+func (s *SubscriptionService) FlushTraffic() (int, error) {
+	if cache.RedisClient == nil {
+		return 0, nil
+	}
+	ctx := context.Background()
+
+	batchID, counters, err := claimTrafficBatch(ctx)
+	if err != nil || batchID == "" {
+		return 0, err
+	}
+
+	events, err := s.commitTrafficBatch(batchID, counters)
+	committed := errors.Is(err, errBatchCommitted)
+	if err != nil && !committed {
+		return 0, err
+	}
+
+	if err := releaseTrafficBatch(ctx, batchID); err != nil {
+		return 0, err
+	}
+	if committed {
+		return 0, nil
+	}
+
+	publishNodeUserEvents(events...)
+	return len(counters), nil
+}
+
+// RunTrafficFlusher 定期将 Redis 中的流量同步到数据库，直到 ctx 结束
+func (s *SubscriptionService) RunTrafficFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.FlushTraffic(); err != nil {
+				log.Printf("流量同步失败: %v", err)
+			}
+		}
+	}
+}
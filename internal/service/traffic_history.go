@@ -0,0 +1,266 @@
+package service
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+)
+
+// 流量历史的时间粒度
+const (
+	GranularityHour  = "hour"
+	GranularityDay   = "day"
+	GranularityMonth = "month"
+)
+
+// maxHistoryRange 各时间粒度允许查询的最大时间范围
+var maxHistoryRange = map[string]time.Duration{
+	GranularityHour:  31 * 24 * time.Hour,
+	GranularityDay:   366 * 24 * time.Hour,
+	GranularityMonth: 5 * 366 * 24 * time.Hour,
+}
+
+// TrafficHistoryQuery 流量历史查询条件
+type TrafficHistoryQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity string // hour/day/month
+	GroupBy     string // 为 node 时按节点分组
+}
+
+// TrafficPoint 一个时间段内的流量
+type TrafficPoint struct {
+	Time     time.Time `json:"time"`
+	NodeID   int64     `json:"nodeId,omitempty"`
+	NodeName string    `json:"nodeName,omitempty"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Charged  int64     `json:"charged"` // 按节点倍率计入订阅的流量
+}
+
+// TrafficHistory 流量历史
+type TrafficHistory struct {
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	Granularity string         `json:"granularity"`
+	GroupBy     string         `json:"groupBy,omitempty"`
+	Points      []TrafficPoint `json:"points"`
+}
+
+// truncateToBucket 将时间截断到所在时间段的起点 (本地时区)
+func truncateToBucket(t time.Time, granularity string) time.Time {
+	year, month, day := t.Date()
+	switch granularity {
+	case GranularityHour:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+	case GranularityMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// nextBucket 返回下一个时间段的起点
+func nextBucket(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case GranularityHour:
+		return t.Add(time.Hour)
+	case GranularityMonth:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// GetTrafficHistory 按时间段汇总用户的流量，可按节点分组。
+// 不分组时没有流量的时间段补零，便于绘制图表。
+func (s *SubscriptionService) GetTrafficHistory(userID int64, query TrafficHistoryQuery) (*TrafficHistory, error) {
+	maxRange, ok := maxHistoryRange[query.Granularity]
+	if !ok {
+		return nil, errors.New("无效的时间粒度")
+	}
+	if query.GroupBy != "" && query.GroupBy != "node" {
+		return nil, errors.New("无效的分组方式")
+	}
+	if !query.From.Before(query.To) {
+		return nil, errors.New("开始时间必须早于结束时间")
+	}
+	if query.To.Sub(query.From) > maxRange {
+		return nil, errors.New("查询时间范围过大")
+	}
+
+	rows, err := loadTrafficRows(userID, query.From, query.To, query.Granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	type bucketKey struct {
+		Time   int64
+		NodeID int64
+	}
+	buckets := make(map[bucketKey]*TrafficPoint)
+	for _, r := range rows {
+		start := truncateToBucket(r.Time.In(query.From.Location()), query.Granularity)
+		key := bucketKey{Time: start.Unix()}
+		if query.GroupBy == "node" {
+			key.NodeID = r.NodeID
+		}
+
+		point, ok := buckets[key]
+		if !ok {
+			point = &TrafficPoint{Time: start, NodeID: key.NodeID}
+			buckets[key] = point
+		}
+		point.Upload += r.Upload
+		point.Download += r.Download
+		point.Charged += r.Charged
+	}
+
+	if query.GroupBy != "node" {
+		// 补齐没有流量的时间段
+		for t := truncateToBucket(query.From, query.Granularity); t.Before(query.To); t = nextBucket(t, query.Granularity) {
+			key := bucketKey{Time: t.Unix()}
+			if _, ok := buckets[key]; !ok {
+				buckets[key] = &TrafficPoint{Time: t}
+			}
+		}
+	}
+
+	points := make([]TrafficPoint, 0, len(buckets))
+	for _, point := range buckets {
+		points = append(points, *point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if !points[i].Time.Equal(points[j].Time) {
+			return points[i].Time.Before(points[j].Time)
+		}
+		return points[i].NodeID < points[j].NodeID
+	})
+
+	if query.GroupBy == "node" {
+		if err := fillNodeNames(points); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TrafficHistory{
+		From:        query.From,
+		To:          query.To,
+		Granularity: query.Granularity,
+		GroupBy:     query.GroupBy,
+		Points:      points,
+	}, nil
+}
+
+// fillNodeNames 填充流量数据的节点名称
+func fillNodeNames(points []TrafficPoint) error {
+	ids := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for _, p := range points {
+		if !seen[p.NodeID] {
+			seen[p.NodeID] = true
+			ids = append(ids, p.NodeID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var nodes []model.Node
+	if err := db.DB.Select("id", "name").Where("id IN ?", ids).Find(&nodes).Error; err != nil {
+		return err
+	}
+	names := make(map[int64]string, len(nodes))
+	for _, n := range nodes {
+		names[n.ID] = n.Name
+	}
+	for i := range points {
+		points[i].NodeName = names[points[i].NodeID]
+	}
+	return nil
+}
+
+// trafficRow 一条带时间的流量记录，来自汇总表或原始日志
+type trafficRow struct {
+	Time     time.Time
+	NodeID   int64
+	Upload   int64
+	Download int64
+	Charged  int64
+}
+
+// loadTrafficRows 读取用户在 [from, to) 内的流量:
+// 已汇总的部分读取 traffic_daily / traffic_hourly，尚未汇总的部分读取 traffic_logs。
+// 汇总表按服务器时区的小时/天对齐，from 先对齐到所在时间段的起点，保证第一个时间段完整。
+func loadTrafficRows(userID int64, from, to time.Time, granularity string) ([]trafficRow, error) {
+	from = truncateToBucket(from.In(time.Local), granularity)
+
+	hourlyWatermark, err := getRollupWatermark(db.DB, rollupHourly)
+	if err != nil {
+		return nil, err
+	}
+	dailyWatermark := time.Time{}
+	if granularity != GranularityHour {
+		if dailyWatermark, err = getRollupWatermark(db.DB, rollupDaily); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := make([]trafficRow, 0)
+	cursor := from
+
+	// 按天汇总
+	if end := minTime(to, dailyWatermark); cursor.Before(end) {
+		var daily []model.TrafficDaily
+		if err := db.DB.Where("user_id = ? AND bucket_start >= ? AND bucket_start < ?", userID, cursor, end).
+			Find(&daily).Error; err != nil {
+			return nil, err
+		}
+		for _, d := range daily {
+			rows = append(rows, trafficRow{Time: d.BucketStart, NodeID: d.NodeID,
+				Upload: d.UploadBytes, Download: d.DownloadBytes, Charged: d.ChargedBytes})
+		}
+		cursor = end
+	}
+
+	// 按小时汇总
+	if end := minTime(to, hourlyWatermark); cursor.Before(end) {
+		var hourly []model.TrafficHourly
+		if err := db.DB.Where("user_id = ? AND bucket_start >= ? AND bucket_start < ?", userID, cursor, end).
+			Find(&hourly).Error; err != nil {
+			return nil, err
+		}
+		for _, h := range hourly {
+			rows = append(rows, trafficRow{Time: h.BucketStart, NodeID: h.NodeID,
+				Upload: h.UploadBytes, Download: h.DownloadBytes, Charged: h.ChargedBytes})
+		}
+		cursor = end
+	}
+
+	// 尚未汇总的原始日志
+	if cursor.Before(to) {
+		var logs []model.TrafficLog
+		if err := db.DB.Select("node_id", "upload_bytes", "download_bytes", "charged_bytes", "recorded_at").
+			Where("user_id = ? AND recorded_at >= ? AND recorded_at < ?", userID, cursor, to).
+			Find(&logs).Error; err != nil {
+			return nil, err
+		}
+		for _, l := range logs {
+			rows = append(rows, trafficRow{Time: l.RecordedAt, NodeID: l.NodeID,
+				Upload: l.UploadBytes, Download: l.DownloadBytes, Charged: l.ChargedBytes})
+		}
+	}
+
+	return rows, nil
+}
+
+// minTime 返回较早的时间
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetTrafficPacks 获取可购买的流量包
+func (s *SubscriptionService) GetTrafficPacks() ([]model.TrafficPack, error) {
+	var packs []model.TrafficPack
+	if err := db.DB.Where("is_active = ?", true).
+		Order("sort_order ASC, price ASC").
+		Find(&packs).Error; err != nil {
+		return nil, err
+	}
+	return packs, nil
+}
+
+// PurchaseTrafficPack 使用余额为订阅购买流量包，流量包在订阅当前的到期时间失效。
+// 订阅因流量用完而暂停时，购买后立即恢复。
+func (s *SubscriptionService) PurchaseTrafficPack(userID, subscriptionID, packID int64) (*model.TrafficPackPurchase, error) {
+	var purchase *model.TrafficPackPurchase
+	var event *NodeUserEvent
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var subscription model.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, subscriptionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("订阅不存在")
+			}
+			return err
+		}
+
+		if subscription.UserID != userID {
+			return errors.New("无权操作此订阅")
+		}
+
+		now := time.Now()
+		if (subscription.Status != "active" && subscription.Status != "exhausted") || !subscription.ExpiredAt.After(now) {
+			return errors.New("订阅已失效，无法购买流量包")
+		}
+
+		var pack model.TrafficPack
+		if err := tx.Where("id = ? AND is_active = ?", packID, true).First(&pack).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("流量包不存在")
+			}
+			return err
+		}
+
+		// 扣除余额
+		var user model.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		if user.Balance < pack.Price {
+			return errors.New("余额不足")
+		}
+
+		if err := tx.Model(&user).Update("balance", gorm.Expr("balance - ?", pack.Price)).Error; err != nil {
+			return err
+		}
+
+		// 创建订单记录
+		order := model.Order{
+			UserID:         userID,
+			OrderNo:        generateOrderNo(userID),
+			Type:           "traffic_pack",
+			SubscriptionID: &subscription.ID,
+			Amount:         pack.Price,
+			PaymentMethod:  "balance",
+			Status:         "paid",
+			PaidAt:         &now,
+		}
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+
+		purchase = &model.TrafficPackPurchase{
+			UserID:         userID,
+			SubscriptionID: subscription.ID,
+			PackID:         pack.ID,
+			OrderID:        order.ID,
+			Traffic:        pack.Traffic,
+			Remaining:      pack.Traffic,
+			ExpiredAt:      subscription.ExpiredAt,
+		}
+		if err := tx.Create(purchase).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&subscription).
+			Update("extra_traffic", gorm.Expr("extra_traffic + ?", pack.Traffic)).Error; err != nil {
+			return err
+		}
+		subscription.ExtraTraffic += pack.Traffic
+
+		if subscription.Status == "exhausted" {
+			active, err := s.restoreSubscriptionTx(tx, &subscription, now)
+			if err != nil {
+				return err
+			}
+			if active {
+				event = &NodeUserEvent{UserID: userID, SubscriptionID: subscription.ID, Status: subscription.Status}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if event != nil {
+		publishNodeUserEvents(*event)
+	}
+	return purchase, nil
+}
+
+// subscriptionPacksTx 获取订阅尚有剩余流量或未处理到期的流量包，按到期时间先后排序
+func subscriptionPacksTx(tx *gorm.DB, subscriptionID int64) ([]model.TrafficPackPurchase, error) {
+	var purchases []model.TrafficPackPurchase
+	err := tx.Where("subscription_id = ?", subscriptionID).
+		Where("remaining > 0 OR expired = ?", false).
+		Order("expired_at ASC, id ASC").
+		Find(&purchases).Error
+	return purchases, err
+}
+
+// allocatePackUsage 将超出套餐流量的用量按顺序分摊到流量包，返回每个流量包分摊到的流量
+func allocatePackUsage(purchases []model.TrafficPackPurchase, overage int64) []int64 {
+	allocated := make([]int64, len(purchases))
+	for i, p := range purchases {
+		if overage <= 0 {
+			break
+		}
+		allocated[i] = min(p.Remaining, overage)
+		overage -= allocated[i]
+	}
+	return allocated
+}
+
+// consumeTrafficPacksTx 在流量重置前扣除本周期超出套餐流量所消耗的流量包，返回订阅剩余的额外流量
+func consumeTrafficPacksTx(tx *gorm.DB, sub *model.Subscription) (int64, error) {
+	purchases, err := subscriptionPacksTx(tx, sub.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	allocated := allocatePackUsage(purchases, sub.TrafficUsed-sub.TrafficLimit)
+	extra := sub.ExtraTraffic
+	for i := range purchases {
+		if allocated[i] == 0 {
+			continue
+		}
+		if err := tx.Model(&purchases[i]).
+			Update("remaining", purchases[i].Remaining-allocated[i]).Error; err != nil {
+			return 0, err
+		}
+		extra -= allocated[i]
+	}
+
+	return max(extra, 0), nil
+}
+
+// expireTrafficPacksTx 扣除订阅已到期流量包的剩余流量，本周期已用掉的部分保留到流量重置时扣除
+func expireTrafficPacksTx(tx *gorm.DB, subscriptionID int64, now time.Time) error {
+	var sub model.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sub, subscriptionID).Error; err != nil {
+		return err
+	}
+
+	purchases, err := subscriptionPacksTx(tx, sub.ID)
+	if err != nil {
+		return err
+	}
+
+	allocated := allocatePackUsage(purchases, sub.TrafficUsed-sub.TrafficLimit)
+	var expired int64
+	for i := range purchases {
+		p := &purchases[i]
+		if p.Expired || p.ExpiredAt.After(now) {
+			continue
+		}
+		expired += p.Remaining - allocated[i]
+		if err := tx.Model(p).Updates(map[string]interface{}{
+			"remaining": allocated[i],
+			"expired":   true,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	if expired == 0 {
+		return nil
+	}
+	return tx.Model(&sub).Update("extra_traffic", max(sub.ExtraTraffic-expired, 0)).Error
+}
+
+// ExpireTrafficPacksOnce 处理所有已到期的流量包，返回涉及的订阅数
+func (s *SubscriptionService) ExpireTrafficPacksOnce(now time.Time) (int, error) {
+	var subscriptionIDs []int64
+	if err := db.DB.Model(&model.TrafficPackPurchase{}).
+		Where("expired = ? AND expired_at <= ?", false, now).
+		Distinct().Pluck("subscription_id", &subscriptionIDs).Error; err != nil {
+		return 0, err
+	}
+
+	for _, id := range subscriptionIDs {
+		if err := db.DB.Transaction(func(tx *gorm.DB) error {
+			return expireTrafficPacksTx(tx, id, now)
+		}); err != nil {
+			log.Printf("订阅 %d 流量包到期处理失败: %v", id, err)
+		}
+	}
+	return len(subscriptionIDs), nil
+}
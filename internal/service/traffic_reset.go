@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// trafficResetDay 每月流量重置日 (monthly 方式)，超过当月天数时在月末重置
+var trafficResetDay = 1
+
+// InitTrafficReset 设置每月流量重置日
+func InitTrafficReset(resetDay int) {
+	if resetDay >= 1 && resetDay <= 31 {
+		trafficResetDay = resetDay
+	}
+}
+
+// monthDay 返回指定年月的第 day 天零点，超过当月天数时取月末
+func monthDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// lastResetBoundary 返回不晚于 now 的最近一个每月第 day 天零点
+func lastResetBoundary(now time.Time, day int) time.Time {
+	year, month, _ := now.Date()
+	boundary := monthDay(year, month, day, now.Location())
+	if boundary.After(now) {
+		boundary = monthDay(year, month-1, day, now.Location())
+	}
+	return boundary
+}
+
+// maxUnresetDuration 总时长不超过一个月的订阅整个订阅期为一个流量周期，按月重置只会让这类订阅多得一份流量。
+// 按订阅实际的起止时间计算 (续费会延长到期时间)，多留 1 小时容纳夏令时切换。
+const maxUnresetDuration = 31*24*time.Hour + time.Hour
+
+// trafficResetBoundary 返回订阅当前应处于的流量周期起点，订阅不重置时返回 false
+func trafficResetBoundary(sub *model.Subscription, now time.Time) (time.Time, bool) {
+	if sub.ExpiredAt.Sub(sub.StartedAt) <= maxUnresetDuration {
+		return time.Time{}, false
+	}
+
+	mode := model.TrafficResetAnniversary
+	if sub.Plan != nil {
+		if sub.Plan.TrafficResetMode != "" {
+			mode = sub.Plan.TrafficResetMode
+		}
+	}
+
+	switch mode {
+	case model.TrafficResetMonthly:
+		return lastResetBoundary(now, trafficResetDay), true
+	case model.TrafficResetAnniversary:
+		return lastResetBoundary(now, sub.StartedAt.In(now.Location()).Day()), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// ResetTrafficOnce 重置已进入新流量周期的活跃订阅的已用流量，返回重置的订阅数。
+// 重置前的用量归档到 traffic_usage_periods，同一周期只会重置一次，停机后补跑不会重复重置。
+// 因流量用完而暂停的订阅在重置后恢复节点权限。
+func (s *SubscriptionService) ResetTrafficOnce(now time.Time) (int, error) {
+	// 先同步 Redis 中的流量，避免上一周期的流量计入新周期
+	if _, err := s.FlushTraffic(); err != nil {
+		return 0, err
+	}
+
+	var subscriptions []model.Subscription
+	if err := db.DB.Preload("Plan").
+		Where("status IN ? AND expired_at > ?", []string{"active", "exhausted"}, now).
+		Find(&subscriptions).Error; err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	events := make([]NodeUserEvent, 0)
+	for i := range subscriptions {
+		sub := &subscriptions[i]
+		boundary, ok := trafficResetBoundary(sub, now)
+		if !ok {
+			continue
+		}
+
+		periodStart := sub.StartedAt
+		if sub.LastResetAt != nil && sub.LastResetAt.After(periodStart) {
+			periodStart = *sub.LastResetAt
+		}
+		if !boundary.After(periodStart) {
+			continue
+		}
+
+		done, event, err := s.resetSubscriptionTraffic(sub.ID, boundary, now)
+		if err != nil {
+			log.Printf("订阅 %d 流量重置失败: %v", sub.ID, err)
+			continue
+		}
+		if done {
+			reset++
+		}
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	if reset > 0 && len(events) == 0 {
+		InvalidateNodeUsers()
+	}
+	publishNodeUserEvents(events...)
+	return reset, nil
+}
+
+// resetSubscriptionTraffic 归档订阅当前周期的用量并清零，boundary 为新周期的起点。
+// 流量用完的订阅会恢复为 active，此时返回状态变化事件。
+func (s *SubscriptionService) resetSubscriptionTraffic(subscriptionID int64, boundary, now time.Time) (bool, *NodeUserEvent, error) {
+	var done bool
+	var event *NodeUserEvent
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var sub model.Subscription
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sub, subscriptionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		periodStart := sub.StartedAt
+		if sub.LastResetAt != nil && sub.LastResetAt.After(periodStart) {
+			periodStart = *sub.LastResetAt
+		}
+		if !boundary.After(periodStart) {
+			// 已被其他实例重置
+			return nil
+		}
+
+		period := model.TrafficUsagePeriod{
+			SubscriptionID: sub.ID,
+			UserID:         sub.UserID,
+			PeriodStart:    periodStart,
+			PeriodEnd:      boundary,
+			TrafficUsed:    sub.TrafficUsed,
+			TrafficLimit:   sub.TotalTrafficLimit(),
+		}
+		if err := tx.Create(&period).Error; err != nil {
+			return err
+		}
+
+		// 本周期超出套餐流量的部分从流量包中扣除，流量包剩余流量延续到下个周期
+		extra, err := consumeTrafficPacksTx(tx, &sub)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&sub).Updates(map[string]interface{}{
+			"traffic_used":  0,
+			"extra_traffic": extra,
+			"last_reset_at": boundary,
+		}).Error; err != nil {
+			return err
+		}
+		done = true
+
+		if sub.Status == "exhausted" {
+			sub.TrafficUsed = 0
+			sub.ExtraTraffic = extra
+			active, err := s.restoreSubscriptionTx(tx, &sub, now)
+			if err != nil {
+				return err
+			}
+			if active {
+				event = &NodeUserEvent{UserID: sub.UserID, SubscriptionID: sub.ID, Status: sub.Status}
+			}
+		}
+		return nil
+	})
+
+	return done, event, err
+}
+
+// RunTrafficReset 启动时立即检查一次，之后定期检查并重置进入新周期的订阅流量，直到 ctx 结束
+func (s *SubscriptionService) RunTrafficReset(ctx context.Context, interval time.Duration) {
+	resetOnce := func() {
+		n, err := s.ResetTrafficOnce(time.Now())
+		if err != nil {
+			log.Printf("流量重置失败: %v", err)
+			return
+		}
+		if n > 0 {
+			log.Printf("已重置 %d 个订阅的流量", n)
+		}
+	}
+
+	resetOnce()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resetOnce()
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 流量汇总进度名称
+const (
+	rollupHourly = "hourly"
+	rollupDaily  = "daily"
+)
+
+// rollupLag 汇总时预留的延迟，等待仍在提交中的流量日志
+const rollupLag = 10 * time.Minute
+
+// maxRollupHoursPerRun 单次最多汇总的小时数，首次启用时分多次追赶历史数据
+const maxRollupHoursPerRun = 24 * 7
+
+// trafficRetention 原始流量日志和小时汇总的保留时间，按天汇总永久保留
+var trafficRetention = struct {
+	raw    time.Duration
+	hourly time.Duration
+}{
+	raw:    30 * 24 * time.Hour,
+	hourly: 90 * 24 * time.Hour,
+}
+
+// InitTrafficRetention 设置原始流量日志和小时汇总的保留天数
+func InitTrafficRetention(rawDays, hourlyDays int) {
+	if rawDays > 0 {
+		trafficRetention.raw = time.Duration(rawDays) * 24 * time.Hour
+	}
+	if hourlyDays > 0 {
+		trafficRetention.hourly = time.Duration(hourlyDays) * 24 * time.Hour
+	}
+}
+
+// trafficBucketKey 汇总时的分组键
+type trafficBucketKey struct {
+	UserID int64
+	NodeID int64
+}
+
+// trafficBucket 汇总的流量
+type trafficBucket struct {
+	Upload   int64
+	Download int64
+	Charged  int64
+}
+
+// getRollupWatermark 获取汇总进度，未开始汇总时返回零值
+func getRollupWatermark(tx *gorm.DB, name string) (time.Time, error) {
+	var state model.TrafficRollupState
+	if err := tx.First(&state, "name = ?", name).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return state.Watermark.In(time.Local), nil
+}
+
+// setRollupWatermark 保存汇总进度
+func setRollupWatermark(tx *gorm.DB, name string, watermark time.Time) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"watermark", "updated_at"}),
+	}).Create(&model.TrafficRollupState{Name: name, Watermark: watermark}).Error
+}
+
+// RollupTrafficOnce 汇总已完成的小时和天的流量，并清理过期的原始日志和小时汇总。
+// 每个时间段在一个事务中汇总并推进进度，重复执行结果相同。
+func (s *SubscriptionService) RollupTrafficOnce(now time.Time) error {
+	now = now.In(time.Local)
+
+	hourlyEnd := truncateToBucket(now.Add(-rollupLag), GranularityHour)
+	hourlyWatermark, err := s.rollupHours(hourlyEnd)
+	if err != nil {
+		return err
+	}
+
+	dailyWatermark, err := s.rollupDays(truncateToBucket(hourlyWatermark, GranularityDay))
+	if err != nil {
+		return err
+	}
+
+	return s.pruneTraffic(now, hourlyWatermark, dailyWatermark)
+}
+
+// rollupHours 将 traffic_logs 逐小时汇总到 traffic_hourly，返回新的汇总进度
+func (s *SubscriptionService) rollupHours(end time.Time) (time.Time, error) {
+	watermark, err := getRollupWatermark(db.DB, rollupHourly)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if watermark.IsZero() {
+		// 首次汇总从最早的流量日志开始
+		var first model.TrafficLog
+		err := db.DB.Select("recorded_at").Order("recorded_at ASC").First(&first).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return end, setRollupWatermark(db.DB, rollupHourly, end)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		watermark = truncateToBucket(first.RecordedAt.In(time.Local), GranularityHour)
+	}
+
+	for i := 0; i < maxRollupHoursPerRun && watermark.Before(end); i++ {
+		start := watermark
+		next := start.Add(time.Hour)
+
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			var logs []model.TrafficLog
+			if err := tx.Select("user_id", "node_id", "upload_bytes", "download_bytes", "charged_bytes").
+				Where("recorded_at >= ? AND recorded_at < ?", start, next).
+				Find(&logs).Error; err != nil {
+				return err
+			}
+
+			buckets := make(map[trafficBucketKey]*trafficBucket)
+			for _, l := range logs {
+				key := trafficBucketKey{UserID: l.UserID, NodeID: l.NodeID}
+				b, ok := buckets[key]
+				if !ok {
+					b = &trafficBucket{}
+					buckets[key] = b
+				}
+				b.Upload += l.UploadBytes
+				b.Download += l.DownloadBytes
+				b.Charged += l.ChargedBytes
+			}
+
+			for key, b := range buckets {
+				row := model.TrafficHourly{
+					UserID:        key.UserID,
+					NodeID:        key.NodeID,
+					BucketStart:   start,
+					UploadBytes:   b.Upload,
+					DownloadBytes: b.Download,
+					ChargedBytes:  b.Charged,
+				}
+				if err := upsertRollup(tx, &row); err != nil {
+					return err
+				}
+			}
+
+			return setRollupWatermark(tx, rollupHourly, next)
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+		watermark = next
+	}
+
+	return watermark, nil
+}
+
+// rollupDays 将 traffic_hourly 逐天汇总到 traffic_daily，返回新的汇总进度
+func (s *SubscriptionService) rollupDays(end time.Time) (time.Time, error) {
+	watermark, err := getRollupWatermark(db.DB, rollupDaily)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if watermark.IsZero() {
+		var first model.TrafficHourly
+		err := db.DB.Select("bucket_start").Order("bucket_start ASC").First(&first).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return end, setRollupWatermark(db.DB, rollupDaily, end)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		watermark = truncateToBucket(first.BucketStart.In(time.Local), GranularityDay)
+	}
+
+	for watermark.Before(end) {
+		start := watermark
+		next := start.AddDate(0, 0, 1)
+
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			var rows []model.TrafficHourly
+			if err := tx.Where("bucket_start >= ? AND bucket_start < ?", start, next).
+				Find(&rows).Error; err != nil {
+				return err
+			}
+
+			buckets := make(map[trafficBucketKey]*trafficBucket)
+			for _, r := range rows {
+				key := trafficBucketKey{UserID: r.UserID, NodeID: r.NodeID}
+				b, ok := buckets[key]
+				if !ok {
+					b = &trafficBucket{}
+					buckets[key] = b
+				}
+				b.Upload += r.UploadBytes
+				b.Download += r.DownloadBytes
+				b.Charged += r.ChargedBytes
+			}
+
+			for key, b := range buckets {
+				row := model.TrafficDaily{
+					UserID:        key.UserID,
+					NodeID:        key.NodeID,
+					BucketStart:   start,
+					UploadBytes:   b.Upload,
+					DownloadBytes: b.Download,
+					ChargedBytes:  b.Charged,
+				}
+				if err := upsertRollup(tx, &row); err != nil {
+					return err
+				}
+			}
+
+			return setRollupWatermark(tx, rollupDaily, next)
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+		watermark = next
+	}
+
+	return watermark, nil
+}
+
+// upsertRollup 写入汇总行，已存在时覆盖为重新汇总的结果
+func upsertRollup(tx *gorm.DB, row interface{}) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "bucket_start"}, {Name: "node_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"upload_bytes", "download_bytes", "charged_bytes"}),
+	}).Create(row).Error
+}
+
+// pruneTraffic 清理超过保留时间且已汇总的原始日志和小时汇总
+func (s *SubscriptionService) pruneTraffic(now, hourlyWatermark, dailyWatermark time.Time) error {
+	rawCutoff := now.Add(-trafficRetention.raw)
+	if hourlyWatermark.Before(rawCutoff) {
+		rawCutoff = hourlyWatermark
+	}
+
+	// 分区表直接删除整月的分区
+	if n, err := db.DropTrafficLogPartitionsBefore(rawCutoff); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("已删除 %d 个过期的流量日志分区", n)
+	}
+
+	if err := db.DB.Where("recorded_at < ?", rawCutoff).Delete(&model.TrafficLog{}).Error; err != nil {
+		return err
+	}
+
+	hourlyCutoff := now.Add(-trafficRetention.hourly)
+	if dailyWatermark.Before(hourlyCutoff) {
+		hourlyCutoff = dailyWatermark
+	}
+	if err := db.DB.Where("bucket_start < ?", hourlyCutoff).Delete(&model.TrafficHourly{}).Error; err != nil {
+		return err
+	}
+
+	// 预先创建后续月份的分区
+	return db.EnsureTrafficLogPartitions(now, 2)
+}
+
+// RunTrafficRollup 定期汇总流量并清理过期日志，直到 ctx 结束
+func (s *SubscriptionService) RunTrafficRollup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.RollupTrafficOnce(time.Now()); err != nil {
+				log.Printf("流量汇总失败: %v", err)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"log"
 
 	"github.com/mariclezhang/vps_backend/internal/model"
 	"github.com/mariclezhang/vps_backend/internal/util"
@@ -125,3 +126,47 @@ func (s *UserService) DeductBalance(userID int64, amount float64) error {
 		return nil
 	})
 }
+
+// SetSpeedLimitOverride 设置用户单独的上传/下载限速 (Mbps)，为 nil 时恢复使用套餐限速
+func (s *UserService) SetSpeedLimitOverride(userID int64, upload, download *int64) error {
+	if (upload != nil && *upload < 0) || (download != nil && *download < 0) {
+		return errors.New("限速不能为负数")
+	}
+
+	result := db.DB.Model(&model.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"upload_speed_limit":   upload,
+		"download_speed_limit": download,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("用户不存在")
+	}
+
+	InvalidateNodeUsers()
+	return nil
+}
+
+// BackfillUserUUIDs 为旧用户补全节点连接凭证
+func (s *UserService) BackfillUserUUIDs() error {
+	var users []model.User
+	if err := db.DB.Select("id").Where("uuid IS NULL OR uuid = ?", "").Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		id, err := model.NewUserUUID()
+		if err != nil {
+			return err
+		}
+		if err := db.DB.Model(&user).Update("uuid", id).Error; err != nil {
+			return err
+		}
+	}
+
+	if len(users) > 0 {
+		log.Printf("已为 %d 个用户补全连接凭证", len(users))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package subscribe
+
+import (
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Clash 策略组名称
+const (
+	clashGroupSelect = "节点选择"
+	clashGroupAuto   = "自动选择"
+)
+
+// clashTestURL url-test 策略组使用的测速地址
+const clashTestURL = "http://www.gstatic.com/generate_204"
+
+// clashBaseRules 基础分流规则，局域网及国内流量直连，其余走代理
+var clashBaseRules = []string{
+	"DOMAIN-SUFFIX,local,DIRECT",
+	"IP-CIDR,127.0.0.0/8,DIRECT,no-resolve",
+	"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve",
+	"IP-CIDR,172.16.0.0/12,DIRECT,no-resolve",
+	"IP-CIDR,192.168.0.0/16,DIRECT,no-resolve",
+	"IP-CIDR,100.64.0.0/10,DIRECT,no-resolve",
+	"IP-CIDR6,::1/128,DIRECT,no-resolve",
+	"IP-CIDR6,fc00::/7,DIRECT,no-resolve",
+	"GEOIP,CN,DIRECT",
+	"MATCH," + clashGroupSelect,
+}
+
+// ClashRenderer 渲染 Clash.Meta (mihomo) YAML 配置
+type ClashRenderer struct{}
+
+type clashConfig struct {
+	MixedPort   int          `yaml:"mixed-port"`
+	AllowLan    bool         `yaml:"allow-lan"`
+	Mode        string       `yaml:"mode"`
+	LogLevel    string       `yaml:"log-level"`
+	Proxies     []clashProxy `yaml:"proxies"`
+	ProxyGroups []clashGroup `yaml:"proxy-groups"`
+	Rules       []string     `yaml:"rules"`
+}
+
+type clashProxy struct {
+	Name           string         `yaml:"name"`
+	Type           string         `yaml:"type"`
+	Server         string         `yaml:"server"`
+	Port           int            `yaml:"port"`
+	UUID           string         `yaml:"uuid,omitempty"`
+	AlterID        *int           `yaml:"alterId,omitempty"`
+	Cipher         string         `yaml:"cipher,omitempty"`
+	Password       string         `yaml:"password,omitempty"`
+	Flow           string         `yaml:"flow,omitempty"`
+	UDP            bool           `yaml:"udp"`
+	TLS            bool           `yaml:"tls,omitempty"`
+	ServerName     string         `yaml:"servername,omitempty"`
+	SNI            string         `yaml:"sni,omitempty"`
+	SkipCertVerify bool           `yaml:"skip-cert-verify,omitempty"`
+	Network        string         `yaml:"network,omitempty"`
+	WSOpts         *clashWSOpts   `yaml:"ws-opts,omitempty"`
+	H2Opts         *clashH2Opts   `yaml:"h2-opts,omitempty"`
+	GrpcOpts       *clashGrpcOpts `yaml:"grpc-opts,omitempty"`
+}
+
+type clashWSOpts struct {
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+type clashH2Opts struct {
+	Host []string `yaml:"host,omitempty"`
+	Path string   `yaml:"path"`
+}
+
+type clashGrpcOpts struct {
+	ServiceName string `yaml:"grpc-service-name"`
+}
+
+type clashGroup struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	URL       string   `yaml:"url,omitempty"`
+	Interval  int      `yaml:"interval,omitempty"`
+	Tolerance int      `yaml:"tolerance,omitempty"`
+	Proxies   []string `yaml:"proxies"`
+}
+
+// ContentType 返回响应的 Content-Type
+func (ClashRenderer) ContentType() string {
+	return "text/yaml; charset=utf-8"
+}
+
+// Render 生成包含 proxies、proxy-groups 与基础规则的完整配置
+func (ClashRenderer) Render(proxies []Proxy) ([]byte, error) {
+	cfg := clashConfig{
+		MixedPort: 7890,
+		Mode:      "rule",
+		LogLevel:  "info",
+		Proxies:   make([]clashProxy, 0, len(proxies)),
+		Rules:     clashBaseRules,
+	}
+
+	names := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		cfg.Proxies = append(cfg.Proxies, toClashProxy(p))
+		names = append(names, p.Name)
+	}
+
+	locations, byLocation := groupByLocation(proxies)
+
+	// 节点选择：自动选择 + 各地区分组 + 全部节点
+	selectProxies := append([]string{clashGroupAuto}, locations...)
+	selectProxies = append(selectProxies, names...)
+
+	cfg.ProxyGroups = append(cfg.ProxyGroups,
+		clashGroup{Name: clashGroupSelect, Type: "select", Proxies: selectProxies},
+		clashGroup{Name: clashGroupAuto, Type: "url-test", URL: clashTestURL, Interval: 300, Tolerance: 50, Proxies: nonEmpty(names)},
+	)
+	for _, location := range locations {
+		cfg.ProxyGroups = append(cfg.ProxyGroups, clashGroup{
+			Name:    location,
+			Type:    "select",
+			Proxies: byLocation[location],
+		})
+	}
+
+	return yaml.Marshal(cfg)
+}
+
+// toClashProxy 转换为 Clash.Meta 的代理配置
+func toClashProxy(p Proxy) clashProxy {
+	cp := clashProxy{
+		Name:   p.Name,
+		Server: p.Server,
+		Port:   p.Port,
+		UDP:    true,
+	}
+
+	switch p.Protocol {
+	case model.NodeProtocolVMess:
+		alterID := p.AlterID
+		cp.Type = "vmess"
+		cp.UUID = p.UUID
+		cp.AlterID = &alterID
+		cp.Cipher = p.Security
+	case model.NodeProtocolVLESS:
+		cp.Type = "vless"
+		cp.UUID = p.UUID
+		cp.Flow = p.Flow
+	case model.NodeProtocolTrojan:
+		cp.Type = "trojan"
+		cp.Password = p.Password
+	case model.NodeProtocolShadowsocks:
+		cp.Type = "ss"
+		cp.Cipher = p.Method
+		cp.Password = p.Password
+	}
+
+	if p.TLS {
+		// trojan 使用 sni，vmess/vless 使用 servername
+		if p.Protocol == model.NodeProtocolTrojan {
+			cp.SNI = p.SNI
+		} else {
+			cp.TLS = true
+			cp.ServerName = p.SNI
+		}
+		cp.SkipCertVerify = p.AllowInsecure
+	}
+
+	if p.Protocol != model.NodeProtocolShadowsocks && p.Network != "tcp" {
+		cp.Network = p.Network
+	}
+
+	switch p.Network {
+	case "ws":
+		cp.WSOpts = &clashWSOpts{Path: p.Path}
+		if p.Host != "" {
+			cp.WSOpts.Headers = map[string]string{"Host": p.Host}
+		}
+	case "h2":
+		cp.H2Opts = &clashH2Opts{Path: p.Path}
+		if p.Host != "" {
+			cp.H2Opts.Host = []string{p.Host}
+		}
+	case "grpc":
+		cp.GrpcOpts = &clashGrpcOpts{ServiceName: p.ServiceName}
+	}
+
+	return cp
+}
+
+// groupByLocation 按节点地区分组，返回地区列表（按出现顺序）及各地区的节点名称
+func groupByLocation(proxies []Proxy) ([]string, map[string][]string) {
+	var locations []string
+	byLocation := make(map[string][]string)
+	for _, p := range proxies {
+		if p.Location == "" {
+			continue
+		}
+		if _, ok := byLocation[p.Location]; !ok {
+			locations = append(locations, p.Location)
+		}
+		byLocation[p.Location] = append(byLocation[p.Location], p.Name)
+	}
+	return locations, byLocation
+}
+
+// nonEmpty 策略组不能为空，没有节点时回退为 DIRECT
+func nonEmpty(names []string) []string {
+	if len(names) == 0 {
+		return []string{"DIRECT"}
+	}
+	return names
+}
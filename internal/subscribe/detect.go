@@ -0,0 +1,30 @@
+package subscribe
+
+import "strings"
+
+// uaTargets User-Agent 关键字到输出格式的映射，按顺序匹配
+var uaTargets = []struct {
+	keyword string
+	target  string
+}{
+	{"sing-box", TargetSingbox},
+	{"clash", TargetClash},
+	{"mihomo", TargetClash},
+	{"stash", TargetClash},
+	{"surge", TargetSurge},
+	{"quantumult", TargetQuantumultX},
+	{"shadowrocket", TargetV2rayN},
+	{"v2rayn", TargetV2rayN},
+	{"v2rayng", TargetV2rayN},
+}
+
+// DetectTarget 根据客户端 User-Agent 推断订阅输出格式，无法识别时返回 base64 分享链接
+func DetectTarget(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	for _, t := range uaTargets {
+		if strings.Contains(ua, t.keyword) {
+			return t.target
+		}
+	}
+	return TargetV2rayN
+}
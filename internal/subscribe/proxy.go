@@ -0,0 +1,288 @@
+package subscribe
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// shadowsocksMethods 支持的 shadowsocks 加密方式
+var shadowsocksMethods = map[string]bool{
+	"aes-128-gcm":                   true,
+	"aes-256-gcm":                   true,
+	"chacha20-ietf-poly1305":        true,
+	"2022-blake3-aes-128-gcm":       true,
+	"2022-blake3-aes-256-gcm":       true,
+	"2022-blake3-chacha20-poly1305": true,
+}
+
+// Proxy 由节点及其 NodeConfig 解析校验后的代理配置
+type Proxy struct {
+	Name     string
+	Location string
+	Protocol string
+	Server   string
+	Port     int
+
+	UUID     string
+	AlterID  int
+	Security string
+	Flow     string
+	Password string
+	Method   string
+
+	Network       string
+	Path          string
+	Host          string
+	ServiceName   string
+	TLS           bool
+	SNI           string
+	AllowInsecure bool
+}
+
+// FromNode 将节点解析为代理配置，并校验协议所需的配置项。
+// credential 为用户的连接凭证，非空时替换节点配置中的 uuid/password。
+func FromNode(node model.Node, credential string) (*Proxy, error) {
+	cfg := node.Config
+	if cfg == nil {
+		cfg = model.NodeConfig{}
+	}
+
+	if node.ServerAddress == "" {
+		return nil, fmt.Errorf("节点 %d 缺少服务器地址", node.ID)
+	}
+	if node.ServerPort <= 0 || node.ServerPort > 65535 {
+		return nil, fmt.Errorf("节点 %d 端口无效: %d", node.ID, node.ServerPort)
+	}
+
+	p := &Proxy{
+		Name:     node.Name,
+		Location: node.Location,
+		Protocol: node.Protocol,
+		Server:   node.ServerAddress,
+		Port:     node.ServerPort,
+	}
+
+	var err error
+	if p.Network, err = configString(cfg, model.NodeConfigNetwork); err != nil {
+		return nil, err
+	}
+	if p.Path, err = configString(cfg, model.NodeConfigPath); err != nil {
+		return nil, err
+	}
+	if p.Host, err = configString(cfg, model.NodeConfigHost); err != nil {
+		return nil, err
+	}
+	if p.ServiceName, err = configString(cfg, model.NodeConfigServiceName); err != nil {
+		return nil, err
+	}
+	if p.TLS, err = configBool(cfg, model.NodeConfigTLS); err != nil {
+		return nil, err
+	}
+	if p.SNI, err = configString(cfg, model.NodeConfigSNI); err != nil {
+		return nil, err
+	}
+	if p.AllowInsecure, err = configBool(cfg, model.NodeConfigAllowInsecure); err != nil {
+		return nil, err
+	}
+	if p.UUID, err = configString(cfg, model.NodeConfigUUID); err != nil {
+		return nil, err
+	}
+	if p.Password, err = configString(cfg, model.NodeConfigPassword); err != nil {
+		return nil, err
+	}
+
+	switch p.Network {
+	case "":
+		p.Network = "tcp"
+	case "tcp":
+	case "ws", "h2":
+		if p.Path == "" {
+			p.Path = "/"
+		}
+	case "grpc":
+		if p.ServiceName == "" {
+			return nil, fmt.Errorf("节点 %d 使用 grpc 传输但缺少 %s", node.ID, model.NodeConfigServiceName)
+		}
+	default:
+		return nil, fmt.Errorf("节点 %d 不支持的传输方式: %s", node.ID, p.Network)
+	}
+
+	switch node.Protocol {
+	case model.NodeProtocolVMess:
+		if credential != "" {
+			p.UUID = credential
+		}
+		if !uuidPattern.MatchString(p.UUID) {
+			return nil, fmt.Errorf("节点 %d 的 %s 不是有效的UUID", node.ID, model.NodeConfigUUID)
+		}
+		if p.AlterID, err = configInt(cfg, model.NodeConfigAlterID); err != nil {
+			return nil, err
+		}
+		if p.AlterID < 0 {
+			return nil, fmt.Errorf("节点 %d 的 %s 不能为负数", node.ID, model.NodeConfigAlterID)
+		}
+		if p.Security, err = configString(cfg, model.NodeConfigSecurity); err != nil {
+			return nil, err
+		}
+		if p.Security == "" {
+			p.Security = "auto"
+		}
+	case model.NodeProtocolVLESS:
+		if credential != "" {
+			p.UUID = credential
+		}
+		if !uuidPattern.MatchString(p.UUID) {
+			return nil, fmt.Errorf("节点 %d 的 %s 不是有效的UUID", node.ID, model.NodeConfigUUID)
+		}
+		if p.Flow, err = configString(cfg, model.NodeConfigFlow); err != nil {
+			return nil, err
+		}
+	case model.NodeProtocolTrojan:
+		if credential != "" {
+			p.Password = credential
+		}
+		if p.Password == "" {
+			return nil, fmt.Errorf("节点 %d 缺少 %s", node.ID, model.NodeConfigPassword)
+		}
+		// trojan 协议必须使用 TLS
+		p.TLS = true
+	case model.NodeProtocolShadowsocks:
+		if p.Method, err = configString(cfg, model.NodeConfigMethod); err != nil {
+			return nil, err
+		}
+		if !shadowsocksMethods[p.Method] {
+			return nil, fmt.Errorf("节点 %d 不支持的 shadowsocks 加密方式: %q", node.ID, p.Method)
+		}
+		if credential != "" {
+			if keyLen := shadowsocks2022KeyLength(p.Method); keyLen > 0 {
+				// 2022 多用户模式：节点配置的 password 为服务端密钥，用户密钥由凭证派生
+				if p.Password == "" {
+					return nil, fmt.Errorf("节点 %d 缺少服务端密钥 %s", node.ID, model.NodeConfigPassword)
+				}
+				userKey, err := ShadowsocksUserKey(credential, keyLen)
+				if err != nil {
+					return nil, err
+				}
+				p.Password = p.Password + ":" + userKey
+			} else {
+				p.Password = credential
+			}
+		}
+		if p.Password == "" {
+			return nil, fmt.Errorf("节点 %d 缺少 %s", node.ID, model.NodeConfigPassword)
+		}
+		if p.Network != "tcp" {
+			return nil, fmt.Errorf("节点 %d: shadowsocks 仅支持 tcp 传输", node.ID)
+		}
+	default:
+		return nil, fmt.Errorf("节点 %d 不支持的协议: %s", node.ID, node.Protocol)
+	}
+
+	if p.TLS && p.SNI == "" {
+		p.SNI = p.Server
+	}
+
+	return p, nil
+}
+
+// shadowsocksUserKeyInfo 派生 shadowsocks 2022 用户密钥时使用的 HKDF info
+const shadowsocksUserKeyInfo = "shadowsocks 2022 user key"
+
+// ShadowsocksUserKey 由用户凭证派生 shadowsocks 2022 的用户密钥 (base64)，节点端需使用相同规则:
+// HKDF-SHA256，输入密钥为凭证字符串，salt 为空，info 为 shadowsocksUserKeyInfo，长度为加密方式的密钥长度
+func ShadowsocksUserKey(credential string, keyLen int) (string, error) {
+	key, err := hkdf.Key(sha256.New, []byte(credential), nil, shadowsocksUserKeyInfo, keyLen)
+	if err != nil {
+		return "", fmt.Errorf("派生 shadowsocks 用户密钥失败: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// shadowsocks2022KeyLength 返回 2022 加密方式的密钥长度，其他加密方式返回 0
+func shadowsocks2022KeyLength(method string) int {
+	switch method {
+	case "2022-blake3-aes-128-gcm":
+		return 16
+	case "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305":
+		return 32
+	default:
+		return 0
+	}
+}
+
+// ParseNodes 批量解析节点，配置无效的节点记录日志后跳过。
+// 客户端要求节点名称唯一，重名节点会追加序号。
+func ParseNodes(nodes []model.Node, credential string) []Proxy {
+	proxies := make([]Proxy, 0, len(nodes))
+	seen := make(map[string]int)
+	for _, node := range nodes {
+		p, err := FromNode(node, credential)
+		if err != nil {
+			log.Printf("节点配置无效，已跳过: %v", err)
+			continue
+		}
+
+		seen[p.Name]++
+		if n := seen[p.Name]; n > 1 {
+			p.Name = fmt.Sprintf("%s %d", p.Name, n)
+		}
+
+		proxies = append(proxies, *p)
+	}
+	return proxies
+}
+
+// configString 读取字符串配置项，不存在时返回空字符串
+func configString(cfg model.NodeConfig, key string) (string, error) {
+	v, ok := cfg[key]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("配置项 %s 必须是字符串", key)
+	}
+	return s, nil
+}
+
+// configInt 读取整数配置项，兼容 JSON 解码得到的 float64
+func configInt(cfg model.NodeConfig, key string) (int, error) {
+	v, ok := cfg[key]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	switch n := v.(type) {
+	case float64:
+		if n != float64(int(n)) {
+			return 0, fmt.Errorf("配置项 %s 必须是整数", key)
+		}
+		return int(n), nil
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("配置项 %s 必须是整数", key)
+	}
+}
+
+// configBool 读取布尔配置项
+func configBool(cfg model.NodeConfig, key string) (bool, error) {
+	v, ok := cfg[key]
+	if !ok || v == nil {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("配置项 %s 必须是布尔值", key)
+	}
+	return b, nil
+}
@@ -0,0 +1,82 @@
+package subscribe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+)
+
+// QuantumultXRenderer 渲染 Quantumult X 节点资源（server_remote 格式）
+type QuantumultXRenderer struct{}
+
+// ContentType 返回响应的 Content-Type
+func (QuantumultXRenderer) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+// Render 每行输出一个代理，Quantumult X 不支持的协议或传输方式会被跳过
+func (QuantumultXRenderer) Render(proxies []Proxy) ([]byte, error) {
+	lines := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		if line, ok := quantumultXLine(p); ok {
+			lines = append(lines, line)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// quantumultXLine 生成单个代理的 Quantumult X 配置行
+func quantumultXLine(p Proxy) (string, bool) {
+	if p.Network != "tcp" && p.Network != "ws" {
+		return "", false
+	}
+
+	server := fmt.Sprintf("%s:%d", p.Server, p.Port)
+	var fields []string
+	switch p.Protocol {
+	case model.NodeProtocolShadowsocks:
+		fields = []string{"shadowsocks=" + server, "method=" + p.Method, "password=" + p.Password, "udp-relay=true"}
+	case model.NodeProtocolVMess:
+		method := p.Security
+		if method == "auto" {
+			method = "chacha20-poly1305"
+		}
+		fields = []string{"vmess=" + server, "method=" + method, "password=" + p.UUID}
+		if p.AlterID == 0 {
+			fields = append(fields, "aead=true")
+		}
+	case model.NodeProtocolTrojan:
+		fields = []string{"trojan=" + server, "password=" + p.Password}
+	default:
+		return "", false
+	}
+
+	switch {
+	case p.Network == "ws" && p.TLS:
+		fields = append(fields, "obfs=wss", "obfs-uri="+p.Path)
+	case p.Network == "ws":
+		fields = append(fields, "obfs=ws", "obfs-uri="+p.Path)
+	case p.TLS:
+		fields = append(fields, "over-tls=true")
+	}
+
+	if p.Network == "ws" {
+		host := p.Host
+		if host == "" {
+			host = p.SNI
+		}
+		if host != "" {
+			fields = append(fields, "obfs-host="+host)
+		}
+	} else if p.TLS {
+		fields = append(fields, "tls-host="+p.SNI)
+	}
+
+	if p.TLS {
+		fields = append(fields, fmt.Sprintf("tls-verification=%t", !p.AllowInsecure))
+	}
+
+	fields = append(fields, "tag="+sanitizeLineName(p.Name))
+	return strings.Join(fields, ", "), true
+}
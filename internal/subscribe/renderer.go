@@ -0,0 +1,32 @@
+package subscribe
+
+// 订阅输出格式
+const (
+	TargetV2rayN      = "v2rayn"  // base64 编码的分享链接列表
+	TargetClash       = "clash"   // Clash.Meta YAML 配置
+	TargetSingbox     = "singbox" // sing-box JSON 配置
+	TargetSurge       = "surge"   // Surge 代理列表
+	TargetQuantumultX = "quanx"   // Quantumult X 节点资源
+)
+
+// Renderer 订阅内容渲染器
+type Renderer interface {
+	// ContentType 返回响应的 Content-Type
+	ContentType() string
+	// Render 将代理列表渲染为客户端可导入的订阅内容
+	Render(proxies []Proxy) ([]byte, error)
+}
+
+var renderers = map[string]Renderer{
+	TargetV2rayN:      ShareLinkRenderer{},
+	TargetClash:       ClashRenderer{},
+	TargetSingbox:     SingboxRenderer{},
+	TargetSurge:       SurgeRenderer{},
+	TargetQuantumultX: QuantumultXRenderer{},
+}
+
+// Lookup 根据输出格式获取渲染器
+func Lookup(target string) (Renderer, bool) {
+	r, ok := renderers[target]
+	return r, ok
+}
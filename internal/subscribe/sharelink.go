@@ -0,0 +1,157 @@
+package subscribe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+)
+
+// ShareLinkRenderer 渲染 v2rayN 风格的 base64 分享链接列表
+type ShareLinkRenderer struct{}
+
+// ContentType 返回响应的 Content-Type
+func (ShareLinkRenderer) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+// Render 将每个代理编码为分享链接，按行拼接后整体 base64 编码
+func (ShareLinkRenderer) Render(proxies []Proxy) ([]byte, error) {
+	links := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		link, err := ShareLink(p)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	content := strings.Join(links, "\n")
+	return []byte(base64.StdEncoding.EncodeToString([]byte(content))), nil
+}
+
+// ShareLink 生成单个代理的分享链接
+func ShareLink(p Proxy) (string, error) {
+	switch p.Protocol {
+	case model.NodeProtocolVMess:
+		return vmessLink(p)
+	case model.NodeProtocolVLESS:
+		return vlessLink(p), nil
+	case model.NodeProtocolTrojan:
+		return trojanLink(p), nil
+	case model.NodeProtocolShadowsocks:
+		return shadowsocksLink(p), nil
+	default:
+		return "", fmt.Errorf("不支持的协议: %s", p.Protocol)
+	}
+}
+
+// vmessLink 生成 vmess:// 链接（v2rayN 的 base64 JSON 格式）
+func vmessLink(p Proxy) (string, error) {
+	tls := ""
+	if p.TLS {
+		tls = "tls"
+	}
+
+	path := p.Path
+	if p.Network == "grpc" {
+		path = p.ServiceName
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"v":    "2",
+		"ps":   p.Name,
+		"add":  p.Server,
+		"port": strconv.Itoa(p.Port),
+		"id":   p.UUID,
+		"aid":  strconv.Itoa(p.AlterID),
+		"scy":  p.Security,
+		"net":  p.Network,
+		"type": "none",
+		"host": p.Host,
+		"path": path,
+		"tls":  tls,
+		"sni":  p.SNI,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "vmess://" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// vlessLink 生成 vless:// 链接
+func vlessLink(p Proxy) string {
+	query := transportQuery(p)
+	query.Set("encryption", "none")
+	if p.Flow != "" {
+		query.Set("flow", p.Flow)
+	}
+
+	return buildURL("vless", p.UUID, p, query)
+}
+
+// trojanLink 生成 trojan:// 链接
+func trojanLink(p Proxy) string {
+	return buildURL("trojan", p.Password, p, transportQuery(p))
+}
+
+// shadowsocksLink 生成 SIP002 格式的 ss:// 链接。
+// SIP002 要求 2022 加密方式的 userinfo 使用百分号编码的明文，其他加密方式使用 base64url 编码。
+func shadowsocksLink(p Proxy) string {
+	userInfo := base64.RawURLEncoding.EncodeToString([]byte(p.Method + ":" + p.Password))
+	if strings.HasPrefix(p.Method, "2022-") {
+		userInfo = url.QueryEscape(p.Method) + ":" + url.QueryEscape(p.Password)
+	}
+	return fmt.Sprintf("ss://%s@%s#%s", userInfo, hostPort(p), url.PathEscape(p.Name))
+}
+
+// transportQuery 生成 vless/trojan 链接中传输与 TLS 相关的参数
+func transportQuery(p Proxy) url.Values {
+	query := url.Values{}
+	query.Set("type", p.Network)
+
+	switch p.Network {
+	case "ws", "h2":
+		query.Set("path", p.Path)
+		if p.Host != "" {
+			query.Set("host", p.Host)
+		}
+	case "grpc":
+		query.Set("serviceName", p.ServiceName)
+	}
+
+	if p.TLS {
+		query.Set("security", "tls")
+		query.Set("sni", p.SNI)
+		if p.AllowInsecure {
+			query.Set("allowInsecure", "1")
+		}
+	} else {
+		query.Set("security", "none")
+	}
+
+	return query
+}
+
+// buildURL 拼接 scheme://credential@host:port?query#name 格式的链接
+func buildURL(scheme, credential string, p Proxy, query url.Values) string {
+	u := url.URL{
+		Scheme:   scheme,
+		User:     url.User(credential),
+		Host:     hostPort(p),
+		RawQuery: query.Encode(),
+		Fragment: p.Name,
+	}
+	return u.String()
+}
+
+// hostPort 拼接服务器地址与端口，兼容 IPv6
+func hostPort(p Proxy) string {
+	return net.JoinHostPort(p.Server, strconv.Itoa(p.Port))
+}
@@ -0,0 +1,239 @@
+package subscribe
+
+import (
+	"encoding/json"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+)
+
+// sing-box 固定的出站与 DNS 标签
+const (
+	singboxTagSelect   = "proxy"
+	singboxTagAuto     = "auto"
+	singboxTagDirect   = "direct"
+	singboxTagDNSProxy = "dns-remote"
+	singboxTagDNSLocal = "dns-local"
+)
+
+// singboxTestURL urltest 出站使用的测速地址
+const singboxTestURL = "https://www.gstatic.com/generate_204"
+
+// SingboxRenderer 渲染 sing-box (1.12+) JSON 配置
+type SingboxRenderer struct{}
+
+type singboxConfig struct {
+	Log       singboxLog        `json:"log"`
+	DNS       singboxDNS        `json:"dns"`
+	Inbounds  []singboxInbound  `json:"inbounds"`
+	Outbounds []singboxOutbound `json:"outbounds"`
+	Route     singboxRoute      `json:"route"`
+}
+
+type singboxLog struct {
+	Level string `json:"level"`
+}
+
+type singboxDNS struct {
+	Servers  []singboxDNSServer `json:"servers"`
+	Rules    []singboxRule      `json:"rules,omitempty"`
+	Final    string             `json:"final"`
+	Strategy string             `json:"strategy,omitempty"`
+}
+
+type singboxDNSServer struct {
+	Type   string `json:"type"`
+	Tag    string `json:"tag"`
+	Server string `json:"server"`
+	Detour string `json:"detour,omitempty"`
+}
+
+type singboxInbound struct {
+	Type        string   `json:"type"`
+	Tag         string   `json:"tag"`
+	Address     []string `json:"address"`
+	AutoRoute   bool     `json:"auto_route"`
+	StrictRoute bool     `json:"strict_route"`
+}
+
+type singboxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort int               `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	AlterID    int               `json:"alter_id,omitempty"`
+	Flow       string            `json:"flow,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	TLS        *singboxTLS       `json:"tls,omitempty"`
+	Transport  *singboxTransport `json:"transport,omitempty"`
+
+	// selector / urltest
+	Outbounds []string `json:"outbounds,omitempty"`
+	Default   string   `json:"default,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Interval  string   `json:"interval,omitempty"`
+	Tolerance int      `json:"tolerance,omitempty"`
+}
+
+type singboxTLS struct {
+	Enabled    bool   `json:"enabled"`
+	ServerName string `json:"server_name,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+type singboxTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Host        []string          `json:"host,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type singboxRule struct {
+	Action      string `json:"action,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+	IPIsPrivate bool   `json:"ip_is_private,omitempty"`
+	Outbound    string `json:"outbound,omitempty"`
+	Server      string `json:"server,omitempty"`
+	ClashMode   string `json:"clash_mode,omitempty"`
+}
+
+type singboxRoute struct {
+	Rules                 []singboxRule `json:"rules"`
+	Final                 string        `json:"final"`
+	AutoDetectInterface   bool          `json:"auto_detect_interface"`
+	DefaultDomainResolver string        `json:"default_domain_resolver"`
+}
+
+// ContentType 返回响应的 Content-Type
+func (SingboxRenderer) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+// Render 生成包含 DNS、tun 入站、代理出站、selector/urltest 及路由的完整配置
+func (SingboxRenderer) Render(proxies []Proxy) ([]byte, error) {
+	names := make([]string, 0, len(proxies))
+	outbounds := make([]singboxOutbound, 0, len(proxies)+3)
+
+	for _, p := range proxies {
+		names = append(names, p.Name)
+	}
+
+	autoOutbounds := names
+	if len(autoOutbounds) == 0 {
+		autoOutbounds = []string{singboxTagDirect}
+	}
+
+	outbounds = append(outbounds,
+		singboxOutbound{
+			Type:      "selector",
+			Tag:       singboxTagSelect,
+			Outbounds: append([]string{singboxTagAuto}, names...),
+			Default:   singboxTagAuto,
+		},
+		singboxOutbound{
+			Type:      "urltest",
+			Tag:       singboxTagAuto,
+			Outbounds: autoOutbounds,
+			URL:       singboxTestURL,
+			Interval:  "3m",
+			Tolerance: 50,
+		},
+	)
+	for _, p := range proxies {
+		outbounds = append(outbounds, toSingboxOutbound(p))
+	}
+	outbounds = append(outbounds, singboxOutbound{Type: "direct", Tag: singboxTagDirect})
+
+	cfg := singboxConfig{
+		Log: singboxLog{Level: "info"},
+		DNS: singboxDNS{
+			Servers: []singboxDNSServer{
+				{Type: "https", Tag: singboxTagDNSProxy, Server: "1.1.1.1", Detour: singboxTagSelect},
+				{Type: "udp", Tag: singboxTagDNSLocal, Server: "223.5.5.5"},
+			},
+			Rules: []singboxRule{
+				{ClashMode: "Direct", Server: singboxTagDNSLocal},
+			},
+			Final:    singboxTagDNSProxy,
+			Strategy: "prefer_ipv4",
+		},
+		Inbounds: []singboxInbound{
+			{
+				Type:        "tun",
+				Tag:         "tun-in",
+				Address:     []string{"172.19.0.1/30", "fdfe:dcba:9876::1/126"},
+				AutoRoute:   true,
+				StrictRoute: true,
+			},
+		},
+		Outbounds: outbounds,
+		Route: singboxRoute{
+			Rules: []singboxRule{
+				{Action: "sniff"},
+				{Protocol: "dns", Action: "hijack-dns"},
+				{IPIsPrivate: true, Outbound: singboxTagDirect},
+			},
+			Final:                 singboxTagSelect,
+			AutoDetectInterface:   true,
+			DefaultDomainResolver: singboxTagDNSLocal,
+		},
+	}
+
+	return json.MarshalIndent(cfg, "", "  ")
+}
+
+// toSingboxOutbound 转换为 sing-box 的代理出站
+func toSingboxOutbound(p Proxy) singboxOutbound {
+	out := singboxOutbound{
+		Tag:        p.Name,
+		Server:     p.Server,
+		ServerPort: p.Port,
+	}
+
+	switch p.Protocol {
+	case model.NodeProtocolVMess:
+		out.Type = "vmess"
+		out.UUID = p.UUID
+		out.Security = p.Security
+		out.AlterID = p.AlterID
+	case model.NodeProtocolVLESS:
+		out.Type = "vless"
+		out.UUID = p.UUID
+		out.Flow = p.Flow
+	case model.NodeProtocolTrojan:
+		out.Type = "trojan"
+		out.Password = p.Password
+	case model.NodeProtocolShadowsocks:
+		out.Type = "shadowsocks"
+		out.Method = p.Method
+		out.Password = p.Password
+	}
+
+	if p.TLS {
+		out.TLS = &singboxTLS{
+			Enabled:    true,
+			ServerName: p.SNI,
+			Insecure:   p.AllowInsecure,
+		}
+	}
+
+	switch p.Network {
+	case "ws":
+		out.Transport = &singboxTransport{Type: "ws", Path: p.Path}
+		if p.Host != "" {
+			out.Transport.Headers = map[string]string{"Host": p.Host}
+		}
+	case "h2":
+		out.Transport = &singboxTransport{Type: "http", Path: p.Path}
+		if p.Host != "" {
+			out.Transport.Host = []string{p.Host}
+		}
+	case "grpc":
+		out.Transport = &singboxTransport{Type: "grpc", ServiceName: p.ServiceName}
+	}
+
+	return out
+}
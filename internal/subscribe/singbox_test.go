@@ -0,0 +1,105 @@
+package subscribe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "更新 golden 文件")
+
+// singboxGoldenNodes 每种协议一个节点，覆盖不同的传输方式
+var singboxGoldenNodes = map[string]model.Node{
+	model.NodeProtocolVMess: {
+		ID: 1, Name: "美国-洛杉矶-01", Location: "US", Protocol: model.NodeProtocolVMess,
+		ServerAddress: "us-la-01.example.com", ServerPort: 443,
+		Config: model.NodeConfig{
+			"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811", "alterId": float64(0),
+			"network": "ws", "path": "/vmess", "host": "cdn.example.com", "tls": true,
+		},
+	},
+	model.NodeProtocolVLESS: {
+		ID: 2, Name: "日本-东京-01", Location: "JP", Protocol: model.NodeProtocolVLESS,
+		ServerAddress: "jp-tko-01.example.com", ServerPort: 443,
+		Config: model.NodeConfig{
+			"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811", "flow": "xtls-rprx-vision",
+			"tls": true, "sni": "www.example.com",
+		},
+	},
+	model.NodeProtocolTrojan: {
+		ID: 3, Name: "新加坡-01", Location: "SG", Protocol: model.NodeProtocolTrojan,
+		ServerAddress: "sg-01.example.com", ServerPort: 443,
+		Config: model.NodeConfig{
+			"password": "trojan-secret", "network": "grpc", "serviceName": "trojan-grpc",
+		},
+	},
+	model.NodeProtocolShadowsocks: {
+		ID: 4, Name: "香港-01", Location: "HK", Protocol: model.NodeProtocolShadowsocks,
+		ServerAddress: "hk-01.example.com", ServerPort: 8388,
+		Config: model.NodeConfig{
+			"method": "2022-blake3-aes-128-gcm", "password": "aGstMDEtc2VydmVyLWtleQ==",
+		},
+	},
+}
+
+func TestSingboxRenderer_Golden(t *testing.T) {
+	for protocol, node := range singboxGoldenNodes {
+		t.Run(protocol, func(t *testing.T) {
+			proxies := ParseNodes([]model.Node{node}, "")
+			assert.Len(t, proxies, 1)
+
+			content, err := SingboxRenderer{}.Render(proxies)
+			assert.NoError(t, err)
+			assert.True(t, json.Valid(content))
+
+			golden := filepath.Join("testdata", "singbox_"+protocol+".golden.json")
+			if *update {
+				assert.NoError(t, os.WriteFile(golden, content, 0o644))
+			}
+
+			expected, err := os.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, string(expected), string(content))
+
+			var cfg singboxConfig
+			assert.NoError(t, json.Unmarshal(content, &cfg))
+			for _, outbound := range cfg.Outbounds {
+				if outbound.Type == model.NodeProtocolShadowsocks {
+					assertShadowsocks2022Keys(t, outbound.Method, outbound.Password)
+				}
+			}
+		})
+	}
+}
+
+// assertShadowsocks2022Keys 检查 2022 加密方式的密钥 (服务端密钥:用户密钥) 均为 base64 编码的完整长度密钥
+func assertShadowsocks2022Keys(t *testing.T, method, password string) {
+	t.Helper()
+	keyLen := shadowsocks2022KeyLength(method)
+	if keyLen == 0 {
+		return
+	}
+	for _, key := range strings.Split(password, ":") {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		assert.NoError(t, err)
+		assert.Len(t, raw, keyLen, "%s 密钥长度错误: %s", method, key)
+	}
+}
+
+func TestSingboxRenderer_Empty(t *testing.T) {
+	content, err := SingboxRenderer{}.Render(nil)
+	assert.NoError(t, err)
+
+	var cfg singboxConfig
+	assert.NoError(t, json.Unmarshal(content, &cfg))
+
+	// urltest 不能为空，没有节点时回退为 direct
+	assert.Equal(t, []string{singboxTagDirect}, cfg.Outbounds[1].Outbounds)
+}
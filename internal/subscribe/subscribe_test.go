@@ -0,0 +1,185 @@
+package subscribe
+
+import (
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestFromNode_Validation(t *testing.T) {
+	// 缺少 uuid 的 vmess 节点
+	_, err := FromNode(model.Node{ID: 1, Protocol: model.NodeProtocolVMess, ServerAddress: "a.example.com", ServerPort: 443}, "")
+	assert.Error(t, err)
+
+	// 不支持的 shadowsocks 加密方式
+	_, err = FromNode(model.Node{ID: 2, Protocol: model.NodeProtocolShadowsocks, ServerAddress: "a.example.com", ServerPort: 8388,
+		Config: model.NodeConfig{"method": "rc4-md5", "password": "secret"}}, "")
+	assert.Error(t, err)
+
+	// 类型错误的配置项
+	_, err = FromNode(model.Node{ID: 3, Protocol: model.NodeProtocolVLESS, ServerAddress: "a.example.com", ServerPort: 443,
+		Config: model.NodeConfig{"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811", "tls": "yes"}}, "")
+	assert.Error(t, err)
+
+	// trojan 默认启用 TLS 并以服务器地址作为 SNI
+	p, err := FromNode(model.Node{ID: 4, Protocol: model.NodeProtocolTrojan, ServerAddress: "a.example.com", ServerPort: 443,
+		Config: model.NodeConfig{"password": "secret"}}, "")
+	assert.NoError(t, err)
+	assert.True(t, p.TLS)
+	assert.Equal(t, "a.example.com", p.SNI)
+	assert.Equal(t, "tcp", p.Network)
+}
+
+func TestShareLinkRenderer(t *testing.T) {
+	proxies := ParseNodes([]model.Node{
+		{ID: 1, Name: "香港-01", Protocol: model.NodeProtocolShadowsocks, ServerAddress: "hk.example.com", ServerPort: 8388,
+			Config: model.NodeConfig{"method": "aes-128-gcm", "password": "secret"}},
+		{ID: 2, Name: "日本-01", Protocol: model.NodeProtocolTrojan, ServerAddress: "jp.example.com", ServerPort: 443,
+			Config: model.NodeConfig{"password": "secret", "network": "ws", "path": "/ws"}},
+		{ID: 3, Name: "无效节点", Protocol: "unknown", ServerAddress: "x.example.com", ServerPort: 443},
+	}, "")
+	assert.Len(t, proxies, 2)
+
+	content, err := ShareLinkRenderer{}.Render(proxies)
+	assert.NoError(t, err)
+
+	decoded, err := base64.StdEncoding.DecodeString(string(content))
+	assert.NoError(t, err)
+
+	links := strings.Split(string(decoded), "\n")
+	assert.Equal(t, "ss://YWVzLTEyOC1nY206c2VjcmV0@hk.example.com:8388#%E9%A6%99%E6%B8%AF-01", links[0])
+	assert.Equal(t, "trojan://secret@jp.example.com:443?path=%2Fws&security=tls&sni=jp.example.com&type=ws#%E6%97%A5%E6%9C%AC-01", links[1])
+}
+
+func TestShareLink_Shadowsocks2022Golden(t *testing.T) {
+	nodes := []model.Node{
+		{ID: 1, Name: "香港-01", Protocol: model.NodeProtocolShadowsocks, ServerAddress: "hk.example.com", ServerPort: 8388,
+			Config: model.NodeConfig{"method": "2022-blake3-aes-128-gcm", "password": "aGstMDEtc2VydmVyLWtleQ=="}},
+		{ID: 2, Name: "日本-01", Protocol: model.NodeProtocolShadowsocks, ServerAddress: "jp.example.com", ServerPort: 8388,
+			Config: model.NodeConfig{"method": "2022-blake3-aes-256-gcm", "password": "anAtMDEtc2VydmVyLWtleS0zMi1ieXRlcy1sb25nISE="}},
+	}
+
+	links := make([]string, 0)
+	for _, credential := range []string{"", "b831381d-6324-4d53-ad4f-8cda48b30811"} {
+		for _, p := range ParseNodes(nodes, credential) {
+			link, err := ShareLink(p)
+			assert.NoError(t, err)
+			links = append(links, link)
+
+			// userinfo 为明文 method:password，解码后与节点配置一致
+			u, err := url.Parse(link)
+			assert.NoError(t, err)
+			password, _ := u.User.Password()
+			assert.Equal(t, p.Method, u.User.Username())
+			assert.Equal(t, p.Password, password)
+			assertShadowsocks2022Keys(t, p.Method, password)
+		}
+	}
+	content := strings.Join(links, "\n") + "\n"
+
+	golden := filepath.Join("testdata", "sharelink_shadowsocks2022.golden.txt")
+	if *update {
+		assert.NoError(t, os.WriteFile(golden, []byte(content), 0o644))
+	}
+	expected, err := os.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), content)
+}
+
+func TestClashRenderer(t *testing.T) {
+	proxies := ParseNodes([]model.Node{
+		{ID: 1, Name: "香港-01", Location: "HK", Protocol: model.NodeProtocolVMess, ServerAddress: "hk.example.com", ServerPort: 443,
+			Config: model.NodeConfig{"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811", "network": "ws", "tls": true}},
+		{ID: 2, Name: "香港-01", Location: "HK", Protocol: model.NodeProtocolTrojan, ServerAddress: "hk2.example.com", ServerPort: 443,
+			Config: model.NodeConfig{"password": "secret"}},
+	}, "")
+
+	content, err := ClashRenderer{}.Render(proxies)
+	assert.NoError(t, err)
+
+	var cfg clashConfig
+	assert.NoError(t, yaml.Unmarshal(content, &cfg))
+	assert.Len(t, cfg.Proxies, 2)
+	assert.Equal(t, "香港-01 2", cfg.Proxies[1].Name)
+	assert.Equal(t, "/", cfg.Proxies[0].WSOpts.Path)
+	assert.Equal(t, "hk.example.com", cfg.Proxies[0].ServerName)
+
+	groups := map[string]clashGroup{}
+	for _, g := range cfg.ProxyGroups {
+		groups[g.Name] = g
+	}
+	assert.Equal(t, "url-test", groups[clashGroupAuto].Type)
+	assert.Equal(t, []string{"香港-01", "香港-01 2"}, groups["HK"].Proxies)
+	assert.Equal(t, []string{clashGroupAuto, "HK", "香港-01", "香港-01 2"}, groups[clashGroupSelect].Proxies)
+	assert.Equal(t, "MATCH,"+clashGroupSelect, cfg.Rules[len(cfg.Rules)-1])
+}
+
+func TestDetectTarget(t *testing.T) {
+	assert.Equal(t, TargetClash, DetectTarget("ClashforWindows/0.20.39"))
+	assert.Equal(t, TargetClash, DetectTarget("Stash/2.4.0 Clash/1.9.0"))
+	assert.Equal(t, TargetSingbox, DetectTarget("SFA/1.9.0 (sing-box 1.9.0)"))
+	assert.Equal(t, TargetSurge, DetectTarget("Surge iOS/2920"))
+	assert.Equal(t, TargetQuantumultX, DetectTarget("Quantumult%20X/1.0.30"))
+	assert.Equal(t, TargetV2rayN, DetectTarget("Shadowrocket/1979"))
+	assert.Equal(t, TargetV2rayN, DetectTarget("curl/8.0.1"))
+}
+
+func TestLineRenderers(t *testing.T) {
+	proxies := ParseNodes([]model.Node{
+		{ID: 1, Name: "美国, 洛杉矶", Protocol: model.NodeProtocolVMess, ServerAddress: "us.example.com", ServerPort: 443,
+			Config: model.NodeConfig{"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811", "network": "ws", "path": "/ws", "tls": true}},
+		{ID: 2, Name: "日本", Protocol: model.NodeProtocolVLESS, ServerAddress: "jp.example.com", ServerPort: 443,
+			Config: model.NodeConfig{"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811"}},
+	}, "")
+
+	surge, err := SurgeRenderer{}.Render(proxies)
+	assert.NoError(t, err)
+	assert.Equal(t, "美国  洛杉矶 = vmess, us.example.com, 443, username=b831381d-6324-4d53-ad4f-8cda48b30811, vmess-aead=true, ws=true, ws-path=/ws, tls=true, sni=us.example.com", string(surge))
+
+	quanx, err := QuantumultXRenderer{}.Render(proxies)
+	assert.NoError(t, err)
+	assert.Equal(t, "vmess=us.example.com:443, method=chacha20-poly1305, password=b831381d-6324-4d53-ad4f-8cda48b30811, aead=true, obfs=wss, obfs-uri=/ws, obfs-host=us.example.com, tls-verification=true, tag=美国  洛杉矶", string(quanx))
+}
+
+func TestFromNode_Credential(t *testing.T) {
+	credential := "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+	// 用户凭证替换节点级 uuid
+	p, err := FromNode(model.Node{ID: 1, Protocol: model.NodeProtocolVMess, ServerAddress: "a.example.com", ServerPort: 443}, credential)
+	assert.NoError(t, err)
+	assert.Equal(t, credential, p.UUID)
+
+	// shadowsocks 2022 使用 服务端密钥:用户密钥
+	p, err = FromNode(model.Node{ID: 2, Protocol: model.NodeProtocolShadowsocks, ServerAddress: "a.example.com", ServerPort: 8388,
+		Config: model.NodeConfig{"method": "2022-blake3-aes-128-gcm", "password": "bm9kZS1zZXJ2ZXIta2V5IQ=="}}, credential)
+	assert.NoError(t, err)
+	userKey, err := ShadowsocksUserKey(credential, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "bm9kZS1zZXJ2ZXIta2V5IQ==:"+userKey, p.Password)
+	assertShadowsocks2022Keys(t, p.Method, p.Password)
+
+	// 用户密钥为 HKDF 派生的完整长度密钥
+	for _, keyLen := range []int{16, 32} {
+		userKey, err := ShadowsocksUserKey(credential, keyLen)
+		assert.NoError(t, err)
+		raw, err := base64.StdEncoding.DecodeString(userKey)
+		assert.NoError(t, err)
+		assert.Len(t, raw, keyLen)
+		assert.NotContains(t, string(raw), credential[:8])
+	}
+	other, err := ShadowsocksUserKey("c9a0b5f2-7e3a-4d1c-9b8e-2f6a1d0c3e4b", 16)
+	assert.NoError(t, err)
+	assert.NotEqual(t, userKey, other)
+
+	// 2022 加密方式缺少服务端密钥
+	_, err = FromNode(model.Node{ID: 3, Protocol: model.NodeProtocolShadowsocks, ServerAddress: "a.example.com", ServerPort: 8388,
+		Config: model.NodeConfig{"method": "2022-blake3-aes-256-gcm"}}, credential)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package subscribe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+)
+
+// SurgeRenderer 渲染 Surge 外部代理列表（policy-path 格式）
+type SurgeRenderer struct{}
+
+// ContentType 返回响应的 Content-Type
+func (SurgeRenderer) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+// Render 每行输出一个代理，Surge 不支持的协议或传输方式会被跳过
+func (SurgeRenderer) Render(proxies []Proxy) ([]byte, error) {
+	lines := make([]string, 0, len(proxies))
+	for _, p := range proxies {
+		if line, ok := surgeLine(p); ok {
+			lines = append(lines, line)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// surgeLine 生成单个代理的 Surge 配置行
+func surgeLine(p Proxy) (string, bool) {
+	if p.Network != "tcp" && p.Network != "ws" {
+		return "", false
+	}
+
+	var fields []string
+	switch p.Protocol {
+	case model.NodeProtocolShadowsocks:
+		fields = []string{"ss", p.Server, fmt.Sprint(p.Port),
+			"encrypt-method=" + p.Method, "password=" + p.Password, "udp-relay=true"}
+	case model.NodeProtocolVMess:
+		fields = []string{"vmess", p.Server, fmt.Sprint(p.Port), "username=" + p.UUID}
+		if p.AlterID == 0 {
+			fields = append(fields, "vmess-aead=true")
+		}
+	case model.NodeProtocolTrojan:
+		fields = []string{"trojan", p.Server, fmt.Sprint(p.Port), "password=" + p.Password}
+	default:
+		return "", false
+	}
+
+	if p.Network == "ws" {
+		fields = append(fields, "ws=true", "ws-path="+p.Path)
+		if p.Host != "" {
+			fields = append(fields, "ws-headers=Host:"+p.Host)
+		}
+	}
+
+	if p.TLS {
+		if p.Protocol != model.NodeProtocolTrojan {
+			fields = append(fields, "tls=true")
+		}
+		fields = append(fields, "sni="+p.SNI)
+		if p.AllowInsecure {
+			fields = append(fields, "skip-cert-verify=true")
+		}
+	}
+
+	return sanitizeLineName(p.Name) + " = " + strings.Join(fields, ", "), true
+}
+
+// sanitizeLineName 去除会破坏行格式的字符
+func sanitizeLineName(name string) string {
+	return strings.NewReplacer(",", " ", "=", " ").Replace(name)
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// NodeSignature 计算节点请求签名
+// 签名内容: METHOD + "\n" + PATH(含查询参数) + "\n" + TIMESTAMP + "\n" + hex(SHA256(body))
+func NodeSignature(secret, method, path, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyNodeSignature 校验节点请求签名
+func VerifyNodeSignature(secret, method, path, timestamp string, body []byte, signature string) bool {
+	expected := NodeSignature(secret, method, path, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// RedisClient Redis 客户端，未配置或连接失败时为 nil，调用方据此回退到数据库
 var RedisClient *redis.Client
 
 // Config Redis配置
@@ -20,7 +21,7 @@ type Config struct {
 
 // InitRedis 初始化Redis连接
 func InitRedis(cfg Config) error {
-	RedisClient = redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
 		Password:     cfg.Password,
 		DB:           cfg.DB,
@@ -34,11 +35,14 @@ func InitRedis(cfg Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := RedisClient.Ping(ctx).Result()
+	_, err := client.Ping(ctx).Result()
 	if err != nil {
+		client.Close()
+		RedisClient = nil
 		return fmt.Errorf("failed to connect redis: %w", err)
 	}
 
+	RedisClient = client
 	return nil
 }
 
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/mariclezhang/vps_backend/pkg/cache"
+	"github.com/mariclezhang/vps_backend/pkg/db"
+	"github.com/spf13/viper"
+)
+
+// Load 加载配置: .env 文件 (如果存在)、config.yaml 与环境变量 (如 DATABASE_HOST 对应 database.host)。
+// 服务端与命令行工具共用同一套默认值。
+func Load() error {
+	// 加载 .env 文件（如果存在）
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(); err != nil {
+			log.Printf("Warning: Error loading .env file: %v", err)
+		} else {
+			log.Println(".env file loaded successfully")
+		}
+	}
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath("./config")
+	viper.AddConfigPath(".")
+
+	// 读取环境变量
+	viper.AutomaticEnv()
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	// 设置默认值
+	viper.SetDefault("server.port", 8080)
+	viper.SetDefault("server.mode", "debug")
+	viper.SetDefault("server.frontend_url", "http://localhost:8000")
+	viper.SetDefault("database.host", "localhost")
+	viper.SetDefault("database.port", 5432)
+	viper.SetDefault("database.sslmode", "disable")
+	viper.SetDefault("database.max_open_conns", 100)
+	viper.SetDefault("database.max_idle_conns", 10)
+	viper.SetDefault("redis.host", "localhost")
+	viper.SetDefault("redis.port", 6379)
+	viper.SetDefault("redis.db", 0)
+	viper.SetDefault("jwt.expire_hours", 24)
+	viper.SetDefault("subscribe.base_url", "http://localhost:8080")
+	viper.SetDefault("payment.notify_base_url", "http://localhost:8080")
+	viper.SetDefault("payment.fake.enabled", false)
+	viper.SetDefault("node_agent.user_cache_seconds", 60)
+	viper.SetDefault("node_agent.heartbeat_check_seconds", 30)
+	viper.SetDefault("node_agent.heartbeat_timeout_seconds", 90)
+	viper.SetDefault("node_agent.online_ttl_seconds", 180)
+	viper.SetDefault("probe.samples", 4)
+	viper.SetDefault("probe.timeout_ms", 3000)
+	viper.SetDefault("health_check.interval_seconds", 60)
+	viper.SetDefault("health_check.workers", 10)
+	viper.SetDefault("health_check.failure_threshold", 3)
+	viper.SetDefault("traffic.sync_interval_seconds", 300)
+	viper.SetDefault("traffic.reset_day", 1)
+	viper.SetDefault("traffic.rollup_interval_seconds", 600)
+	viper.SetDefault("traffic.raw_retention_days", 30)
+	viper.SetDefault("traffic.hourly_retention_days", 90)
+	viper.SetDefault("traffic.enforce_interval_seconds", 60)
+
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			log.Println("Config file not found, using defaults")
+			return nil
+		}
+		return err
+	}
+
+	log.Println("Config file loaded successfully")
+	return nil
+}
+
+// Database 返回数据库配置
+func Database() db.Config {
+	return db.Config{
+		Host:         viper.GetString("database.host"),
+		Port:         viper.GetInt("database.port"),
+		User:         viper.GetString("database.user"),
+		Password:     viper.GetString("database.password"),
+		DBName:       viper.GetString("database.dbname"),
+		SSLMode:      viper.GetString("database.sslmode"),
+		MaxOpenConns: viper.GetInt("database.max_open_conns"),
+		MaxIdleConns: viper.GetInt("database.max_idle_conns"),
+	}
+}
+
+// Redis 返回 Redis 配置
+func Redis() cache.Config {
+	return cache.Config{
+		Host:     viper.GetString("redis.host"),
+		Port:     viper.GetInt("redis.port"),
+		Password: viper.GetString("redis.password"),
+		DB:       viper.GetInt("redis.db"),
+	}
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"gorm.io/gorm"
+)
+
+// trafficLogPartitionPrefix traffic_logs 月分区表名前缀，如 traffic_logs_p202501
+const trafficLogPartitionPrefix = "traffic_logs_p"
+
+// IsPostgres 当前是否连接 PostgreSQL
+func IsPostgres() bool {
+	return DB != nil && DB.Dialector.Name() == "postgres"
+}
+
+// createPartitionedTrafficLogs 新安装时将 traffic_logs 创建为按 recorded_at 月份分区的表。
+// 已存在的普通表不做转换，需要时请手动迁移。
+func createPartitionedTrafficLogs() error {
+	if !IsPostgres() || DB.Migrator().HasTable("traffic_logs") {
+		return nil
+	}
+
+	ddl, err := trafficLogsDDL(DB)
+	if err != nil {
+		return err
+	}
+	if err := DB.Exec(ddl).Error; err != nil {
+		return fmt.Errorf("failed to create partitioned traffic_logs: %w", err)
+	}
+
+	// 兜底分区，避免月分区未及时创建时写入失败
+	if err := DB.Exec("CREATE TABLE traffic_logs_default PARTITION OF traffic_logs DEFAULT").Error; err != nil {
+		return fmt.Errorf("failed to create default partition: %w", err)
+	}
+
+	log.Println("Created partitioned traffic_logs table")
+	return nil
+}
+
+// trafficLogsDDL 根据 TrafficLog 模型生成分区表的建表语句，列定义与 GORM 建表一致，
+// 索引由之后的 AutoMigrate 创建。分区表的主键必须包含分区键。
+func trafficLogsDDL(tx *gorm.DB) (string, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(&model.TrafficLog{}); err != nil {
+		return "", fmt.Errorf("failed to parse traffic log schema: %w", err)
+	}
+
+	migrator := tx.Migrator()
+	columns := make([]string, 0, len(stmt.Schema.DBNames)+1)
+	for _, name := range stmt.Schema.DBNames {
+		field := stmt.Schema.FieldsByDBName[name]
+		columns = append(columns, fmt.Sprintf("%s %s", stmt.Quote(name), migrator.FullDataTypeOf(field).SQL))
+	}
+	columns = append(columns, "PRIMARY KEY (id, recorded_at)")
+
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n) PARTITION BY RANGE (recorded_at)",
+		stmt.Quote(stmt.Schema.Table), strings.Join(columns, ",\n\t")), nil
+}
+
+// isTrafficLogPartitioned traffic_logs 是否为分区表
+func isTrafficLogPartitioned() (bool, error) {
+	if !IsPostgres() {
+		return false, nil
+	}
+
+	var count int64
+	if err := DB.Raw(`SELECT COUNT(*) FROM pg_partitioned_table
+		WHERE partrelid = to_regclass('traffic_logs')`).Scan(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// EnsureTrafficLogPartitions 创建当月及之后 ahead 个月的 traffic_logs 分区，非分区表时不做处理
+func EnsureTrafficLogPartitions(now time.Time, ahead int) error {
+	partitioned, err := isTrafficLogPartitioned()
+	if err != nil || !partitioned {
+		return err
+	}
+
+	now = now.UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= ahead; i++ {
+		start := month.AddDate(0, i, 0)
+		end := start.AddDate(0, 1, 0)
+		sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s%s PARTITION OF traffic_logs
+			FOR VALUES FROM ('%s') TO ('%s')`,
+			trafficLogPartitionPrefix, start.Format("200601"),
+			start.Format(time.RFC3339), end.Format(time.RFC3339))
+		if err := DB.Exec(sql).Error; err != nil {
+			return fmt.Errorf("failed to create traffic_logs partition %s: %w", start.Format("200601"), err)
+		}
+	}
+	return nil
+}
+
+// DropTrafficLogPartitionsBefore 删除整月都早于 cutoff 的 traffic_logs 分区，返回删除的分区数
+func DropTrafficLogPartitionsBefore(cutoff time.Time) (int, error) {
+	partitioned, err := isTrafficLogPartitioned()
+	if err != nil || !partitioned {
+		return 0, err
+	}
+
+	var names []string
+	if err := DB.Raw(`SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = to_regclass('traffic_logs')`).Scan(&names).Error; err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, trafficLogPartitionPrefix) {
+			continue
+		}
+		start, err := time.Parse("200601", strings.TrimPrefix(name, trafficLogPartitionPrefix))
+		if err != nil {
+			continue
+		}
+		if start.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+
+		if err := DB.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", name)).Error; err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
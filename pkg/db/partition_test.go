@@ -0,0 +1,30 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mariclezhang/vps_backend/internal/model"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestTrafficLogsDDL(t *testing.T) {
+	// 只生成语句，不连接数据库
+	pg, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{DisableAutomaticPing: true})
+	assert.NoError(t, err)
+
+	ddl, err := trafficLogsDDL(pg)
+	assert.NoError(t, err)
+
+	// 分区表的列必须与模型一致，模型新增字段时自动包含
+	stmt := &gorm.Statement{DB: pg}
+	assert.NoError(t, stmt.Parse(&model.TrafficLog{}))
+	for _, name := range stmt.Schema.DBNames {
+		assert.Contains(t, ddl, `"`+name+`" `)
+	}
+	assert.Contains(t, ddl, `"id" bigserial`)
+	assert.Contains(t, ddl, "PRIMARY KEY (id, recorded_at)")
+	assert.True(t, strings.HasSuffix(ddl, "PARTITION BY RANGE (recorded_at)"))
+}
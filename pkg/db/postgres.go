@@ -33,6 +33,8 @@ func InitDB(cfg Config) error {
 	var err error
 	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
+		// 唯一约束冲突转换为 gorm.ErrDuplicatedKey，用于幂等去重
+		TranslateError: true,
 		NowFunc: func() time.Time {
 			return time.Now().UTC()
 		},
@@ -58,17 +60,37 @@ func InitDB(cfg Config) error {
 
 // AutoMigrate 自动迁移数据库表结构
 func AutoMigrate() error {
-	return DB.AutoMigrate(
+	// 新安装时 traffic_logs 按月分区，需在 GORM 建表前创建
+	if err := createPartitionedTrafficLogs(); err != nil {
+		return err
+	}
+
+	if err := DB.AutoMigrate(
 		&model.User{},
 		&model.SubscriptionPlan{},
 		&model.Subscription{},
+		&model.TrafficUsagePeriod{},
+		&model.TrafficPack{},
+		&model.TrafficPackPurchase{},
 		&model.Node{},
+		&model.NodeGroup{},
 		&model.UserNodeAccess{},
+		&model.NodeCredential{},
+		&model.NodeLatencyLog{},
 		&model.TrafficLog{},
+		&model.TrafficReport{},
+		&model.TrafficFlush{},
+		&model.TrafficHourly{},
+		&model.TrafficDaily{},
+		&model.TrafficRollupState{},
 		&model.Order{},
 		&model.Announcement{},
 		&model.PasswordReset{},
-	)
+	); err != nil {
+		return err
+	}
+
+	return EnsureTrafficLogPartitions(time.Now(), 2)
 }
 
 // GetDB 获取数据库实例
@@ -0,0 +1,156 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// FakeName 内置模拟支付的支付方式名称
+const FakeName = "fake"
+
+// FakeProvider 本地测试用的模拟支付渠道。
+// 支付地址即为签名后的异步通知地址，访问该地址即视为支付成功。
+type FakeProvider struct {
+	secret string
+
+	mu       sync.Mutex
+	payments map[string]*QueryResult
+	seq      int64
+}
+
+// NewFakeProvider 创建模拟支付渠道，secret 用于通知签名，为空时随机生成
+func NewFakeProvider(secret string) *FakeProvider {
+	if secret == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		secret = hex.EncodeToString(b)
+	}
+	return &FakeProvider{
+		secret:   secret,
+		payments: make(map[string]*QueryResult),
+	}
+}
+
+// Name 支付方式名称
+func (f *FakeProvider) Name() string {
+	return FakeName
+}
+
+// CreatePayment 记录待支付订单，返回签名后的通知地址作为支付地址
+func (f *FakeProvider) CreatePayment(_ context.Context, req Request) (*Payment, error) {
+	if req.OrderNo == "" || req.Amount <= 0 {
+		return nil, errors.New("无效的支付参数")
+	}
+
+	f.mu.Lock()
+	f.seq++
+	tradeNo := fmt.Sprintf("FAKE%s%d", req.OrderNo, f.seq)
+	f.payments[req.OrderNo] = &QueryResult{
+		OrderNo: req.OrderNo,
+		TradeNo: tradeNo,
+		Amount:  req.Amount,
+		Status:  StatusPending,
+	}
+	f.mu.Unlock()
+
+	payURL := req.NotifyURL + "?" + f.SignNotification(req.OrderNo, tradeNo, req.Amount, StatusPaid).Encode()
+	return &Payment{OrderNo: req.OrderNo, TradeNo: tradeNo, PayURL: payURL}, nil
+}
+
+// SignNotification 生成带签名的支付结果通知参数
+func (f *FakeProvider) SignNotification(orderNo, tradeNo string, amount float64, status string) url.Values {
+	values := url.Values{}
+	values.Set("order_no", orderNo)
+	values.Set("trade_no", tradeNo)
+	values.Set("amount", strconv.FormatFloat(amount, 'f', 2, 64))
+	values.Set("status", status)
+	values.Set("sign", f.sign(values))
+	return values
+}
+
+// sign 对除 sign 以外的参数按键名排序后计算 HMAC-SHA256
+func (f *FakeProvider) sign(values url.Values) string {
+	unsigned := url.Values{}
+	for key, v := range values {
+		if key != "sign" {
+			unsigned[key] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write([]byte(unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyCallback 校验通知签名，支持 GET 查询参数与 POST 表单
+func (f *FakeProvider) VerifyCallback(r *http.Request) (*Notification, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	values := r.Form
+	if !hmac.Equal([]byte(f.sign(values)), []byte(values.Get("sign"))) {
+		return nil, errors.New("支付通知签名无效")
+	}
+
+	amount, err := strconv.ParseFloat(values.Get("amount"), 64)
+	if err != nil {
+		return nil, errors.New("支付通知金额无效")
+	}
+
+	notification := &Notification{
+		OrderNo: values.Get("order_no"),
+		TradeNo: values.Get("trade_no"),
+		Amount:  amount,
+		Status:  values.Get("status"),
+	}
+
+	f.mu.Lock()
+	if p, ok := f.payments[notification.OrderNo]; ok && p.Status == StatusPending && notification.Status == StatusPaid {
+		p.Status = StatusPaid
+	}
+	f.mu.Unlock()
+
+	return notification, nil
+}
+
+// Query 查询模拟支付状态
+func (f *FakeProvider) Query(_ context.Context, orderNo string) (*QueryResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[orderNo]
+	if !ok {
+		return nil, errors.New("支付记录不存在")
+	}
+	result := *p
+	return &result, nil
+}
+
+// Refund 模拟退款
+func (f *FakeProvider) Refund(_ context.Context, orderNo string, amount float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[orderNo]
+	if !ok {
+		return errors.New("支付记录不存在")
+	}
+	if p.Status != StatusPaid {
+		return errors.New("订单未支付，无法退款")
+	}
+	if amount <= 0 || amount > p.Amount {
+		return errors.New("退款金额无效")
+	}
+	p.Status = StatusRefunded
+	return nil
+}
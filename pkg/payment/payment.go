@@ -0,0 +1,100 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// 支付状态
+const (
+	StatusPending  = "pending"
+	StatusPaid     = "paid"
+	StatusRefunded = "refunded"
+)
+
+// ErrProviderNotFound 支付方式未注册
+var ErrProviderNotFound = errors.New("不支持的支付方式")
+
+// Request 发起支付的参数，金额单位为元
+type Request struct {
+	OrderNo   string
+	Amount    float64
+	Subject   string
+	NotifyURL string // 支付结果异步通知地址
+	ReturnURL string // 支付完成后跳转的页面
+}
+
+// Payment 发起支付的结果
+type Payment struct {
+	OrderNo string `json:"orderNo"`
+	TradeNo string `json:"tradeNo"` // 支付渠道的交易号
+	PayURL  string `json:"payUrl"`  // 用户完成支付的地址
+}
+
+// Notification 已验签的支付结果通知
+type Notification struct {
+	OrderNo string
+	TradeNo string
+	Amount  float64
+	Status  string
+}
+
+// QueryResult 主动查询的支付状态
+type QueryResult struct {
+	OrderNo string
+	TradeNo string
+	Amount  float64
+	Status  string
+}
+
+// Provider 支付渠道
+type Provider interface {
+	// Name 支付方式名称，与订单的 paymentMethod 对应
+	Name() string
+	// CreatePayment 创建支付，返回用户完成支付的地址
+	CreatePayment(ctx context.Context, req Request) (*Payment, error)
+	// VerifyCallback 校验支付渠道的异步通知，签名无效时返回错误
+	VerifyCallback(r *http.Request) (*Notification, error)
+	// Query 主动查询订单的支付状态
+	Query(ctx context.Context, orderNo string) (*QueryResult, error)
+	// Refund 对已支付的订单退款
+	Refund(ctx context.Context, orderNo string, amount float64) error
+}
+
+var (
+	mu        sync.RWMutex
+	providers = make(map[string]Provider)
+)
+
+// Register 注册支付渠道，同名渠道会被替换
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[p.Name()] = p
+}
+
+// Get 获取已注册的支付渠道
+func Get(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrProviderNotFound
+	}
+	return p, nil
+}
+
+// Names 已注册的支付方式
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,151 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+	"time"
+)
+
+// Options 探测参数
+type Options struct {
+	Samples    int           // 采样次数
+	Timeout    time.Duration // 单次探测超时
+	Interval   time.Duration // 采样间隔
+	TLS        bool          // 建立连接后是否进行 TLS 握手
+	ServerName string        // TLS SNI，为空时使用目标主机名
+}
+
+// DefaultOptions 默认探测参数
+var DefaultOptions = Options{
+	Samples:  4,
+	Timeout:  3 * time.Second,
+	Interval: 200 * time.Millisecond,
+}
+
+// Result 探测结果，延迟单位为毫秒
+type Result struct {
+	Latency  int     `json:"latency"`  // 中位数延迟
+	Min      int     `json:"min"`      // 最小延迟
+	Max      int     `json:"max"`      // 最大延迟
+	Jitter   int     `json:"jitter"`   // 抖动，相邻成功样本延迟差的平均值
+	Loss     float64 `json:"loss"`     // 丢包率 %
+	Samples  int     `json:"samples"`  // 采样次数
+	Received int     `json:"received"` // 成功次数
+	TLS      bool    `json:"tls"`      // 是否包含 TLS 握手
+}
+
+// TCP 对 address (host:port) 进行多次 TCP 连接探测，可选 TLS 握手。
+// 连接失败计为丢包，只有 ctx 取消时返回错误。
+func TCP(ctx context.Context, address string, opts Options) (*Result, error) {
+	if opts.Samples <= 0 {
+		opts.Samples = DefaultOptions.Samples
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+
+	rtts := make([]time.Duration, 0, opts.Samples)
+	for i := 0; i < opts.Samples; i++ {
+		if i > 0 && opts.Interval > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(opts.Interval):
+			}
+		}
+
+		rtt, err := dial(ctx, address, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+
+	return summarize(rtts, opts.Samples, opts.TLS), nil
+}
+
+// dial 建立一次连接并返回耗时
+func dial(ctx context.Context, address string, opts Options) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if opts.TLS {
+		serverName := opts.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(address)
+		}
+		// 只测量握手耗时，节点常使用自签证书，不校验证书链
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	return time.Since(start), nil
+}
+
+// summarize 根据成功样本计算中位数、抖动和丢包率
+func summarize(rtts []time.Duration, samples int, withTLS bool) *Result {
+	result := &Result{
+		Samples:  samples,
+		Received: len(rtts),
+		TLS:      withTLS,
+		Loss:     float64(samples-len(rtts)) * 100 / float64(samples),
+	}
+	if len(rtts) == 0 {
+		return result
+	}
+
+	// 抖动按采样顺序计算
+	var jitter time.Duration
+	for i := 1; i < len(rtts); i++ {
+		diff := rtts[i] - rtts[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		jitter += diff
+	}
+	if len(rtts) > 1 {
+		jitter /= time.Duration(len(rtts) - 1)
+	}
+
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+
+	result.Latency = toMillis(median)
+	result.Min = toMillis(sorted[0])
+	result.Max = toMillis(sorted[len(sorted)-1])
+	result.Jitter = toMillis(jitter)
+	return result
+}
+
+// toMillis 转换为毫秒，不足 1ms 的成功样本记为 1ms 以区别于失败
+func toMillis(d time.Duration) int {
+	ms := int(d.Round(time.Millisecond) / time.Millisecond)
+	if ms == 0 && d > 0 {
+		return 1
+	}
+	return ms
+}
@@ -0,0 +1,109 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCP_LocalListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	result, err := TCP(context.Background(), ln.Addr().String(), Options{Samples: 3, Timeout: time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Samples)
+	assert.Equal(t, 3, result.Received)
+	assert.Equal(t, float64(0), result.Loss)
+	assert.GreaterOrEqual(t, result.Latency, 1)
+	assert.LessOrEqual(t, result.Min, result.Latency)
+	assert.GreaterOrEqual(t, result.Max, result.Latency)
+}
+
+func TestTCP_TLSHandshake(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+	result, err := TCP(context.Background(), address, Options{Samples: 2, Timeout: time.Second, TLS: true})
+	assert.NoError(t, err)
+	assert.True(t, result.TLS)
+	assert.Equal(t, 2, result.Received)
+}
+
+func TestTCP_Unreachable(t *testing.T) {
+	// 获取一个空闲端口后关闭，保证连接被拒绝
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	result, err := TCP(context.Background(), address, Options{Samples: 2, Timeout: 500 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Received)
+	assert.Equal(t, float64(100), result.Loss)
+	assert.Equal(t, 0, result.Latency)
+}
+
+func TestTCP_NoTLSServer(t *testing.T) {
+	// 普通 TCP 服务无法完成 TLS 握手，计为丢包
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	result, err := TCP(context.Background(), ln.Addr().String(), Options{Samples: 2, Timeout: 500 * time.Millisecond, TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Received)
+}
+
+func TestSummarize(t *testing.T) {
+	rtts := []time.Duration{
+		10 * time.Millisecond,
+		30 * time.Millisecond,
+		20 * time.Millisecond,
+	}
+
+	result := summarize(rtts, 4, false)
+	assert.Equal(t, 20, result.Latency)
+	assert.Equal(t, 10, result.Min)
+	assert.Equal(t, 30, result.Max)
+	assert.Equal(t, 15, result.Jitter) // (|30-10| + |20-30|) / 2
+	assert.Equal(t, float64(25), result.Loss)
+	assert.Equal(t, 3, result.Received)
+
+	// 偶数个样本取中间两个的平均值
+	result = summarize([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, 2, false)
+	assert.Equal(t, 15, result.Latency)
+}